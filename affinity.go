@@ -0,0 +1,88 @@
+package jiffy
+
+import (
+	"sort"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/ipfs/go-cid"
+)
+
+var (
+	_ Packer = (*affinityPacker)(nil)
+)
+
+type (
+	// SegmentOption represents a configurable parameter of a segment at the time of segmentation.
+	SegmentOption  func(*segmentOptions)
+	segmentOptions struct {
+		affinityGroup string
+		root          cid.Cid
+	}
+
+	// affinityPacker wraps a Packer such that segments are only co-located in the same piece if they belong to the
+	// same affinity pool. An affinity pool is either a single affinity group, or a set of groups that are allowed to
+	// share pieces.
+	affinityPacker struct {
+		packer Packer
+		// pools maps affinity groups that share pieces to a common pool key. Groups absent from the map form a pool
+		// of their own.
+		pools map[string]string
+	}
+)
+
+// SegmentWithAffinityGroup sets the affinity group of segment, e.g. a tenant, dataset or retention class.
+// Segments are only packed into the same piece as segments of the same affinity group, unless their groups are
+// configured to share pieces via WithSharedAffinityGroups. Identical data cannot belong to more than one group; see
+// ErrSegmentAffinityConflict.
+// Defaults to empty, i.e. the default group.
+func SegmentWithAffinityGroup(group string) SegmentOption {
+	return func(o *segmentOptions) {
+		o.affinityGroup = group
+	}
+}
+
+func newSegmentOptions(o ...SegmentOption) *segmentOptions {
+	var opts segmentOptions
+	for _, apply := range o {
+		apply(&opts)
+	}
+	return &opts
+}
+
+func newAffinityPacker(packer Packer, pools map[string]string) *affinityPacker {
+	return &affinityPacker{packer: packer, pools: pools}
+}
+
+func (a *affinityPacker) pool(group string) string {
+	if pool, ok := a.pools[group]; ok {
+		return pool
+	}
+	return group
+}
+
+// Pack packs the segments of each affinity pool separately using the wrapped packer. The maxPieces limit applies to
+// each pool, so that no pool is starved of pieces by another.
+func (a *affinityPacker) Pack(segments []*Segment, capacity abi.PaddedPieceSize, maxPieces int) ([]*Piece, []*Segment, error) {
+	segmentsByPool := make(map[string][]*Segment)
+	for _, segment := range segments {
+		pool := a.pool(segment.AffinityGroup)
+		segmentsByPool[pool] = append(segmentsByPool[pool], segment)
+	}
+	pools := make([]string, 0, len(segmentsByPool))
+	for pool := range segmentsByPool {
+		pools = append(pools, pool)
+	}
+	sort.Strings(pools)
+
+	var pieces []*Piece
+	var unpacked []*Segment
+	for _, pool := range pools {
+		poolPieces, poolUnpacked, err := a.packer.Pack(segmentsByPool[pool], capacity, maxPieces)
+		if err != nil {
+			return nil, nil, err
+		}
+		pieces = append(pieces, poolPieces...)
+		unpacked = append(unpacked, poolUnpacked...)
+	}
+	return pieces, unpacked, nil
+}
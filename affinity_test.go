@@ -0,0 +1,90 @@
+package jiffy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAffinityPacker_IsolatesGroups(t *testing.T) {
+	opts, err := applyTestOptions(WithSharedAffinityGroups("b", "c"))
+	require.NoError(t, err)
+	subject := newAffinityPacker(NewBestFitPacker(), opts.replicatorAffinityPools)
+
+	now := time.Now()
+	var segments []*Segment
+	for _, group := range []string{"a", "a", "b", "c", ""} {
+		segment := newFakeSegment(t, 1*KiB, now)
+		segment.AffinityGroup = group
+		segments = append(segments, segment)
+	}
+	pieces, unpacked, err := subject.Pack(segments, 64*KiB, 1)
+	require.NoError(t, err)
+	require.Empty(t, unpacked)
+	require.Len(t, pieces, 3)
+
+	var gotGroups [][]string
+	for _, piece := range pieces {
+		var groups []string
+		for _, segment := range piece.contentSegments() {
+			groups = append(groups, segment.AffinityGroup)
+		}
+		sort.Strings(groups)
+		gotGroups = append(gotGroups, groups)
+	}
+	require.ElementsMatch(t, [][]string{{""}, {"a", "a"}, {"b", "c"}}, gotGroups)
+}
+
+func TestWithSharedAffinityGroups_MergesOverlappingSets(t *testing.T) {
+	opts, err := applyTestOptions(
+		WithSharedAffinityGroups("a", "b"),
+		WithSharedAffinityGroups("c", "d"),
+		WithSharedAffinityGroups("d", "b"),
+	)
+	require.NoError(t, err)
+	pools := opts.replicatorAffinityPools
+	for _, group := range []string{"b", "c", "d"} {
+		require.Equal(t, pools["a"], pools[group])
+	}
+	_, err = applyTestOptions(WithSharedAffinityGroups("a"))
+	require.Error(t, err)
+}
+
+func TestHeadlessCarSegmentor_RejectsDuplicateAcrossGroups(t *testing.T) {
+	ctx := context.Background()
+	subject := newTestSegmentor(t)
+	data := bytes.Repeat([]byte("fish"), 1024)
+	segment := func(group string) (*Segment, error) {
+		return subject.Segment(ctx, io.NopCloser(bytes.NewReader(data)), SegmentWithAffinityGroup(group))
+	}
+
+	fish, err := segment("fish")
+	require.NoError(t, err)
+	again, err := segment("fish")
+	require.NoError(t, err)
+	require.Equal(t, fish.Info, again.Info)
+
+	_, err = segment("lobster")
+	require.ErrorIs(t, err, ErrSegmentAffinityConflict)
+	got, err := subject.GetSegment(ctx, fish.Info)
+	require.NoError(t, err)
+	require.Equal(t, "fish", got.AffinityGroup)
+	segments, err := subject.ListSegments(ctx)
+	require.NoError(t, err)
+	require.Len(t, segments, 1)
+}
+
+func applyTestOptions(o ...Option) (*options, error) {
+	var opts options
+	for _, apply := range o {
+		if err := apply(&opts); err != nil {
+			return nil, err
+		}
+	}
+	return &opts, nil
+}
@@ -0,0 +1,143 @@
+package jiffy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-shipyard/boostly"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+const (
+	filStorageAskProtocol_1_1_0 = "/fil/storage/ask/1.1.0"
+
+	askStreamTimeout = 10 * time.Second
+)
+
+// queryStorageAsk queries the current storage ask of the given storage provider over the storage ask protocol.
+func queryStorageAsk(ctx context.Context, h host.Host, id peer.ID, sp address.Address) (*boostly.StorageAsk, error) {
+	s, err := h.NewStream(ctx, id, filStorageAskProtocol_1_1_0)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = s.Close() }()
+	deadline := time.Now().Add(askStreamTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = s.SetDeadline(deadline)
+
+	if err := encodeAskRequest(s, sp); err != nil {
+		return nil, fmt.Errorf("failed to send ask request: %w", err)
+	}
+	ask, err := decodeAskResponse(s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ask response: %w", err)
+	}
+	if ask == nil {
+		return nil, fmt.Errorf("provider %s has no storage ask", sp)
+	}
+	return ask, nil
+}
+
+// encodeAskRequest encodes the map-encoded ask request of the storage ask protocol, i.e. {"Miner": sp}.
+func encodeAskRequest(w io.Writer, sp address.Address) error {
+	cw := cbg.NewCborWriter(w)
+	if err := cw.WriteMajorTypeHeader(cbg.MajMap, 1); err != nil {
+		return err
+	}
+	if err := cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len("Miner"))); err != nil {
+		return err
+	}
+	if _, err := cw.WriteString("Miner"); err != nil {
+		return err
+	}
+	return sp.MarshalCBOR(cw)
+}
+
+// decodeAskResponse decodes the map-encoded ask response of the storage ask protocol, i.e.
+// {"Ask": {"Ask": StorageAsk, "Signature": ...}}. The signature is not verified, since the response is received
+// directly from the storage provider over an authenticated libp2p stream.
+func decodeAskResponse(r io.Reader) (*boostly.StorageAsk, error) {
+	cr := cbg.NewCborReader(r)
+	var ask *boostly.StorageAsk
+	err := decodeMapFields(cr, "AskResponse", func(name string) (bool, error) {
+		if name != "Ask" {
+			return false, nil
+		}
+		return true, decodeNullable(cr, func() error {
+			return decodeMapFields(cr, "SignedStorageAsk", func(name string) (bool, error) {
+				if name != "Ask" {
+					return false, nil
+				}
+				return true, decodeNullable(cr, func() error {
+					ask = &boostly.StorageAsk{}
+					return ask.UnmarshalCBOR(cr)
+				})
+			})
+		})
+	})
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	return ask, err
+}
+
+// decodeMapFields reads a CBOR map with string keys, calling decodeField for each key. Fields for which
+// decodeField returns false are skipped.
+func decodeMapFields(cr *cbg.CborReader, typeName string, decodeField func(name string) (bool, error)) error {
+	maj, extra, err := cr.ReadHeader()
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajMap {
+		return fmt.Errorf("%s: cbor input should be of type map", typeName)
+	}
+	if extra > cbg.MaxLength {
+		return fmt.Errorf("%s: map struct too large (%d)", typeName, extra)
+	}
+	for i := uint64(0); i < extra; i++ {
+		name, err := cbg.ReadString(cr)
+		if err != nil {
+			return err
+		}
+		switch decoded, err := decodeField(name); {
+		case err != nil:
+			return err
+		case !decoded:
+			if err := cbg.ScanForLinks(cr, func(cid.Cid) {}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// decodeNullable calls decode unless the next CBOR value is null.
+func decodeNullable(cr *cbg.CborReader, decode func() error) error {
+	b, err := cr.ReadByte()
+	if err != nil {
+		return err
+	}
+	if b == cbg.CborNull[0] {
+		return nil
+	}
+	if err := cr.UnreadByte(); err != nil {
+		return err
+	}
+	return decode()
+}
+
+// askPricePerEpoch converts the given price per GiB per epoch to the price per epoch of a piece of the given size.
+func askPricePerEpoch(pricePerGiBEpoch abi.TokenAmount, pieceSize abi.PaddedPieceSize) abi.TokenAmount {
+	return big.Div(big.Mul(pricePerGiBEpoch, big.NewIntUnsigned(uint64(pieceSize))), big.NewIntUnsigned(GiB))
+}
@@ -0,0 +1,60 @@
+package jiffy
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-shipyard/boostly"
+	"github.com/stretchr/testify/require"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+func TestDecodeAskResponse(t *testing.T) {
+	sp, err := address.NewIDAddress(1413)
+	require.NoError(t, err)
+	want := boostly.StorageAsk{
+		Price:         big.NewInt(100),
+		VerifiedPrice: big.NewInt(0),
+		MinPieceSize:  256,
+		MaxPieceSize:  32 * GiB,
+		Miner:         sp,
+	}
+
+	var buf bytes.Buffer
+	cw := cbg.NewCborWriter(&buf)
+	writeKey := func(key string) {
+		require.NoError(t, cw.WriteMajorTypeHeader(cbg.MajTextString, uint64(len(key))))
+		_, err := cw.WriteString(key)
+		require.NoError(t, err)
+	}
+	require.NoError(t, cw.WriteMajorTypeHeader(cbg.MajMap, 1))
+	writeKey("Ask")
+	require.NoError(t, cw.WriteMajorTypeHeader(cbg.MajMap, 2))
+	writeKey("Signature")
+	require.NoError(t, cw.WriteMajorTypeHeader(cbg.MajByteString, 3))
+	_, err = cw.Write([]byte{1, 2, 3})
+	require.NoError(t, err)
+	writeKey("Ask")
+	require.NoError(t, want.MarshalCBOR(cw))
+
+	got, err := decodeAskResponse(&buf)
+	require.NoError(t, err)
+	require.Equal(t, want, *got)
+
+	// Assert that absent asks are decoded as nil.
+	buf.Reset()
+	require.NoError(t, cw.WriteMajorTypeHeader(cbg.MajMap, 1))
+	writeKey("Ask")
+	_, err = cw.Write(cbg.CborNull)
+	require.NoError(t, err)
+	got, err = decodeAskResponse(&buf)
+	require.NoError(t, err)
+	require.Nil(t, got)
+}
+
+func TestAskPricePerEpoch(t *testing.T) {
+	require.Equal(t, big.NewInt(3200), askPricePerEpoch(big.NewInt(100), 32*GiB))
+	require.Equal(t, big.NewInt(50), askPricePerEpoch(big.NewInt(100), 512*MiB))
+}
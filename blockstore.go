@@ -0,0 +1,130 @@
+package jiffy
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync/atomic"
+
+	"github.com/ipfs/boxo/blockstore"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+var (
+	_ blockstore.Blockstore = (*segmentBlockstore)(nil)
+)
+
+type (
+	// segmentBlockstore is a read-only blockstore.Blockstore that serves the CAR sections of local segments.
+	// The blocks are looked up using the per-segment CID index, populated by headlessCarSegmentor at the time of
+	// segmentation.
+	segmentBlockstore struct {
+		s          *headlessCarSegmentor
+		hashOnRead atomic.Bool
+	}
+)
+
+func newSegmentBlockstore(s *headlessCarSegmentor) (*segmentBlockstore, error) {
+	return &segmentBlockstore{s: s}, nil
+}
+
+func (b *segmentBlockstore) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	_, _, found := b.s.locate(c)
+	select {
+	case <-ctx.Done():
+		return false, ctx.Err()
+	default:
+		return found, nil
+	}
+}
+
+func (b *segmentBlockstore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	path, location, found := b.s.locate(c)
+	if !found {
+		return nil, ipld.ErrNotFound{Cid: c}
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	data := make([]byte, location.length)
+	// Segment files shorter than the recorded location, e.g. once truncated, must not yield zero-padded blocks.
+	if n, err := f.ReadAt(data, location.offset); n < len(data) {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if b.hashOnRead.Load() {
+		rc, err := c.Prefix().Sum(data)
+		if err != nil {
+			return nil, err
+		}
+		if !rc.Equals(c) {
+			return nil, blockstore.ErrHashMismatch
+		}
+	}
+	return blocks.NewBlockWithCid(data, c)
+}
+
+func (b *segmentBlockstore) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	_, location, found := b.s.locate(c)
+	if !found {
+		return -1, ipld.ErrNotFound{Cid: c}
+	}
+	select {
+	case <-ctx.Done():
+		return -1, ctx.Err()
+	default:
+		return int(location.length), nil
+	}
+}
+
+func (b *segmentBlockstore) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
+	// Take a snapshot of all keys to avoid holding the segments lock while the caller consumes the channel.
+	var keys []cid.Cid
+	b.s.segmentsMutex.RLock()
+	for _, segment := range b.s.segments {
+		for mh := range segment.index {
+			keys = append(keys, cid.NewCidV1(cid.Raw, []byte(mh)))
+		}
+	}
+	b.s.segmentsMutex.RUnlock()
+
+	out := make(chan cid.Cid)
+	go func() {
+		defer close(out)
+		for _, key := range keys {
+			select {
+			case <-ctx.Done():
+				return
+			case out <- key:
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (b *segmentBlockstore) HashOnRead(enabled bool) {
+	b.hashOnRead.Store(enabled)
+}
+
+func (*segmentBlockstore) DeleteBlock(context.Context, cid.Cid) error {
+	return ErrReadOnlyBlockstore
+}
+
+func (*segmentBlockstore) Put(context.Context, blocks.Block) error {
+	return ErrReadOnlyBlockstore
+}
+
+func (*segmentBlockstore) PutMany(context.Context, []blocks.Block) error {
+	return ErrReadOnlyBlockstore
+}
@@ -0,0 +1,89 @@
+package jiffy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSegmentBlockstore(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSegmentor(t)
+	subject, err := newSegmentBlockstore(s)
+	require.NoError(t, err)
+
+	data := make([]byte, 3*KiB+7)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+	_, err = s.Segment(ctx, io.NopCloser(bytes.NewReader(data)))
+	require.NoError(t, err)
+
+	var wantCids []cid.Cid
+	for chunk := data; len(chunk) > 0; {
+		n := len(chunk)
+		if n > KiB {
+			n = KiB
+		}
+		mh, err := multihash.Sum(chunk[:n], multihash.SHA2_256, -1)
+		require.NoError(t, err)
+		c := cid.NewCidV1(cid.Raw, mh)
+		wantCids = append(wantCids, c)
+
+		has, err := subject.Has(ctx, c)
+		require.NoError(t, err)
+		require.True(t, has)
+		size, err := subject.GetSize(ctx, c)
+		require.NoError(t, err)
+		require.Equal(t, n, size)
+		subject.HashOnRead(true)
+		blk, err := subject.Get(ctx, c)
+		require.NoError(t, err)
+		require.Equal(t, chunk[:n], blk.RawData())
+		chunk = chunk[n:]
+	}
+
+	keys, err := subject.AllKeysChan(ctx)
+	require.NoError(t, err)
+	var gotCids []cid.Cid
+	for key := range keys {
+		gotCids = append(gotCids, key)
+	}
+	require.ElementsMatch(t, wantCids, gotCids)
+
+	absent, err := cid.Prefix{Version: 1, Codec: cid.Raw, MhType: multihash.SHA2_256, MhLength: -1}.Sum([]byte("fish"))
+	require.NoError(t, err)
+	_, err = subject.Get(ctx, absent)
+	require.True(t, ipld.IsNotFound(err))
+	require.ErrorIs(t, subject.Put(ctx, nil), ErrReadOnlyBlockstore)
+}
+
+func TestSegmentBlockstore_TruncatedSegment(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSegmentor(t)
+	subject, err := newSegmentBlockstore(s)
+	require.NoError(t, err)
+
+	data := make([]byte, 2*KiB)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+	_, err = s.Segment(ctx, io.NopCloser(bytes.NewReader(data)))
+	require.NoError(t, err)
+	mh, err := multihash.Sum(data[KiB:], multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	c := cid.NewCidV1(cid.Raw, mh)
+	path, location, found := s.locate(c)
+	require.True(t, found)
+
+	// Truncate the segment file halfway through the last block.
+	require.NoError(t, os.Truncate(path, location.offset+location.length/2))
+	_, err = subject.Get(ctx, c)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
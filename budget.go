@@ -0,0 +1,267 @@
+package jiffy
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/builtin/v9/market"
+	"github.com/google/uuid"
+)
+
+type (
+	// DealBudget reports the storage price committed by deal proposals against the limits set by WithDailyBudget,
+	// WithTotalBudget and WithTenantBudget.
+	DealBudget struct {
+		// Day is the start of the current UTC day, over which Daily is accounted.
+		Day   time.Time
+		Daily DealBudgetUsage
+		Total DealBudgetUsage
+		// Tenants reports the usage per tenant, i.e. per segment affinity group. See SegmentWithAffinityGroup.
+		Tenants map[string]DealBudgetUsage
+	}
+	// DealBudgetUsage reports the storage price committed against a budget limit.
+	DealBudgetUsage struct {
+		// Committed is the total storage price of proposals accepted by storage providers.
+		Committed abi.TokenAmount
+		// Reserved is the total storage price of proposals in flight.
+		Reserved abi.TokenAmount
+		// Limit is the configured limit, if any.
+		Limit *abi.TokenAmount `json:",omitempty"`
+	}
+
+	// dealBudget accounts for the total storage price of deal proposals, i.e. the FIL committed to storage providers
+	// over the duration of deals, and refuses proposals that would exceed the configured limits. Committed amounts
+	// are rebuilt from the deal journal upon start, so that limits hold across restarts.
+	dealBudget struct {
+		j *Jiffy
+
+		mutex        sync.Mutex
+		day          time.Time
+		dayCommitted abi.TokenAmount
+		total        abi.TokenAmount
+		tenants      map[string]abi.TokenAmount
+		// reserved maps the deal UUID of proposals in flight to their charge.
+		reserved map[uuid.UUID]budgetCharge
+	}
+	// budgetCharge is the storage price of a proposal, and the share of it charged to each tenant of the piece.
+	budgetCharge struct {
+		amount  abi.TokenAmount
+		tenants map[string]abi.TokenAmount
+	}
+)
+
+func newDealBudget(j *Jiffy) (*dealBudget, error) {
+	b := &dealBudget{
+		j:            j,
+		day:          budgetDay(time.Now()),
+		dayCommitted: big.Zero(),
+		total:        big.Zero(),
+		tenants:      make(map[string]abi.TokenAmount),
+		reserved:     make(map[uuid.UUID]budgetCharge),
+	}
+	if err := b.load(context.Background()); err != nil {
+		return nil, fmt.Errorf("failed to load committed budget from deal journal: %w", err)
+	}
+	return b, nil
+}
+
+// load sums the storage price of the proposals accepted according to the deal journal, including those whose outcome
+// is unknown, since the provider may have accepted them.
+func (b *dealBudget) load(ctx context.Context) error {
+	entries, err := b.j.journal.query(ctx, DealJournalQuery{})
+	if err != nil {
+		return err
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, entry := range entries {
+		if !(entry.Accepted || entry.OutcomeUnknown) || entry.DryRun || entry.Proposal == nil {
+			continue
+		}
+		b.add(entry.Time, budgetCharge{
+			amount:  entry.Proposal.Proposal.TotalStorageFee(),
+			tenants: entry.TenantCharges,
+		})
+	}
+	return nil
+}
+
+// newBudgetCharge returns the charge of the given proposal for the given piece. The storage price is shared across
+// the tenants of the piece in proportion to the size of their segments. Segments without a tenant are not charged
+// to any tenant.
+func newBudgetCharge(piece *Piece, proposal market.DealProposal) budgetCharge {
+	charge := budgetCharge{
+		amount:  proposal.TotalStorageFee(),
+		tenants: make(map[string]abi.TokenAmount),
+	}
+	if piece.TotalSegmentedSize == 0 {
+		return charge
+	}
+	sizes := make(map[string]uint64)
+	for _, segment := range piece.Segments {
+		if segment.AffinityGroup != "" {
+			sizes[segment.AffinityGroup] += segment.SegmentedSize
+		}
+	}
+	total := big.NewIntUnsigned(piece.TotalSegmentedSize)
+	for tenant, size := range sizes {
+		charge.tenants[tenant] = big.Div(big.Mul(charge.amount, big.NewIntUnsigned(size)), total)
+	}
+	return charge
+}
+
+// reserve reserves the given charge for the proposal with the given deal UUID. It returns an error wrapping
+// ErrBudgetExceeded if the charge, on top of committed and reserved amounts, would exceed any of the limits.
+func (b *dealBudget) reserve(dealUUID uuid.UUID, charge budgetCharge) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err := b.exceeds(charge); err != nil {
+		return err
+	}
+	b.reserved[dealUUID] = charge
+	return nil
+}
+
+// check checks that the given charge is within the limits, without reserving it.
+func (b *dealBudget) check(charge budgetCharge) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.exceeds(charge)
+}
+
+// commit counts the charge reserved for the given deal UUID as committed, e.g. once the proposal is accepted.
+func (b *dealBudget) commit(dealUUID uuid.UUID) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	charge, ok := b.reserved[dealUUID]
+	if !ok {
+		return
+	}
+	delete(b.reserved, dealUUID)
+	b.add(time.Now(), charge)
+}
+
+// release releases the charge reserved for the given deal UUID, e.g. once the proposal is rejected.
+func (b *dealBudget) release(dealUUID uuid.UUID) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.reserved, dealUUID)
+}
+
+// status reports the current usage against the configured limits.
+func (b *dealBudget) status() *DealBudget {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.rollover(time.Now())
+	reserved, tenantsReserved := b.reservedTotals()
+	status := &DealBudget{
+		Day:     b.day,
+		Daily:   newDealBudgetUsage(b.dayCommitted, reserved, b.j.budgetDaily),
+		Total:   newDealBudgetUsage(b.total, reserved, b.j.budgetTotal),
+		Tenants: make(map[string]DealBudgetUsage),
+	}
+	for tenant, committed := range b.tenants {
+		status.Tenants[tenant] = newDealBudgetUsage(committed, tenantsReserved[tenant], b.j.budgetTenants[tenant])
+	}
+	for tenant, limit := range b.j.budgetTenants {
+		if _, ok := status.Tenants[tenant]; !ok {
+			status.Tenants[tenant] = newDealBudgetUsage(big.Zero(), tenantsReserved[tenant], limit)
+		}
+	}
+	return status
+}
+
+// exceeds returns an error wrapping ErrBudgetExceeded if the given charge would exceed any of the limits. The
+// caller must hold the mutex lock.
+func (b *dealBudget) exceeds(charge budgetCharge) error {
+	b.rollover(time.Now())
+	reserved, tenantsReserved := b.reservedTotals()
+	if limit := b.j.budgetDaily; limit.Int != nil {
+		if needed := big.Sum(b.dayCommitted, reserved, charge.amount); needed.GreaterThan(limit) {
+			return fmt.Errorf("%w: daily budget of %s would be exceeded by %s", ErrBudgetExceeded, limit, big.Sub(needed, limit))
+		}
+	}
+	if limit := b.j.budgetTotal; limit.Int != nil {
+		if needed := big.Sum(b.total, reserved, charge.amount); needed.GreaterThan(limit) {
+			return fmt.Errorf("%w: total budget of %s would be exceeded by %s", ErrBudgetExceeded, limit, big.Sub(needed, limit))
+		}
+	}
+	for tenant, amount := range charge.tenants {
+		limit, ok := b.j.budgetTenants[tenant]
+		if !ok {
+			continue
+		}
+		committed, ok := b.tenants[tenant]
+		if !ok {
+			committed = big.Zero()
+		}
+		tenantReserved, ok := tenantsReserved[tenant]
+		if !ok {
+			tenantReserved = big.Zero()
+		}
+		if needed := big.Sum(committed, tenantReserved, amount); needed.GreaterThan(limit) {
+			return fmt.Errorf("%w: budget of tenant %q of %s would be exceeded by %s", ErrBudgetExceeded, tenant, limit, big.Sub(needed, limit))
+		}
+	}
+	return nil
+}
+
+// add counts the given charge as committed at the given time. The caller must hold the mutex lock.
+func (b *dealBudget) add(at time.Time, charge budgetCharge) {
+	b.rollover(time.Now())
+	b.total = big.Add(b.total, charge.amount)
+	if budgetDay(at).Equal(b.day) {
+		b.dayCommitted = big.Add(b.dayCommitted, charge.amount)
+	}
+	for tenant, amount := range charge.tenants {
+		committed, ok := b.tenants[tenant]
+		if !ok {
+			committed = big.Zero()
+		}
+		b.tenants[tenant] = big.Add(committed, amount)
+	}
+}
+
+// rollover resets the daily committed amount once the day is over. The caller must hold the mutex lock.
+func (b *dealBudget) rollover(now time.Time) {
+	if today := budgetDay(now); !today.Equal(b.day) {
+		b.day = today
+		b.dayCommitted = big.Zero()
+	}
+}
+
+// reservedTotals sums the reserved charges, overall and per tenant. The caller must hold the mutex lock.
+func (b *dealBudget) reservedTotals() (abi.TokenAmount, map[string]abi.TokenAmount) {
+	reserved := big.Zero()
+	tenants := make(map[string]abi.TokenAmount)
+	for _, charge := range b.reserved {
+		reserved = big.Add(reserved, charge.amount)
+		for tenant, amount := range charge.tenants {
+			if existing, ok := tenants[tenant]; ok {
+				amount = big.Add(existing, amount)
+			}
+			tenants[tenant] = amount
+		}
+	}
+	return reserved, tenants
+}
+
+func newDealBudgetUsage(committed, reserved, limit abi.TokenAmount) DealBudgetUsage {
+	if reserved.Int == nil {
+		reserved = big.Zero()
+	}
+	usage := DealBudgetUsage{Committed: committed, Reserved: reserved}
+	if limit.Int != nil {
+		usage.Limit = &limit
+	}
+	return usage
+}
+
+// budgetDay returns the start of the UTC day of the given time.
+func budgetDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
@@ -0,0 +1,149 @@
+package jiffy
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/builtin/v9/market"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewBudgetCharge_SharesAcrossTenants(t *testing.T) {
+	now := time.Now()
+	fish := newFakeSegment(t, 1*KiB, now)
+	fish.AffinityGroup = "fish"
+	lobster := newFakeSegment(t, 4*KiB, now)
+	lobster.AffinityGroup = "lobster"
+	untenanted := newFakeSegment(t, 2*KiB, now)
+	pieces, _, err := NewBestFitPacker().Pack([]*Segment{fish, lobster, untenanted}, 64*KiB, 1)
+	require.NoError(t, err)
+	piece := pieces[0]
+
+	got := newBudgetCharge(piece, market.DealProposal{StoragePricePerEpoch: big.NewInt(10), StartEpoch: 100, EndEpoch: 200})
+	require.Equal(t, big.NewInt(1000), got.amount)
+	require.Len(t, got.tenants, 2)
+	total := big.NewIntUnsigned(piece.TotalSegmentedSize)
+	require.Equal(t, big.Div(big.Mul(got.amount, big.NewIntUnsigned(fish.SegmentedSize)), total), got.tenants["fish"])
+	require.Equal(t, big.Div(big.Mul(got.amount, big.NewIntUnsigned(lobster.SegmentedSize)), total), got.tenants["lobster"])
+	require.True(t, got.tenants["lobster"].GreaterThan(got.tenants["fish"]))
+}
+
+func TestDealBudget_EnforcesLimits(t *testing.T) {
+	charge := func(amount int64, tenants map[string]int64) budgetCharge {
+		c := budgetCharge{amount: big.NewInt(amount), tenants: make(map[string]abi.TokenAmount)}
+		for tenant, share := range tenants {
+			c.tenants[tenant] = big.NewInt(share)
+		}
+		return c
+	}
+	tests := []struct {
+		name      string
+		opts      []Option
+		committed []budgetCharge
+		reserved  []budgetCharge
+		charge    budgetCharge
+		wantErr   bool
+	}{
+		{name: "no limits", charge: charge(1000, nil)},
+		{name: "within daily", opts: []Option{WithDailyBudget(big.NewInt(100))}, committed: []budgetCharge{charge(50, nil)}, charge: charge(50, nil)},
+		{name: "exceeds daily", opts: []Option{WithDailyBudget(big.NewInt(100))}, committed: []budgetCharge{charge(50, nil)}, charge: charge(51, nil), wantErr: true},
+		{name: "exceeds daily with reserved", opts: []Option{WithDailyBudget(big.NewInt(100))}, reserved: []budgetCharge{charge(60, nil)}, charge: charge(41, nil), wantErr: true},
+		{name: "exceeds total", opts: []Option{WithTotalBudget(big.NewInt(100))}, committed: []budgetCharge{charge(100, nil)}, charge: charge(1, nil), wantErr: true},
+		{
+			name:      "within tenant",
+			opts:      []Option{WithTenantBudget("fish", big.NewInt(10))},
+			committed: []budgetCharge{charge(100, map[string]int64{"fish": 5})},
+			charge:    charge(100, map[string]int64{"fish": 5, "lobster": 95}),
+		},
+		{
+			name:      "exceeds tenant",
+			opts:      []Option{WithTenantBudget("fish", big.NewInt(10))},
+			committed: []budgetCharge{charge(100, map[string]int64{"fish": 5})},
+			reserved:  []budgetCharge{charge(100, map[string]int64{"fish": 5})},
+			charge:    charge(100, map[string]int64{"fish": 1}),
+			wantErr:   true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts, err := applyTestOptions(append(test.opts, WithDealJournalPath(filepath.Join(t.TempDir(), "deals.jsonl")))...)
+			require.NoError(t, err)
+			j := &Jiffy{options: opts}
+			j.journal, err = newDealJournal(j)
+			require.NoError(t, err)
+			subject, err := newDealBudget(j)
+			require.NoError(t, err)
+			for _, c := range test.committed {
+				id := uuid.New()
+				require.NoError(t, subject.reserve(id, c))
+				subject.commit(id)
+			}
+			for _, c := range test.reserved {
+				require.NoError(t, subject.reserve(uuid.New(), c))
+			}
+
+			id := uuid.New()
+			err = subject.reserve(id, test.charge)
+			if test.wantErr {
+				require.ErrorIs(t, err, ErrBudgetExceeded)
+				require.Equal(t, DealFailureBudget, classifyDealFailure(err))
+				require.ErrorIs(t, subject.check(test.charge), ErrBudgetExceeded)
+				return
+			}
+			require.NoError(t, err)
+			// Released charges no longer count towards the limits.
+			subject.release(id)
+			require.NoError(t, subject.check(test.charge))
+		})
+	}
+}
+
+func TestDealBudget_LoadsFromJournal(t *testing.T) {
+	opts, err := applyTestOptions(
+		WithDealJournalPath(filepath.Join(t.TempDir(), "deals.jsonl")),
+		WithTenantBudget("fish", big.NewInt(1000)),
+		WithDailyBudget(big.NewInt(5000)),
+	)
+	require.NoError(t, err)
+	j := &Jiffy{options: opts}
+	j.journal, err = newDealJournal(j)
+	require.NoError(t, err)
+
+	now := time.Now()
+	proposal := func(price int64) *market.ClientDealProposal {
+		return &market.ClientDealProposal{
+			Proposal: market.DealProposal{StoragePricePerEpoch: big.NewInt(price), StartEpoch: 100, EndEpoch: 110},
+		}
+	}
+	for _, entry := range []*DealJournalEntry{
+		{Time: now.Add(-48 * time.Hour), Proposal: proposal(1), Accepted: true},
+		{Time: now, Proposal: proposal(2), Accepted: true, TenantCharges: map[string]abi.TokenAmount{"fish": big.NewInt(15)}},
+		{Time: now, Proposal: proposal(4), Accepted: true, DryRun: true},
+		{Time: now, Proposal: proposal(8), Error: "rejected"},
+		{Time: now, Proposal: proposal(16), OutcomeUnknown: true, Error: "outcome unknown"},
+		{Time: now, Error: "connection refused"},
+	} {
+		require.NoError(t, j.journal.append(entry))
+	}
+	subject, err := newDealBudget(j)
+	require.NoError(t, err)
+
+	got := subject.status()
+	require.Equal(t, budgetDay(now), got.Day)
+	require.Equal(t, big.NewInt(180), got.Daily.Committed)
+	require.Equal(t, big.NewInt(190), got.Total.Committed)
+	require.Nil(t, got.Total.Limit)
+	require.Equal(t, big.NewInt(5000), *got.Daily.Limit)
+	require.Equal(t, big.NewInt(15), got.Tenants["fish"].Committed)
+	require.Equal(t, big.NewInt(1000), *got.Tenants["fish"].Limit)
+
+	// The daily usage resets once the day is over.
+	subject.day = subject.day.Add(-24 * time.Hour)
+	got = subject.status()
+	require.Equal(t, big.Zero(), got.Daily.Committed)
+	require.Equal(t, big.NewInt(190), got.Total.Committed)
+}
@@ -31,19 +31,27 @@ type (
 // The varint length is the sum of CID in bytes plus the data length.
 // The CID is encoded as cid.Raw codec with multihash.SHA2_256 digest.
 func (s Section) WriteTo(out io.Writer) (int64, error) {
+	_, written, err := s.Encode(out)
+	return written, err
+}
+
+// Encode writes the section to out in the same way as WriteTo, and additionally returns the CID of data.
+// This allows the callers to index the written sections without having to re-compute the CID.
+func (s Section) Encode(out io.Writer) (cid.Cid, int64, error) {
 	// TODO convert to using streaming sum since we know the final size if hash function is fixed to SHA 256
 	mh, err := multihash.Sum(s, multihash.SHA2_256, -1)
 	if err != nil {
-		return 0, err
+		return cid.Undef, 0, err
 	}
-	cb := cid.NewCidV1(cid.Raw, mh).Bytes()
+	c := cid.NewCidV1(cid.Raw, mh)
+	cb := c.Bytes()
 	var written int64
 	// Write varint length.
 	{
 		l, err := varintLength(len(cb) + len(s)).WriteTo(out)
 		written += l
 		if err != nil {
-			return written, err
+			return cid.Undef, written, err
 		}
 	}
 	// Write cid byte value.
@@ -51,7 +59,7 @@ func (s Section) WriteTo(out io.Writer) (int64, error) {
 		l, err := out.Write(cb)
 		written += int64(l)
 		if err != nil {
-			return written, err
+			return cid.Undef, written, err
 		}
 	}
 	// Write raw data.
@@ -59,10 +67,10 @@ func (s Section) WriteTo(out io.Writer) (int64, error) {
 		l, err := out.Write(s)
 		written += int64(l)
 		if err != nil {
-			return written, err
+			return cid.Undef, written, err
 		}
 	}
-	return written, nil
+	return c, written, nil
 }
 
 func (l varintLength) WriteTo(out io.Writer) (int64, error) {
@@ -0,0 +1,266 @@
+package jiffy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-shipyard/boostly"
+	"github.com/google/uuid"
+	"github.com/ipfs/go-cid"
+)
+
+const pieceManifestFileExtension = ".manifest.json"
+
+var (
+	_ PieceCatalog = (*localPieceCatalog)(nil)
+)
+
+type (
+	// PieceCatalog keeps track of the aggregate pieces made by Jiffy, how their segments are laid out and the deals
+	// made for them.
+	PieceCatalog interface {
+		GetPieceManifest(context.Context, cid.Cid) (*PieceManifest, error)
+		ListPieceManifests(context.Context) ([]*PieceManifest, error)
+		// FindPieceManifests lists the manifests of pieces that contain the given segment.
+		FindPieceManifests(context.Context, abi.PieceInfo) ([]*PieceManifest, error)
+	}
+	// PieceManifest records the layout of an aggregate piece and the deals made for it.
+	PieceManifest struct {
+		Info abi.PieceInfo
+		// Segments lists the segments in the piece in order of their placement, including the empty CAR header.
+		Segments []PieceManifestSegment
+		Deals    []PieceManifestDeal
+		// CreateTime is the time at which the manifest was first recorded.
+		CreateTime time.Time
+	}
+	// PieceManifestSegment records the placement of a segment within an aggregate piece.
+	PieceManifestSegment struct {
+		Info abi.PieceInfo
+		// Offset is the padded offset of segment within the piece.
+		Offset        abi.PaddedPieceSize
+		RawSize       uint64
+		SegmentedSize uint64
+		CreateTime    time.Time
+		AffinityGroup string
+		// Root is the root CID of the DAG that the segment data represents, if known.
+		Root cid.Cid
+	}
+	// PieceManifestDeal records a deal made for an aggregate piece.
+	PieceManifestDeal struct {
+		DealUUID   uuid.UUID
+		Provider   address.Address
+		StartEpoch abi.ChainEpoch
+		EndEpoch   abi.ChainEpoch
+		ProposedAt time.Time
+		// Offline signals that the piece data is shipped to the provider out of band. See ExportOfflineDeals.
+		Offline bool
+	}
+
+	// localPieceCatalog stores piece manifests as JSON files on local disk, one file per piece.
+	localPieceCatalog struct {
+		j *Jiffy
+
+		mutex     sync.RWMutex
+		manifests map[cid.Cid]*PieceManifest
+		// segmentPieces indexes the piece CIDs that contain each segment by segment piece CID.
+		segmentPieces map[cid.Cid]map[cid.Cid]struct{}
+	}
+)
+
+// Piece reconstructs the Piece that corresponds to the manifest.
+func (m *PieceManifest) Piece() *Piece {
+	piece := &Piece{
+		Info:     m.Info,
+		Capacity: m.Info.Size,
+		Segments: make(Segments, 0, len(m.Segments)),
+	}
+	for _, s := range m.Segments {
+		var segment *Segment
+		if s.Info == emptyHeaderV1Segment.Info {
+			segment = emptyHeaderV1Segment
+		} else {
+			segment = &Segment{
+				Info:          s.Info,
+				RawSize:       s.RawSize,
+				SegmentedSize: s.SegmentedSize,
+				CreateTime:    s.CreateTime,
+				AffinityGroup: s.AffinityGroup,
+				Root:          s.Root,
+			}
+		}
+		piece.Segments = append(piece.Segments, segment)
+		piece.TotalSegmentedSize += segment.SegmentedSize
+	}
+	return piece
+}
+
+func newLocalPieceCatalog(j *Jiffy) (*localPieceCatalog, error) {
+	c := &localPieceCatalog{
+		j:             j,
+		manifests:     make(map[cid.Cid]*PieceManifest),
+		segmentPieces: make(map[cid.Cid]map[cid.Cid]struct{}),
+	}
+	if err := os.MkdirAll(j.pieceCatalogDir, 0755); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(j.pieceCatalogDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), pieceManifestFileExtension) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(j.pieceCatalogDir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var manifest PieceManifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return nil, fmt.Errorf("failed to decode piece manifest %s: %w", entry.Name(), err)
+		}
+		c.index(&manifest)
+	}
+	return c, nil
+}
+
+// recordDeal records the deal made for the given piece, creating the piece manifest if it does not exist.
+func (c *localPieceCatalog) recordDeal(piece *Piece, deal *boostly.DealProposal) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	existing, ok := c.manifests[piece.Info.PieceCID]
+	var manifest PieceManifest
+	if ok {
+		manifest = *existing
+		manifest.Deals = append([]PieceManifestDeal{}, existing.Deals...)
+	} else {
+		aggregate, err := piece.aggregate()
+		if err != nil {
+			return err
+		}
+		manifest = PieceManifest{
+			Info:       piece.Info,
+			Segments:   make([]PieceManifestSegment, 0, len(piece.Segments)),
+			CreateTime: time.Now(),
+		}
+		for i, segment := range piece.Segments {
+			manifest.Segments = append(manifest.Segments, PieceManifestSegment{
+				Info:          segment.Info,
+				Offset:        abi.PaddedPieceSize(aggregate.Index[i].Offset),
+				RawSize:       segment.RawSize,
+				SegmentedSize: segment.SegmentedSize,
+				CreateTime:    segment.CreateTime,
+				AffinityGroup: segment.AffinityGroup,
+				Root:          segment.Root,
+			})
+		}
+	}
+	proposal := deal.ClientDealProposal.Proposal
+	manifest.Deals = append(manifest.Deals, PieceManifestDeal{
+		DealUUID:   deal.DealUUID,
+		Provider:   proposal.Provider,
+		StartEpoch: proposal.StartEpoch,
+		EndEpoch:   proposal.EndEpoch,
+		ProposedAt: time.Now(),
+		Offline:    deal.IsOffline,
+	})
+	if err := c.write(&manifest); err != nil {
+		return err
+	}
+	c.index(&manifest)
+	return nil
+}
+
+// write atomically writes the manifest to disk.
+func (c *localPieceCatalog) write(manifest *PieceManifest) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(c.j.pieceCatalogDir, "*.temp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(c.j.pieceCatalogDir, manifest.Info.PieceCID.String()+pieceManifestFileExtension))
+}
+
+// index adds the manifest to in-memory indices. The caller must hold the mutex lock, unless called at construction.
+func (c *localPieceCatalog) index(manifest *PieceManifest) {
+	c.manifests[manifest.Info.PieceCID] = manifest
+	for _, segment := range manifest.Segments {
+		pieces, ok := c.segmentPieces[segment.Info.PieceCID]
+		if !ok {
+			pieces = make(map[cid.Cid]struct{})
+			c.segmentPieces[segment.Info.PieceCID] = pieces
+		}
+		pieces[manifest.Info.PieceCID] = struct{}{}
+	}
+}
+
+func (c *localPieceCatalog) GetPieceManifest(ctx context.Context, pieceCID cid.Cid) (*PieceManifest, error) {
+	c.mutex.RLock()
+	manifest, ok := c.manifests[pieceCID]
+	c.mutex.RUnlock()
+	if !ok {
+		return nil, ErrPieceNotFound
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+		return manifest, nil
+	}
+}
+
+func (c *localPieceCatalog) ListPieceManifests(ctx context.Context) ([]*PieceManifest, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	list := make([]*PieceManifest, 0, len(c.manifests))
+	for _, manifest := range c.manifests {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+			list = append(list, manifest)
+		}
+	}
+	return list, nil
+}
+
+func (c *localPieceCatalog) FindPieceManifests(ctx context.Context, segment abi.PieceInfo) ([]*PieceManifest, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	var list []*PieceManifest
+	for pieceCID := range c.segmentPieces[segment.PieceCID] {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+		manifest := c.manifests[pieceCID]
+		for _, s := range manifest.Segments {
+			if s.Info == segment {
+				list = append(list, manifest)
+				break
+			}
+		}
+	}
+	return list, nil
+}
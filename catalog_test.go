@@ -0,0 +1,69 @@
+package jiffy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/builtin/v9/market"
+	"github.com/filecoin-shipyard/boostly"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalPieceCatalog_RecordDeal(t *testing.T) {
+	ctx := context.Background()
+	j := &Jiffy{options: &options{pieceCatalogDir: t.TempDir()}}
+	subject, err := newLocalPieceCatalog(j)
+	require.NoError(t, err)
+
+	now := time.Now()
+	segment := newFakeSegment(t, 2*KiB, now)
+	pieces, _, err := NewBestFitPacker().Pack([]*Segment{
+		segment,
+		newFakeSegment(t, 1*KiB, now),
+	}, 64*KiB, 1)
+	require.NoError(t, err)
+	piece := pieces[0]
+
+	provider, err := address.NewIDAddress(1413)
+	require.NoError(t, err)
+	deal := &boostly.DealProposal{
+		DealUUID: uuid.New(),
+		ClientDealProposal: market.ClientDealProposal{
+			Proposal: market.DealProposal{Provider: provider, StartEpoch: 10, EndEpoch: 20},
+		},
+	}
+	require.NoError(t, subject.recordDeal(piece, deal))
+	require.NoError(t, subject.recordDeal(piece, deal))
+
+	// Reload from disk to assert that manifests are persisted.
+	subject, err = newLocalPieceCatalog(j)
+	require.NoError(t, err)
+	got, err := subject.GetPieceManifest(ctx, piece.Info.PieceCID)
+	require.NoError(t, err)
+	require.Equal(t, piece.Info, got.Info)
+	require.Len(t, got.Deals, 2)
+	require.Equal(t, deal.DealUUID, got.Deals[0].DealUUID)
+	require.Equal(t, provider, got.Deals[0].Provider)
+	require.Len(t, got.Segments, len(piece.Segments))
+	require.Equal(t, emptyHeaderV1Segment.Info, got.Segments[0].Info)
+	require.Zero(t, got.Segments[0].Offset)
+
+	// The padded offsets must reproduce the same aggregate.
+	reconstructed, err := got.Piece().aggregate()
+	require.NoError(t, err)
+	gotCID, err := reconstructed.PieceCID()
+	require.NoError(t, err)
+	require.Equal(t, piece.Info.PieceCID, gotCID)
+	for i, s := range got.Segments {
+		require.EqualValues(t, reconstructed.Index[i].Offset, s.Offset)
+	}
+
+	found, err := subject.FindPieceManifests(ctx, segment.Info)
+	require.NoError(t, err)
+	require.Len(t, found, 1)
+	_, err = subject.GetPieceManifest(ctx, segment.Info.PieceCID)
+	require.ErrorIs(t, err, ErrPieceNotFound)
+}
@@ -0,0 +1,273 @@
+package jiffy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/builtin/v11/verifreg"
+	"github.com/filecoin-project/go-state-types/exitcode"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/ybbus/jsonrpc/v3"
+)
+
+const (
+	defaultFilecoinAPI = `https://api.node.glif.io`
+
+	methodFilStateMinerInfo            = `Filecoin.StateMinerInfo`
+	methodFilStateLookupID             = `Filecoin.StateLookupID`
+	methodFilStateGetAllocations       = `Filecoin.StateGetAllocations`
+	methodFilStateGetClaims            = `Filecoin.StateGetClaims`
+	methodFilMpoolGetNonce             = `Filecoin.MpoolGetNonce`
+	methodFilGasEstimateMessageGas     = `Filecoin.GasEstimateMessageGas`
+	methodFilMpoolPush                 = `Filecoin.MpoolPush`
+	methodFilStateMarketBalance        = `Filecoin.StateMarketBalance`
+	methodFilStateSearchMsg            = `Filecoin.StateSearchMsg`
+	methodFilStateVerifiedClientStatus = `Filecoin.StateVerifiedClientStatus`
+)
+
+type (
+	// chainClient offers access to the Filecoin chain state that is not exposed by telefil.Telefil.
+	chainClient struct {
+		client jsonrpc.RPCClient
+
+		// sendersMutex guards senders, which maps each message sender to the mutex that serialises the nonce
+		// assignment and push of its messages.
+		sendersMutex sync.Mutex
+		senders      map[address.Address]*sync.Mutex
+	}
+	// marketBalance represents the storage market escrow of an address. The funds available for new deals are the
+	// escrow minus locked funds.
+	marketBalance struct {
+		Escrow abi.TokenAmount `json:"Escrow"`
+		Locked abi.TokenAmount `json:"Locked"`
+	}
+	// msgLookup captures the subset of message lookup result that is relevant to Jiffy.
+	msgLookup struct {
+		Receipt struct {
+			ExitCode exitcode.ExitCode `json:"ExitCode"`
+		} `json:"Receipt"`
+		Height abi.ChainEpoch `json:"Height"`
+	}
+	// minerInfo captures the subset of storage provider information on chain that is relevant to Jiffy.
+	minerInfo struct {
+		PeerId              *string                 `json:"PeerId"`
+		Multiaddrs          [][]byte                `json:"Multiaddrs"`
+		SectorSize          abi.SectorSize          `json:"SectorSize"`
+		WindowPoStProofType abi.RegisteredPoStProof `json:"WindowPoStProofType"`
+	}
+)
+
+func newChainClient(api string) *chainClient {
+	return &chainClient{
+		client:  jsonrpc.NewClient(api),
+		senders: make(map[address.Address]*sync.Mutex),
+	}
+}
+
+func (c *chainClient) StateMinerInfo(ctx context.Context, sp address.Address) (*minerInfo, error) {
+	switch resp, err := c.client.Call(ctx, methodFilStateMinerInfo, sp.String(), nil); {
+	case err != nil:
+		return nil, err
+	case resp.Error != nil:
+		return nil, resp.Error
+	default:
+		var mi minerInfo
+		if err := resp.GetObject(&mi); err != nil {
+			return nil, err
+		}
+		return &mi, nil
+	}
+}
+
+// StateLookupID resolves the given address to its ID address.
+func (c *chainClient) StateLookupID(ctx context.Context, addr address.Address) (address.Address, error) {
+	switch resp, err := c.client.Call(ctx, methodFilStateLookupID, addr.String(), nil); {
+	case err != nil:
+		return address.Undef, err
+	case resp.Error != nil:
+		return address.Undef, resp.Error
+	default:
+		var id string
+		if err := resp.GetObject(&id); err != nil {
+			return address.Undef, err
+		}
+		return address.NewFromString(id)
+	}
+}
+
+// StateGetAllocations lists the verified registry allocations made by the given client.
+func (c *chainClient) StateGetAllocations(ctx context.Context, client address.Address) (map[verifreg.AllocationId]verifreg.Allocation, error) {
+	switch resp, err := c.client.Call(ctx, methodFilStateGetAllocations, client.String(), nil); {
+	case err != nil:
+		return nil, err
+	case resp.Error != nil:
+		return nil, resp.Error
+	default:
+		var allocations map[verifreg.AllocationId]verifreg.Allocation
+		if err := resp.GetObject(&allocations); err != nil {
+			return nil, err
+		}
+		return allocations, nil
+	}
+}
+
+// StateGetClaims lists the verified registry claims made by the given storage provider.
+func (c *chainClient) StateGetClaims(ctx context.Context, sp address.Address) (map[verifreg.ClaimId]verifreg.Claim, error) {
+	switch resp, err := c.client.Call(ctx, methodFilStateGetClaims, sp.String(), nil); {
+	case err != nil:
+		return nil, err
+	case resp.Error != nil:
+		return nil, resp.Error
+	default:
+		var claims map[verifreg.ClaimId]verifreg.Claim
+		if err := resp.GetObject(&claims); err != nil {
+			return nil, err
+		}
+		return claims, nil
+	}
+}
+
+// lockSender locks the nonce of the given message sender until the returned function is called, so that concurrent
+// messages from the same sender are not assigned the same nonce.
+func (c *chainClient) lockSender(sender address.Address) func() {
+	c.sendersMutex.Lock()
+	mutex, ok := c.senders[sender]
+	if !ok {
+		mutex = &sync.Mutex{}
+		c.senders[sender] = mutex
+	}
+	c.sendersMutex.Unlock()
+	mutex.Lock()
+	return mutex.Unlock
+}
+
+// MpoolGetNonce returns the next nonce of the given address, taking into account pending messages.
+func (c *chainClient) MpoolGetNonce(ctx context.Context, addr address.Address) (uint64, error) {
+	switch resp, err := c.client.Call(ctx, methodFilMpoolGetNonce, addr.String()); {
+	case err != nil:
+		return 0, err
+	case resp.Error != nil:
+		return 0, resp.Error
+	default:
+		var nonce uint64
+		if err := resp.GetObject(&nonce); err != nil {
+			return 0, err
+		}
+		return nonce, nil
+	}
+}
+
+// GasEstimateMessageGas returns a copy of the given message with its gas limit, fee cap and premium estimated.
+func (c *chainClient) GasEstimateMessageGas(ctx context.Context, msg *chainMessage) (*chainMessage, error) {
+	switch resp, err := c.client.Call(ctx, methodFilGasEstimateMessageGas, msg, nil, nil); {
+	case err != nil:
+		return nil, err
+	case resp.Error != nil:
+		return nil, resp.Error
+	default:
+		var estimated chainMessage
+		if err := resp.GetObject(&estimated); err != nil {
+			return nil, err
+		}
+		return &estimated, nil
+	}
+}
+
+// MpoolPush pushes the given signed message to the message pool, and returns its CID.
+func (c *chainClient) MpoolPush(ctx context.Context, msg *signedChainMessage) (cid.Cid, error) {
+	switch resp, err := c.client.Call(ctx, methodFilMpoolPush, msg); {
+	case err != nil:
+		return cid.Undef, err
+	case resp.Error != nil:
+		return cid.Undef, resp.Error
+	default:
+		var msgCid cid.Cid
+		if err := resp.GetObject(&msgCid); err != nil {
+			return cid.Undef, err
+		}
+		return msgCid, nil
+	}
+}
+
+// StateMarketBalance returns the storage market escrow and locked balance of the given address.
+func (c *chainClient) StateMarketBalance(ctx context.Context, addr address.Address) (*marketBalance, error) {
+	switch resp, err := c.client.Call(ctx, methodFilStateMarketBalance, addr.String(), nil); {
+	case err != nil:
+		return nil, err
+	case resp.Error != nil:
+		return nil, resp.Error
+	default:
+		var balance marketBalance
+		if err := resp.GetObject(&balance); err != nil {
+			return nil, err
+		}
+		return &balance, nil
+	}
+}
+
+// StateSearchMsg looks up the execution of the given message on chain. It returns nil if the message has not been
+// executed yet.
+func (c *chainClient) StateSearchMsg(ctx context.Context, msg cid.Cid) (*msgLookup, error) {
+	switch resp, err := c.client.Call(ctx, methodFilStateSearchMsg, nil, msg, -1, true); {
+	case err != nil:
+		return nil, err
+	case resp.Error != nil:
+		return nil, resp.Error
+	case resp.Result == nil:
+		return nil, nil
+	default:
+		var lookup msgLookup
+		if err := resp.GetObject(&lookup); err != nil {
+			return nil, err
+		}
+		return &lookup, nil
+	}
+}
+
+// StateVerifiedClientStatus returns the remaining DataCap of the given client in bytes, or zero if the client is
+// not verified.
+func (c *chainClient) StateVerifiedClientStatus(ctx context.Context, client address.Address) (abi.StoragePower, error) {
+	switch resp, err := c.client.Call(ctx, methodFilStateVerifiedClientStatus, client.String(), nil); {
+	case err != nil:
+		return abi.StoragePower{}, err
+	case resp.Error != nil:
+		return abi.StoragePower{}, resp.Error
+	case resp.Result == nil:
+		return big.Zero(), nil
+	default:
+		var dataCap abi.StoragePower
+		if err := resp.GetObject(&dataCap); err != nil {
+			return abi.StoragePower{}, err
+		}
+		return dataCap, nil
+	}
+}
+
+// addrInfo returns the libp2p peer ID and addresses advertised by the storage provider on chain.
+func (mi *minerInfo) addrInfo() (*peer.AddrInfo, error) {
+	if mi.PeerId == nil || *mi.PeerId == "" {
+		return nil, errors.New("no peer ID on chain")
+	}
+	id, err := peer.Decode(*mi.PeerId)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer ID on chain: %w", err)
+	}
+	ai := peer.AddrInfo{ID: id}
+	for _, mab := range mi.Multiaddrs {
+		addr, err := multiaddr.NewMultiaddrBytes(mab)
+		if err != nil {
+			// Skip malformed addresses; the others may still be usable.
+			logger.Debugw("skipping invalid multiaddr on chain", "peer", id, "err", err)
+			continue
+		}
+		ai.Addrs = append(ai.Addrs, addr)
+	}
+	return &ai, nil
+}
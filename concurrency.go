@@ -0,0 +1,258 @@
+package jiffy
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-shipyard/boostly"
+	"github.com/ipfs/go-cid"
+)
+
+const (
+	// ExtraReplicasKeep keeps the replicas accepted beyond WithTargetReplicas by proposals that were already in
+	// flight when the target was reached.
+	ExtraReplicasKeep ExtraReplicaPolicy = iota
+	// ExtraReplicasRollBack stops tracking the replicas accepted beyond WithTargetReplicas, so that they are excluded
+	// from replica counts and not verified. Their deals are still recorded in the piece catalog, and their escrow and
+	// DataCap stay reserved until published or expired, since storage providers may still publish them.
+	ExtraReplicasRollBack
+	// ExtraReplicasAvoid deals a piece with no more providers at a time than the replicas still needed, such that no
+	// extra replicas are made at the cost of less concurrency per piece.
+	ExtraReplicasAvoid
+)
+
+type (
+	// ExtraReplicaPolicy determines what happens to replicas accepted beyond the target set by WithTargetReplicas.
+	ExtraReplicaPolicy int
+
+	// replicationCycle holds the state shared by the pieces replicated concurrently within a replication cycle.
+	replicationCycle struct {
+		// spare lists the under-replicated segments left unpacked, with which pieces are filled for providers that
+		// take larger pieces than they were packed for.
+		spare []*Segment
+		// wait is cancelled once the cycle is paused, after which no further deals are proposed. It is only used to
+		// wait on concurrency limits, so that proposals in flight complete regardless.
+		wait  context.Context
+		pause context.CancelFunc
+
+		verificationsMutex sync.Mutex
+		verifications      map[cid.Cid]error
+	}
+	// pieceReplication tracks the replicas of a piece accepted by the storage providers dealt with concurrently.
+	pieceReplication struct {
+		piece  *Piece
+		target int
+		// wait is cancelled once the target replicas are accepted or the cycle is paused.
+		wait    context.Context
+		reached context.CancelFunc
+		// needed limits the providers dealt with at a time to the replicas still needed, if ExtraReplicasAvoid.
+		needed chan struct{}
+
+		mutex    sync.Mutex
+		replicas int
+	}
+)
+
+func newReplicationCycle(ctx context.Context, spare []*Segment) *replicationCycle {
+	c := &replicationCycle{
+		spare:         spare,
+		verifications: make(map[cid.Cid]error),
+	}
+	c.wait, c.pause = context.WithCancel(ctx)
+	return c
+}
+
+// verify verifies the given piece once per cycle.
+func (c *replicationCycle) verify(ctx context.Context, j *Jiffy, piece *Piece) error {
+	c.verificationsMutex.Lock()
+	err, ok := c.verifications[piece.Info.PieceCID]
+	c.verificationsMutex.Unlock()
+	if ok {
+		return err
+	}
+	err = j.VerifyPiece(ctx, piece)
+	c.verificationsMutex.Lock()
+	c.verifications[piece.Info.PieceCID] = err
+	c.verificationsMutex.Unlock()
+	return err
+}
+
+func (r *simpleReplicator) newPieceReplication(cycle *replicationCycle, piece *Piece) *pieceReplication {
+	pr := &pieceReplication{
+		piece:  piece,
+		target: r.j.replicatorTargetReplicas,
+	}
+	pr.wait, pr.reached = context.WithCancel(cycle.wait)
+	if pr.target > 0 && r.j.replicatorExtraReplicaPolicy == ExtraReplicasAvoid {
+		pr.needed = make(chan struct{}, pr.target)
+	}
+	return pr
+}
+
+// settle counts a provider done dealing the piece, and returns whether the deals it accepted are beyond the target
+// replicas. Providers count as a replica only if they accepted all the deals needed to replicate the piece.
+func (p *pieceReplication) settle(replicated bool) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.target > 0 && p.replicas >= p.target {
+		return true
+	}
+	if replicated {
+		p.replicas++
+		if p.target > 0 && p.replicas >= p.target {
+			p.reached()
+		}
+	}
+	return false
+}
+
+// newSlots returns a channel that limits concurrency to n, or to one if n is not positive.
+func newSlots(n int) chan struct{} {
+	if n < 1 {
+		n = 1
+	}
+	return make(chan struct{}, n)
+}
+
+// acquireSlot waits for a slot in slots, and returns false if ctx is done before then. Slots are released by
+// receiving from slots.
+func acquireSlot(ctx context.Context, slots chan struct{}) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case slots <- struct{}{}:
+		return true
+	}
+}
+
+// replicateCycle deals the given pieces with the storage providers picked for each, concurrently within the limits
+// set by WithMaxConcurrentDeals and WithMaxConcurrentDealsPerProvider. The spare segments are those left unpacked,
+// used to fill pieces for providers with larger sectors. It returns once all deals have completed.
+func (r *simpleReplicator) replicateCycle(ctx context.Context, pieces []*Piece, spare []*Segment) {
+	cycle := newReplicationCycle(ctx, spare)
+	defer cycle.pause()
+	now := time.Now()
+	var wg sync.WaitGroup
+	for _, piece := range pieces {
+		if cycle.wait.Err() != nil {
+			break
+		}
+		if !r.isReadyToDeal(piece, now) {
+			logger.Debugw("holding back piece until it is worth dealing", "piece", piece.Info.PieceCID, "fillRatio", piece.FillRatio(), "bytes", piece.TotalSegmentedSize)
+			continue
+		}
+		sps, err := r.j.replicatorSpPicker(ctx, piece)
+		if err != nil {
+			logger.Errorw("failed to pick storage providers", "piece", piece.Info.PieceCID, "err", err)
+			continue
+		}
+		if len(sps) == 0 {
+			continue
+		}
+		pr := r.newPieceReplication(cycle, piece)
+		for _, sp := range sps {
+			if until, cooling := r.cooldown.coolingDown(sp, time.Now()); cooling {
+				logger.Debugw("skipping provider until cooldown ends", "piece", piece.Info.PieceCID, "sp", sp, "until", until)
+				continue
+			}
+			wg.Add(1)
+			go func(sp address.Address) {
+				defer wg.Done()
+				r.replicateToProvider(ctx, cycle, pr, sp)
+			}(sp)
+		}
+	}
+	wg.Wait()
+}
+
+// replicateToProvider deals the piece of pr with sp once the concurrency limits allow, unless the target replicas
+// of the piece are accepted or the cycle is paused in the meantime.
+func (r *simpleReplicator) replicateToProvider(ctx context.Context, cycle *replicationCycle, pr *pieceReplication, sp address.Address) {
+	var replicated bool
+	if pr.needed != nil {
+		if !acquireSlot(pr.wait, pr.needed) {
+			return
+		}
+		// Keep the slot once sp holds a replica, so that no more providers are dealt with than needed.
+		defer func() {
+			if !replicated {
+				<-pr.needed
+			}
+		}()
+	}
+	// Wait on the provider before the global limit, so that busy providers do not hold up the others.
+	spSlots := r.providerSlots(sp)
+	if !acquireSlot(pr.wait, spSlots) {
+		return
+	}
+	defer func() { <-spSlots }()
+	if !acquireSlot(pr.wait, r.dealSlots) {
+		return
+	}
+	defer func() { <-r.dealSlots }()
+
+	spPieces, err := r.piecesForProvider(ctx, pr.piece, cycle.spare, sp)
+	if err != nil {
+		logger.Errorw("failed to fit piece to provider", "piece", pr.piece.Info.PieceCID, "sp", sp, "err", err)
+		return
+	}
+	var dealt []*Piece
+	var deals []*boostly.DealProposal
+	for _, spPiece := range spPieces {
+		if pr.wait.Err() != nil {
+			break
+		}
+		if r.j.replicatorVerifyPieces {
+			if err := cycle.verify(ctx, r.j, spPiece); err != nil {
+				logger.Errorw("skipping deal: failed to verify piece", "piece", spPiece.Info.PieceCID, "sp", sp, "err", err)
+				continue
+			}
+		}
+		deal, err := r.deal(ctx, spPiece, sp)
+		if err != nil {
+			if errors.Is(err, ErrInsufficientDataCap) && r.j.dealDataCapShortfallPolicy == DataCapPause {
+				logger.Warnw("pausing replication cycle until DataCap is replenished", "err", err)
+				cycle.pause()
+				break
+			}
+			logger.Errorw("failed to deal piece", "piece", spPiece.Info.PieceCID, "sp", sp, "class", classifyDealFailure(err), "err", err)
+			if _, cooling := r.cooldown.coolingDown(sp, time.Now()); cooling {
+				break
+			}
+			continue
+		}
+		dealt = append(dealt, spPiece)
+		deals = append(deals, deal)
+	}
+	replicated = len(deals) > 0 && len(deals) == len(spPieces)
+	extra := pr.settle(replicated)
+	for i, deal := range deals {
+		if r.j.dealDryRun != DealDryRunDisabled {
+			// Dry run proposals are only recorded in the deal journal.
+			continue
+		}
+		if extra && r.j.replicatorExtraReplicaPolicy == ExtraReplicasRollBack {
+			logger.Infow("rolling back replica beyond target", "piece", dealt[i].Info.PieceCID, "sp", sp, "deal", deal.DealUUID)
+		} else {
+			r.addReplicas(dealt[i], deal)
+		}
+		if err := r.j.catalog.recordDeal(dealt[i], deal); err != nil {
+			logger.Errorw("failed to record deal in piece catalog", "piece", dealt[i].Info.PieceCID, "deal", deal.DealUUID, "err", err)
+		}
+	}
+}
+
+// providerSlots returns the channel that limits the concurrent deals with sp.
+func (r *simpleReplicator) providerSlots(sp address.Address) chan struct{} {
+	r.providerSlotsMutex.Lock()
+	defer r.providerSlotsMutex.Unlock()
+	slots, ok := r.providerSlotsBySp[sp]
+	if !ok {
+		slots = newSlots(r.j.replicatorMaxProviderDeals)
+		r.providerSlotsBySp[sp] = slots
+	}
+	return slots
+}
@@ -0,0 +1,263 @@
+package jiffy
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/builtin/v9/market"
+	"github.com/filecoin-shipyard/boostly"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+// inFlightDealer is a Dealer that tracks the maximum number of deals in flight, overall and per provider.
+type inFlightDealer struct {
+	// deal is called while the deal is counted as in flight.
+	deal func(ctx context.Context, sp address.Address) error
+
+	mutex         sync.Mutex
+	inFlight      int
+	maxInFlight   int
+	spInFlight    map[address.Address]int
+	maxSpInFlight int
+	calls         int
+}
+
+func (d *inFlightDealer) Deal(ctx context.Context, piece *Piece, sp address.Address) (*boostly.DealProposal, error) {
+	d.mutex.Lock()
+	d.calls++
+	d.inFlight++
+	d.spInFlight[sp]++
+	if d.inFlight > d.maxInFlight {
+		d.maxInFlight = d.inFlight
+	}
+	if d.spInFlight[sp] > d.maxSpInFlight {
+		d.maxSpInFlight = d.spInFlight[sp]
+	}
+	d.mutex.Unlock()
+	defer func() {
+		d.mutex.Lock()
+		d.inFlight--
+		d.spInFlight[sp]--
+		d.mutex.Unlock()
+	}()
+	if err := d.deal(ctx, sp); err != nil {
+		return nil, err
+	}
+	return &boostly.DealProposal{
+		DealUUID: uuid.New(),
+		ClientDealProposal: market.ClientDealProposal{
+			Proposal: market.DealProposal{PieceCID: piece.Info.PieceCID, Provider: sp},
+		},
+	}, nil
+}
+
+// barrier returns a function that blocks until n callers are waiting on it, or the test times out.
+func barrier(t *testing.T, n int) func() {
+	var mutex sync.Mutex
+	var waiting int
+	all := make(chan struct{})
+	return func() {
+		mutex.Lock()
+		waiting++
+		if waiting == n {
+			close(all)
+		}
+		mutex.Unlock()
+		select {
+		case <-all:
+		case <-time.After(5 * time.Second):
+			t.Error("timed out waiting on barrier")
+		}
+	}
+}
+
+func TestSimpleReplicator_ReplicateCycle(t *testing.T) {
+	var sps []address.Address
+	for i := 0; i < 5; i++ {
+		sp, err := address.NewIDAddress(uint64(1000 + i))
+		require.NoError(t, err)
+		sps = append(sps, sp)
+	}
+	errRejected := errors.New("fish")
+
+	tests := []struct {
+		name          string
+		opts          []Option
+		pieces        int
+		sps           []address.Address
+		deal          func(t *testing.T) func(context.Context, address.Address) error
+		wantCalls     int
+		wantReplicas  int
+		wantMaxFlight int
+		wantMaxSp     int
+	}{
+		{
+			name:   "deals concurrently within global limit",
+			opts:   []Option{WithMaxConcurrentDeals(3)},
+			pieces: 1,
+			sps:    sps,
+			deal: func(t *testing.T) func(context.Context, address.Address) error {
+				wait := barrier(t, 3)
+				return func(context.Context, address.Address) error {
+					wait()
+					return nil
+				}
+			},
+			wantCalls:     5,
+			wantReplicas:  5,
+			wantMaxFlight: 3,
+			wantMaxSp:     1,
+		},
+		{
+			name:   "limits deals per provider",
+			opts:   []Option{WithMaxConcurrentDeals(8), WithMaxConcurrentDealsPerProvider(1)},
+			pieces: 3,
+			sps:    sps[:1],
+			deal: func(*testing.T) func(context.Context, address.Address) error {
+				return func(context.Context, address.Address) error {
+					time.Sleep(10 * time.Millisecond)
+					return nil
+				}
+			},
+			wantCalls:     3,
+			wantReplicas:  1,
+			wantMaxFlight: 1,
+			wantMaxSp:     1,
+		},
+		{
+			name:   "avoids extra replicas",
+			opts:   []Option{WithTargetReplicas(2), WithMaxConcurrentDeals(8), WithExtraReplicaPolicy(ExtraReplicasAvoid)},
+			pieces: 1,
+			sps:    sps,
+			deal: func(t *testing.T) func(context.Context, address.Address) error {
+				wait := barrier(t, 2)
+				var mutex sync.Mutex
+				var calls int
+				return func(context.Context, address.Address) error {
+					mutex.Lock()
+					calls++
+					call := calls
+					mutex.Unlock()
+					// Fail the first of the two deals in flight, so that a third provider is dealt with.
+					wait()
+					if call == 1 {
+						return errRejected
+					}
+					return nil
+				}
+			},
+			wantCalls:     3,
+			wantReplicas:  2,
+			wantMaxFlight: 2,
+			wantMaxSp:     1,
+		},
+		{
+			name:   "keeps extra replicas in flight",
+			opts:   []Option{WithTargetReplicas(1), WithMaxConcurrentDeals(3)},
+			pieces: 1,
+			sps:    sps,
+			deal: func(t *testing.T) func(context.Context, address.Address) error {
+				wait := barrier(t, 3)
+				return func(context.Context, address.Address) error {
+					wait()
+					return nil
+				}
+			},
+			wantCalls:     3,
+			wantReplicas:  3,
+			wantMaxFlight: 3,
+			wantMaxSp:     1,
+		},
+		{
+			name:   "rolls back extra replicas in flight",
+			opts:   []Option{WithTargetReplicas(1), WithMaxConcurrentDeals(3), WithExtraReplicaPolicy(ExtraReplicasRollBack)},
+			pieces: 1,
+			sps:    sps,
+			deal: func(t *testing.T) func(context.Context, address.Address) error {
+				wait := barrier(t, 3)
+				return func(context.Context, address.Address) error {
+					wait()
+					return nil
+				}
+			},
+			wantCalls:     3,
+			wantReplicas:  1,
+			wantMaxFlight: 3,
+			wantMaxSp:     1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts, err := applyTestOptions(append(test.opts,
+				WithPieceCatalogDir(t.TempDir()),
+				WithDealRetryPolicy(DealFailureTransient, DealRetryPolicy{MaxAttempts: 1}))...)
+			require.NoError(t, err)
+			opts.replicatorSpPicker = func(context.Context, *Piece) ([]address.Address, error) { return test.sps, nil }
+			j := &Jiffy{options: opts}
+			dealer := &inFlightDealer{deal: test.deal(t), spInFlight: make(map[address.Address]int)}
+			j.dealer = dealer
+			j.providers, err = newProviderDirectory(j)
+			require.NoError(t, err)
+			for _, sp := range test.sps {
+				j.providers.entries[sp] = &providerEntry{
+					info:       ProviderInfo{Provider: sp, SectorSize: abi.SectorSize(32 * GiB)},
+					infoExpiry: time.Now().Add(time.Hour),
+				}
+			}
+			j.catalog, err = newLocalPieceCatalog(j)
+			require.NoError(t, err)
+			j.escrow, err = newMarketEscrow(j)
+			require.NoError(t, err)
+			j.dataCap, err = newDataCapTracker(j)
+			require.NoError(t, err)
+			subject, err := newSimpleReplicator(j)
+			require.NoError(t, err)
+
+			now := time.Now()
+			var pieces []*Piece
+			for i := 0; i < test.pieces; i++ {
+				packed, _, err := NewBestFitPacker().Pack([]*Segment{newFakeSegment(t, 2*KiB, now)}, 64*KiB, 1)
+				require.NoError(t, err)
+				pieces = append(pieces, packed...)
+			}
+			subject.replicateCycle(context.Background(), pieces, nil)
+
+			require.Equal(t, test.wantCalls, dealer.calls)
+			require.Equal(t, test.wantMaxFlight, dealer.maxInFlight)
+			require.Equal(t, test.wantMaxSp, dealer.maxSpInFlight)
+			replicated := make(map[address.Address]struct{})
+			for _, piece := range pieces {
+				replicas, err := subject.GetReplicas(context.Background(), piece.Segments[0].Info)
+				require.NoError(t, err)
+				for _, replica := range replicas {
+					replicated[replica.Provider()] = struct{}{}
+				}
+			}
+			require.Len(t, replicated, test.wantReplicas)
+		})
+	}
+}
+
+func TestSimpleReplicator_DealOnceTimesOut(t *testing.T) {
+	opts, err := applyTestOptions(WithDealProposalTimeout(10 * time.Millisecond))
+	require.NoError(t, err)
+	j := &Jiffy{options: opts}
+	j.dealer = funcDealer(func(ctx context.Context, _ *Piece, _ address.Address) (*boostly.DealProposal, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	subject, err := newSimpleReplicator(j)
+	require.NoError(t, err)
+	sp, err := address.NewIDAddress(1413)
+	require.NoError(t, err)
+
+	_, err = subject.dealOnce(context.Background(), &Piece{}, sp)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Equal(t, DealFailureTransient, classifyDealFailure(err))
+}
@@ -0,0 +1,166 @@
+package jiffy
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/google/uuid"
+	"github.com/ipfs/go-cid"
+)
+
+const (
+	// DataCapPause skips verified deals while DataCap falls short, until it is replenished. The replication cycle in
+	// which DataCap runs short is ended early.
+	DataCapPause DataCapShortfallPolicy = iota
+	// DataCapFallbackToUnverified makes unverified deals while DataCap falls short.
+	DataCapFallbackToUnverified
+	// DataCapAlert calls the alert function set via WithDataCapAlert and skips the deal while DataCap falls short.
+	DataCapAlert
+)
+
+type (
+	// DataCapShortfallPolicy determines how verified deals are handled when the client's remaining DataCap falls short.
+	DataCapShortfallPolicy int
+
+	// dataCapTracker keeps track of the DataCap of the client, as needed by verified proposals and allocations that
+	// are not yet reflected on chain.
+	dataCapTracker struct {
+		j *Jiffy
+
+		mutex sync.Mutex
+		// reserved maps the deal UUID of proposals that are not yet published to the DataCap they need.
+		reserved map[uuid.UUID]reservedFunds
+		// published reports whether the given storage provider has published the deal with the given UUID.
+		published func(context.Context, address.Address, uuid.UUID) (bool, error)
+	}
+)
+
+func newDataCapTracker(j *Jiffy) (*dataCapTracker, error) {
+	return &dataCapTracker{
+		j:        j,
+		reserved: make(map[uuid.UUID]reservedFunds),
+		published: func(ctx context.Context, sp address.Address, dealUUID uuid.UUID) (bool, error) {
+			return dealPublished(ctx, j, sp, dealUUID)
+		},
+	}, nil
+}
+
+// reserve reserves DataCap for a piece of the given size for the proposal with the given deal UUID. It returns an
+// error wrapping ErrInsufficientDataCap if the remaining DataCap of client, minus the DataCap reserved by pending
+// proposals, falls short. The storage provider sp is used to check whether pending proposals have been published, and
+// is undefined for allocations, the DataCap of which is spent by the message set via spentBy.
+func (t *dataCapTracker) reserve(ctx context.Context, client, sp address.Address, dealUUID uuid.UUID, size abi.PaddedPieceSize, startEpoch, head abi.ChainEpoch) error {
+	remaining, err := t.j.chain.StateVerifiedClientStatus(ctx, client)
+	if err != nil {
+		return fmt.Errorf("failed to get remaining DataCap: %w", err)
+	}
+	t.mutex.Lock()
+	for id, reserved := range t.reserved {
+		if reserved.startEpoch <= head {
+			delete(t.reserved, id)
+		}
+	}
+	needed := t.needed(size)
+	if needed.GreaterThan(remaining) && len(t.reserved) > 0 {
+		// DataCap of proposals published, or allocations made, since they were last verified is spent on chain as
+		// well as reserved. Stop counting it twice before concluding that DataCap falls short.
+		t.mutex.Unlock()
+		if t.releaseSpent(ctx) {
+			if remaining, err = t.j.chain.StateVerifiedClientStatus(ctx, client); err != nil {
+				return fmt.Errorf("failed to get remaining DataCap: %w", err)
+			}
+		}
+		t.mutex.Lock()
+		needed = t.needed(size)
+	}
+	defer t.mutex.Unlock()
+	if needed.GreaterThan(remaining) {
+		return fmt.Errorf("%w: pending proposals need %s bytes but %s bytes remain", ErrInsufficientDataCap, needed, remaining)
+	}
+	t.reserved[dealUUID] = reservedFunds{amount: big.NewIntUnsigned(uint64(size)), provider: sp, startEpoch: startEpoch}
+	return nil
+}
+
+// needed sums the DataCap reserved by pending proposals and the given size. The caller must hold the mutex lock.
+func (t *dataCapTracker) needed(size abi.PaddedPieceSize) abi.StoragePower {
+	needed := big.NewIntUnsigned(uint64(size))
+	for _, reserved := range t.reserved {
+		needed = big.Add(needed, reserved.amount)
+	}
+	return needed
+}
+
+// spentBy records that the DataCap reserved for the given deal UUID is spent once the given message is executed.
+func (t *dataCapTracker) spentBy(dealUUID uuid.UUID, msg cid.Cid) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if reserved, ok := t.reserved[dealUUID]; ok {
+		reserved.message = msg
+		t.reserved[dealUUID] = reserved
+	}
+}
+
+// releaseSpent releases the DataCap reserved for proposals that their storage provider reports as published, and for
+// allocations the message of which is executed, and reports whether any were released.
+func (t *dataCapTracker) releaseSpent(ctx context.Context) bool {
+	t.mutex.Lock()
+	reserved := make(map[uuid.UUID]reservedFunds, len(t.reserved))
+	for id, funds := range t.reserved {
+		reserved[id] = funds
+	}
+	t.mutex.Unlock()
+
+	var released bool
+	for id, funds := range reserved {
+		var spent bool
+		var err error
+		switch {
+		case funds.message.Defined():
+			var lookup *msgLookup
+			lookup, err = t.j.chain.StateSearchMsg(ctx, funds.message)
+			// Failed messages spend no DataCap; either way, the reservation is no longer needed.
+			spent = lookup != nil
+		case funds.provider != address.Undef:
+			spent, err = t.published(ctx, funds.provider, id)
+		default:
+			// Allocation message is not pushed yet.
+			continue
+		}
+		switch {
+		case err != nil:
+			logger.Warnw("failed to check whether reserved DataCap is spent", "deal", id, "err", err)
+		case spent:
+			t.release(id)
+			released = true
+		}
+	}
+	return released
+}
+
+// release releases the DataCap reserved for the given deal UUID, e.g. once the proposal is rejected or published.
+func (t *dataCapTracker) release(dealUUID uuid.UUID) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.reserved, dealUUID)
+}
+
+// onShortfall applies the configured DataCapShortfallPolicy to the given DataCap reservation error. It returns
+// whether to fall back on an unverified deal, or the error that should abort the deal.
+func (t *dataCapTracker) onShortfall(ctx context.Context, client address.Address, err error) (bool, error) {
+	switch t.j.dealDataCapShortfallPolicy {
+	case DataCapFallbackToUnverified:
+		logger.Warnw("falling back on unverified deal", "client", client, "err", err)
+		return true, nil
+	case DataCapAlert:
+		if t.j.dealDataCapAlert != nil {
+			t.j.dealDataCapAlert(ctx, client, err)
+		}
+		return false, err
+	default:
+		return false, err
+	}
+}
@@ -0,0 +1,123 @@
+package jiffy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDataCapTracker_OnShortfall(t *testing.T) {
+	ctx := context.Background()
+	client, err := address.NewIDAddress(1413)
+	require.NoError(t, err)
+	shortfall := ErrInsufficientDataCap
+
+	var alerted error
+	tests := []struct {
+		name         string
+		opts         []Option
+		wantFallback bool
+		wantErr      bool
+		wantAlert    bool
+	}{
+		{name: "default pauses", wantErr: true},
+		{name: "fallback", opts: []Option{WithDataCapShortfallPolicy(DataCapFallbackToUnverified)}, wantFallback: true},
+		{name: "alert", opts: []Option{WithDataCapAlert(func(_ context.Context, _ address.Address, err error) { alerted = err })}, wantErr: true, wantAlert: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			alerted = nil
+			opts, err := applyTestOptions(test.opts...)
+			require.NoError(t, err)
+			subject, err := newDataCapTracker(&Jiffy{options: opts})
+			require.NoError(t, err)
+			fallback, err := subject.onShortfall(ctx, client, shortfall)
+			require.Equal(t, test.wantFallback, fallback)
+			if test.wantErr {
+				require.ErrorIs(t, err, ErrInsufficientDataCap)
+			} else {
+				require.NoError(t, err)
+			}
+			if test.wantAlert {
+				require.ErrorIs(t, alerted, ErrInsufficientDataCap)
+			} else {
+				require.NoError(t, alerted)
+			}
+		})
+	}
+	_, err = applyTestOptions(WithDataCapShortfallPolicy(DataCapShortfallPolicy(42)))
+	require.Error(t, err)
+}
+
+func TestDataCapTracker_ReserveReleasesSpent(t *testing.T) {
+	ctx := context.Background()
+	client, err := address.NewIDAddress(1413)
+	require.NoError(t, err)
+	sp, err := address.NewIDAddress(1414)
+	require.NoError(t, err)
+	allocationMsg := newFakeSegment(t, 1<<10, time.Now()).Info.PieceCID
+
+	var subject *dataCapTracker
+	var lockedDuringCall atomic.Bool
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subject.mutex.TryLock() {
+			subject.mutex.Unlock()
+		} else {
+			lockedDuringCall.Store(true)
+		}
+		var req struct {
+			Method string `json:"method"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		var result any
+		switch req.Method {
+		case methodFilStateVerifiedClientStatus:
+			result = big.NewInt(100)
+		case methodFilStateSearchMsg:
+			// The allocation message is executed.
+			result = msgLookup{Height: 5}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"jsonrpc": "2.0",
+			"id":      0,
+			"result":  result,
+		})
+	}))
+	defer api.Close()
+
+	opts, err := applyTestOptions()
+	require.NoError(t, err)
+	opts.chain = newChainClient(api.URL)
+	subject, err = newDataCapTracker(&Jiffy{options: opts})
+	require.NoError(t, err)
+	published, allocated, pushing := uuid.New(), uuid.New(), uuid.New()
+	subject.published = func(_ context.Context, _ address.Address, dealUUID uuid.UUID) (bool, error) {
+		return dealUUID == published, nil
+	}
+	subject.reserved[published] = reservedFunds{amount: big.NewInt(60), provider: sp, startEpoch: 100}
+	subject.reserved[allocated] = reservedFunds{amount: big.NewInt(20), message: allocationMsg, startEpoch: 100}
+	subject.reserved[pushing] = reservedFunds{amount: big.NewInt(10), startEpoch: 100}
+
+	// Without counting the published deal and made allocation twice, the remaining DataCap covers the next proposal.
+	pending := uuid.New()
+	require.NoError(t, subject.reserve(ctx, client, sp, pending, 64, 100, 10))
+	require.NotContains(t, subject.reserved, published)
+	require.NotContains(t, subject.reserved, allocated)
+	require.Contains(t, subject.reserved, pushing)
+	require.Contains(t, subject.reserved, pending)
+
+	// DataCap reserved by proposals that are not published yet still counts.
+	err = subject.reserve(ctx, client, sp, uuid.New(), 32, 100, 10)
+	require.ErrorIs(t, err, ErrInsufficientDataCap)
+	// The tracker is not locked while calling the chain.
+	require.False(t, lockedDuringCall.Load())
+}
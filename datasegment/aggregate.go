@@ -0,0 +1,138 @@
+package datasegment
+
+import (
+	"fmt"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/ipfs/go-cid"
+)
+
+type (
+	// Aggregate represents a deal that aggregates a set of sub-pieces along with their data segment index.
+	Aggregate struct {
+		// DealSize is the padded size of the aggregate deal.
+		DealSize abi.PaddedPieceSize
+		// Index lists the data segment index entries, one per sub-piece, in order of their placement.
+		Index []Entry
+
+		tree *sparseTree
+	}
+)
+
+// ComputeOffsets returns the padded offsets at which sub-pieces of the given sizes are placed in an aggregate, in
+// order, where each sub-piece is aligned to its own size. The returned end is the padded offset immediately after
+// the last sub-piece.
+func ComputeOffsets(sizes []abi.PaddedPieceSize) ([]abi.PaddedPieceSize, abi.PaddedPieceSize) {
+	offsets := make([]abi.PaddedPieceSize, len(sizes))
+	var next abi.PaddedPieceSize
+	for i, size := range sizes {
+		if misalignment := next % size; misalignment != 0 {
+			next += size - misalignment
+		}
+		offsets[i] = next
+		next += size
+	}
+	return offsets, next
+}
+
+// MinDealSize returns the smallest deal size that fits the given number of sub-pieces ending at the given padded
+// offset, along with their data segment index.
+func MinDealSize(end abi.PaddedPieceSize, subPieces int) abi.PaddedPieceSize {
+	size := abi.PaddedPieceSize(minIndexEntries * EntrySize)
+	for IndexStartOffset(size) < end || MaxIndexEntriesInDeal(size) < subPieces {
+		size *= 2
+	}
+	return size
+}
+
+// NewAggregate places the given sub-pieces in a deal of the given size, in order, and computes their data segment
+// index.
+func NewAggregate(dealSize abi.PaddedPieceSize, subPieces []abi.PieceInfo) (*Aggregate, error) {
+	if err := dealSize.Validate(); err != nil {
+		return nil, err
+	}
+	if maxEntries := MaxIndexEntriesInDeal(dealSize); len(subPieces) > maxEntries {
+		return nil, fmt.Errorf("too many sub-pieces for deal size %d; maximum is %d, got: %d", dealSize, maxEntries, len(subPieces))
+	}
+	sizes := make([]abi.PaddedPieceSize, len(subPieces))
+	for i, subPiece := range subPieces {
+		if err := subPiece.Size.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid sub-piece at index %d: %w", i, err)
+		}
+		sizes[i] = subPiece.Size
+	}
+	offsets, end := ComputeOffsets(sizes)
+	if indexStart := IndexStartOffset(dealSize); end > indexStart {
+		return nil, fmt.Errorf("sub-pieces end at %d, which overlaps the data segment index starting at %d", end, indexStart)
+	}
+
+	a := &Aggregate{
+		DealSize: dealSize,
+		Index:    make([]Entry, 0, len(subPieces)),
+	}
+	subtrees := make([]subtree, 0, 2*len(subPieces))
+	indexStart := uint64(a.IndexStartOffset())
+	for i, subPiece := range subPieces {
+		entry, err := NewEntry(subPiece.PieceCID, offsets[i], subPiece.Size)
+		if err != nil {
+			return nil, err
+		}
+		a.Index = append(a.Index, *entry)
+		left, right := entry.nodes()
+		subtrees = append(subtrees,
+			subtree{offset: uint64(offsets[i]), size: uint64(subPiece.Size), node: entry.CommDs},
+			subtree{offset: indexStart + uint64(i)*EntrySize, size: EntrySize, node: hashNodes(&left, &right)},
+		)
+	}
+	var err error
+	if a.tree, err = newSparseTree(uint64(dealSize), subtrees); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// PieceCID returns the piece CID of the aggregate deal, including the data segment index.
+func (a *Aggregate) PieceCID() (cid.Cid, error) {
+	return a.tree.root().CID()
+}
+
+// IndexStartOffset returns the padded offset at which the data segment index starts in the aggregate.
+func (a *Aggregate) IndexStartOffset() abi.PaddedPieceSize {
+	return IndexStartOffset(a.DealSize)
+}
+
+// IndexBytes returns the unpadded bytes of the data segment index, as they appear in the aggregate payload starting
+// at the unpadded IndexStartOffset. Unused entries are left as zero.
+func (a *Aggregate) IndexBytes() ([]byte, error) {
+	padded := make([]byte, a.DealSize-a.IndexStartOffset())
+	for i := range a.Index {
+		a.Index[i].encode(padded[i*EntrySize:])
+	}
+	return Fr32Unpad(padded)
+}
+
+// ParseIndex parses the data segment index from its unpadded bytes, as returned by Aggregate.IndexBytes.
+// Parsing stops at the first unused entry. An error is returned if any of the entries has an invalid checksum.
+func ParseIndex(unpadded []byte) ([]Entry, error) {
+	padded, err := Fr32Pad(unpadded)
+	if err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	var unused [EntrySize]byte
+	for offset := 0; offset+EntrySize <= len(padded); offset += EntrySize {
+		data := padded[offset : offset+EntrySize]
+		if string(data) == string(unused[:]) {
+			break
+		}
+		var entry Entry
+		if err := entry.UnmarshalBinary(data); err != nil {
+			return nil, err
+		}
+		if err := entry.Validate(); err != nil {
+			return nil, fmt.Errorf("entry at index %d: %w", len(entries), err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
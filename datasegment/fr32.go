@@ -0,0 +1,75 @@
+package datasegment
+
+import "fmt"
+
+const (
+	// fr32PaddedQuadSize is the number of bytes in a padded quad, i.e. four 32-byte Fr32 elements.
+	fr32PaddedQuadSize = 128
+	// fr32UnpaddedQuadSize is the number of bytes in an unpadded quad, i.e. four 254-bit chunks of data.
+	fr32UnpaddedQuadSize = 127
+)
+
+// Fr32Pad pads the given unpadded data into Fr32 elements, where every 254 bits of data are followed by two zero
+// bits. The length of data must be a multiple of 127 bytes.
+func Fr32Pad(unpadded []byte) ([]byte, error) {
+	if len(unpadded)%fr32UnpaddedQuadSize != 0 {
+		return nil, fmt.Errorf("unpadded data length must be a multiple of %d, got: %d", fr32UnpaddedQuadSize, len(unpadded))
+	}
+	quads := len(unpadded) / fr32UnpaddedQuadSize
+	padded := make([]byte, quads*fr32PaddedQuadSize)
+	for quad := 0; quad < quads; quad++ {
+		in := unpadded[quad*fr32UnpaddedQuadSize : (quad+1)*fr32UnpaddedQuadSize]
+		out := padded[quad*fr32PaddedQuadSize : (quad+1)*fr32PaddedQuadSize]
+
+		copy(out[:31], in[:31])
+		out[31] = in[31] & 0x3f
+		carry := in[31] >> 6
+		for i := 32; i < 64; i++ {
+			out[i] = in[i]<<2 | carry
+			carry = in[i] >> 6
+		}
+		out[63] &= 0x3f
+		carry = in[63] >> 4
+		for i := 64; i < 96; i++ {
+			out[i] = in[i]<<4 | carry
+			carry = in[i] >> 4
+		}
+		out[95] &= 0x3f
+		carry = in[95] >> 2
+		for i := 96; i < 127; i++ {
+			out[i] = in[i]<<6 | carry
+			carry = in[i] >> 2
+		}
+		out[127] = carry & 0x3f
+	}
+	return padded, nil
+}
+
+// Fr32Unpad removes the two padding bits from every Fr32 element in the given padded data.
+// The length of data must be a multiple of 128 bytes.
+func Fr32Unpad(padded []byte) ([]byte, error) {
+	if len(padded)%fr32PaddedQuadSize != 0 {
+		return nil, fmt.Errorf("padded data length must be a multiple of %d, got: %d", fr32PaddedQuadSize, len(padded))
+	}
+	quads := len(padded) / fr32PaddedQuadSize
+	unpadded := make([]byte, quads*fr32UnpaddedQuadSize)
+	for quad := 0; quad < quads; quad++ {
+		in := padded[quad*fr32PaddedQuadSize : (quad+1)*fr32PaddedQuadSize]
+		out := unpadded[quad*fr32UnpaddedQuadSize : (quad+1)*fr32UnpaddedQuadSize]
+
+		copy(out[:31], in[:31])
+		out[31] = in[31]&0x3f | in[32]<<6
+		for i := 32; i < 63; i++ {
+			out[i] = in[i]>>2 | in[i+1]<<6
+		}
+		out[63] = (in[63]>>2)&0x0f | in[64]<<4
+		for i := 64; i < 95; i++ {
+			out[i] = in[i]>>4 | in[i+1]<<4
+		}
+		out[95] = (in[95]>>4)&0x03 | in[96]<<2
+		for i := 96; i < 127; i++ {
+			out[i] = in[i]>>6 | in[i+1]<<2
+		}
+	}
+	return unpadded, nil
+}
@@ -0,0 +1,148 @@
+// Package datasegment implements the data segment aggregation format as specified in FRC-0058, where the index of
+// sub-pieces aggregated into a deal is written at the tail of the deal.
+//
+// See: https://github.com/filecoin-project/FIPs/blob/master/FRCs/frc-0058.md
+package datasegment
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/ipfs/go-cid"
+)
+
+const (
+	// EntrySize is the size of a data segment index entry in padded bytes.
+	EntrySize = 64
+	// ChecksumSize is the size of the checksum of a data segment index entry.
+	ChecksumSize = 16
+
+	// minIndexEntries is the minimum number of entries in a data segment index.
+	minIndexEntries = 4
+)
+
+var (
+	// ErrInvalidChecksum signals that the checksum of an index entry does not match its content.
+	ErrInvalidChecksum = errors.New("invalid data segment index entry checksum")
+)
+
+type (
+	// Entry represents an entry in the data segment index.
+	// Both the offset and size of the entry are expressed in padded bytes.
+	Entry struct {
+		CommDs   Node
+		Offset   uint64
+		Size     uint64
+		Checksum [ChecksumSize]byte
+	}
+)
+
+// NewEntry instantiates a new index entry for the sub-piece with the given piece CID, placed at the given padded
+// offset within a deal.
+func NewEntry(pieceCID cid.Cid, offset, size abi.PaddedPieceSize) (*Entry, error) {
+	commDs, err := NodeFromCID(pieceCID)
+	if err != nil {
+		return nil, err
+	}
+	e := &Entry{
+		CommDs: commDs,
+		Offset: uint64(offset),
+		Size:   uint64(size),
+	}
+	e.Checksum = e.computeChecksum()
+	return e, nil
+}
+
+// MaxIndexEntriesInDeal returns the number of entries in the data segment index of a deal of the given size.
+// The index occupies roughly 1/2048 of the deal, with a minimum of four entries.
+func MaxIndexEntriesInDeal(dealSize abi.PaddedPieceSize) int {
+	entries := uint64(dealSize) / 2048 / EntrySize
+	if entries <= minIndexEntries {
+		return minIndexEntries
+	}
+	if bits.OnesCount64(entries) != 1 {
+		entries = 1 << bits.Len64(entries)
+	}
+	return int(entries)
+}
+
+// IndexStartOffset returns the padded offset at which the data segment index starts in a deal of the given size.
+// No sub-piece may extend beyond this offset.
+func IndexStartOffset(dealSize abi.PaddedPieceSize) abi.PaddedPieceSize {
+	return dealSize - abi.PaddedPieceSize(MaxIndexEntriesInDeal(dealSize)*EntrySize)
+}
+
+// PieceInfo returns the piece info of the sub-piece referenced by the entry.
+func (e *Entry) PieceInfo() (abi.PieceInfo, error) {
+	pieceCID, err := e.CommDs.CID()
+	if err != nil {
+		return abi.PieceInfo{}, err
+	}
+	return abi.PieceInfo{
+		Size:     abi.PaddedPieceSize(e.Size),
+		PieceCID: pieceCID,
+	}, nil
+}
+
+// Validate checks that the entry checksum matches its content.
+func (e *Entry) Validate() error {
+	if checksum := e.computeChecksum(); !bytes.Equal(checksum[:], e.Checksum[:]) {
+		return ErrInvalidChecksum
+	}
+	return nil
+}
+
+// MarshalBinary encodes the entry as two padded Fr32 elements.
+func (e *Entry) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, EntrySize)
+	e.encode(buf)
+	return buf, nil
+}
+
+// UnmarshalBinary decodes the entry from two padded Fr32 elements.
+func (e *Entry) UnmarshalBinary(data []byte) error {
+	if len(data) != EntrySize {
+		return fmt.Errorf("data segment index entry must be %d bytes long, got: %d", EntrySize, len(data))
+	}
+	copy(e.CommDs[:], data[:NodeSize])
+	e.Offset = binary.LittleEndian.Uint64(data[NodeSize:])
+	e.Size = binary.LittleEndian.Uint64(data[NodeSize+8:])
+	copy(e.Checksum[:], data[NodeSize+16:])
+	return nil
+}
+
+func (e *Entry) encode(buf []byte) {
+	copy(buf[:NodeSize], e.CommDs[:])
+	binary.LittleEndian.PutUint64(buf[NodeSize:], e.Offset)
+	binary.LittleEndian.PutUint64(buf[NodeSize+8:], e.Size)
+	copy(buf[NodeSize+16:], e.Checksum[:])
+}
+
+// nodes returns the two tree leaves that represent the entry.
+func (e *Entry) nodes() (Node, Node) {
+	var left, right Node
+	var buf [EntrySize]byte
+	e.encode(buf[:])
+	copy(left[:], buf[:NodeSize])
+	copy(right[:], buf[NodeSize:])
+	return left, right
+}
+
+// computeChecksum computes the entry checksum as the truncated SHA-256 digest of its encoding with zero checksum.
+// The last two bits of checksum are zeroed to keep the encoded entry a valid Fr32 element.
+func (e *Entry) computeChecksum() [ChecksumSize]byte {
+	var buf [EntrySize]byte
+	copy(buf[:NodeSize], e.CommDs[:])
+	binary.LittleEndian.PutUint64(buf[NodeSize:], e.Offset)
+	binary.LittleEndian.PutUint64(buf[NodeSize+8:], e.Size)
+	digest := sha256.Sum256(buf[:])
+	var checksum [ChecksumSize]byte
+	copy(checksum[:], digest[:ChecksumSize])
+	checksum[ChecksumSize-1] &= 0b00111111
+	return checksum
+}
@@ -0,0 +1,58 @@
+package datasegment
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFr32_RoundTrip(t *testing.T) {
+	unpadded := make([]byte, 3*fr32UnpaddedQuadSize)
+	_, err := rand.Read(unpadded)
+	require.NoError(t, err)
+
+	padded, err := Fr32Pad(unpadded)
+	require.NoError(t, err)
+	require.Len(t, padded, 3*fr32PaddedQuadSize)
+	for i := NodeSize - 1; i < len(padded); i += NodeSize {
+		require.Zero(t, padded[i]&0b11000000, "expected the two most significant bits of element to be zero")
+	}
+	got, err := Fr32Unpad(padded)
+	require.NoError(t, err)
+	require.Equal(t, unpadded, got)
+
+	_, err = Fr32Pad(unpadded[1:])
+	require.Error(t, err)
+}
+
+func TestMaxIndexEntriesInDeal(t *testing.T) {
+	for size, want := range map[abi.PaddedPieceSize]int{
+		256:      4,
+		1 << 20:  8,
+		32 << 30: 262144,
+		64 << 30: 524288,
+	} {
+		require.Equal(t, want, MaxIndexEntriesInDeal(size), "size %d", size)
+		require.Equal(t, size-abi.PaddedPieceSize(want*EntrySize), IndexStartOffset(size))
+	}
+}
+
+func TestEntry_ChecksumAndEncoding(t *testing.T) {
+	pieceCID := zeroNode(2048)
+	c, err := pieceCID.CID()
+	require.NoError(t, err)
+	entry, err := NewEntry(c, 4096, 2048)
+	require.NoError(t, err)
+	require.NoError(t, entry.Validate())
+
+	encoded, err := entry.MarshalBinary()
+	require.NoError(t, err)
+	var decoded Entry
+	require.NoError(t, decoded.UnmarshalBinary(encoded))
+	require.Equal(t, *entry, decoded)
+
+	decoded.Offset++
+	require.ErrorIs(t, decoded.Validate(), ErrInvalidChecksum)
+}
@@ -0,0 +1,157 @@
+package datasegment
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math/bits"
+	"sort"
+
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	"github.com/ipfs/go-cid"
+)
+
+const (
+	// NodeSize is the size of a node in the piece commitment merkle tree, which is also the size of an Fr32 element.
+	NodeSize = 32
+	// maxTreeLevels is the maximum number of levels supported in a tree, corresponding to 2^64 bytes of padded data.
+	maxTreeLevels = 64 - 5
+)
+
+var zeroNodes [maxTreeLevels]Node
+
+type (
+	// Node represents a node in the piece commitment merkle tree.
+	Node [NodeSize]byte
+
+	// subtree represents a node in the piece commitment merkle tree at a known location.
+	// Its offset and size are expressed in padded bytes.
+	subtree struct {
+		offset uint64
+		size   uint64
+		node   Node
+	}
+	// sparseTree represents a piece commitment merkle tree over a set of non-overlapping subtrees, where any
+	// space not covered by a subtree is zero.
+	sparseTree struct {
+		size     uint64
+		subtrees []subtree
+	}
+)
+
+func init() {
+	for level := 1; level < maxTreeLevels; level++ {
+		zeroNodes[level] = hashNodes(&zeroNodes[level-1], &zeroNodes[level-1])
+	}
+}
+
+// NodeFromCID returns the root node of the piece commitment represented by the given CID.
+func NodeFromCID(c cid.Cid) (Node, error) {
+	var node Node
+	commP, err := commcid.CIDToPieceCommitmentV1(c)
+	if err != nil {
+		return node, err
+	}
+	if len(commP) != NodeSize {
+		return node, fmt.Errorf("unexpected piece commitment length: %d", len(commP))
+	}
+	copy(node[:], commP)
+	return node, nil
+}
+
+// CID returns the piece commitment CID that corresponds to the node.
+func (n Node) CID() (cid.Cid, error) {
+	return commcid.PieceCommitmentV1ToCID(n[:])
+}
+
+// hashNodes computes the parent of the given left and right nodes as the SHA-256 digest of their concatenation,
+// truncated to 254 bits.
+func hashNodes(left, right *Node) Node {
+	h := sha256.New()
+	_, _ = h.Write(left[:])
+	_, _ = h.Write(right[:])
+	var parent Node
+	h.Sum(parent[:0])
+	parent[NodeSize-1] &= 0b00111111
+	return parent
+}
+
+// zeroNode returns the root node of a tree of the given size in padded bytes, where all leaves are zero.
+func zeroNode(size uint64) Node {
+	return zeroNodes[level(size)]
+}
+
+// level returns the level in tree at which the nodes represent the given size in padded bytes.
+func level(size uint64) int {
+	return bits.TrailingZeros64(size / NodeSize)
+}
+
+func newSparseTree(size uint64, subtrees []subtree) (*sparseTree, error) {
+	if size < NodeSize || bits.OnesCount64(size) != 1 {
+		return nil, fmt.Errorf("tree size must be a power of two no smaller than %d, got: %d", NodeSize, size)
+	}
+	sort.Slice(subtrees, func(i, j int) bool { return subtrees[i].offset < subtrees[j].offset })
+	var end uint64
+	for _, s := range subtrees {
+		switch {
+		case s.size < NodeSize || bits.OnesCount64(s.size) != 1:
+			return nil, fmt.Errorf("subtree size must be a power of two no smaller than %d, got: %d", NodeSize, s.size)
+		case s.offset%s.size != 0:
+			return nil, fmt.Errorf("subtree at offset %d is not aligned to its size %d", s.offset, s.size)
+		case s.offset < end:
+			return nil, fmt.Errorf("subtree at offset %d overlaps its preceding subtree", s.offset)
+		}
+		end = s.offset + s.size
+	}
+	if end > size {
+		return nil, fmt.Errorf("subtrees end at %d, which exceeds tree size %d", end, size)
+	}
+	return &sparseTree{size: size, subtrees: subtrees}, nil
+}
+
+// root returns the root node of the tree.
+func (t *sparseTree) root() Node {
+	return t.node(0, t.size)
+}
+
+// node computes the node that represents the given range of padded bytes in the tree.
+// The range must be aligned to its size, and must not fall strictly within a subtree.
+func (t *sparseTree) node(offset, size uint64) Node {
+	end := offset + size
+	// Find the first subtree that ends after the offset.
+	i := sort.Search(len(t.subtrees), func(i int) bool {
+		return t.subtrees[i].offset+t.subtrees[i].size > offset
+	})
+	switch {
+	case i == len(t.subtrees) || t.subtrees[i].offset >= end:
+		return zeroNode(size)
+	case t.subtrees[i].offset == offset && t.subtrees[i].size == size:
+		return t.subtrees[i].node
+	default:
+		half := size / 2
+		left := t.node(offset, half)
+		right := t.node(offset+half, half)
+		return hashNodes(&left, &right)
+	}
+}
+
+// proof returns the inclusion proof of the node at the given offset and size, up to the root of the tree.
+func (t *sparseTree) proof(offset, size uint64) ProofData {
+	var path []Node
+	for nodeSize := t.size; nodeSize > size; nodeSize /= 2 {
+		half := nodeSize / 2
+		start := offset &^ (nodeSize - 1)
+		if offset-start < half {
+			path = append(path, t.node(start+half, half))
+		} else {
+			path = append(path, t.node(start, half))
+		}
+	}
+	// Reverse to order the path from the bottom of tree to the top.
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return ProofData{
+		Path:  path,
+		Index: offset / size,
+	}
+}
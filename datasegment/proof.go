@@ -0,0 +1,135 @@
+package datasegment
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/ipfs/go-cid"
+)
+
+var (
+	// ErrSubPieceNotFound signals that the sub-piece is not present in the aggregate.
+	ErrSubPieceNotFound = errors.New("sub-piece not found in aggregate")
+)
+
+type (
+	// ProofData represents a merkle inclusion proof of a node in the piece commitment tree.
+	ProofData struct {
+		// Path lists the sibling nodes from the bottom of the tree to the top.
+		Path []Node
+		// Index is the position of the proven node among the nodes at its level of the tree.
+		Index uint64
+	}
+
+	// InclusionProof is a proof of data segment inclusion (PoDSI), which proves that a sub-piece is included in an
+	// aggregate deal, and that the data segment index of the deal contains an entry that describes it.
+	InclusionProof struct {
+		// ProofSubtree proves the inclusion of the sub-piece piece commitment in the aggregate.
+		ProofSubtree ProofData
+		// ProofIndex proves the inclusion of the data segment index entry of the sub-piece in the aggregate.
+		ProofIndex ProofData
+	}
+
+	// InclusionVerifierData is the information about the sub-piece, known to the verifier of an InclusionProof.
+	InclusionVerifierData struct {
+		CommPc cid.Cid
+		SizePc abi.PaddedPieceSize
+	}
+
+	// InclusionAuxData is the information about the aggregate, computed from an InclusionProof. It must match the
+	// piece commitment and size of the aggregate deal, for instance the ones on chain, for the proof to be valid.
+	InclusionAuxData struct {
+		CommPa cid.Cid
+		SizePa abi.PaddedPieceSize
+	}
+)
+
+// ComputeRoot computes the root of the tree, given the node to which the proof corresponds.
+func (p ProofData) ComputeRoot(node Node) (Node, error) {
+	if len(p.Path) >= 64 || p.Index>>len(p.Path) != 0 {
+		return Node{}, fmt.Errorf("proof index %d is out of range for path of length %d", p.Index, len(p.Path))
+	}
+	index := p.Index
+	for i := range p.Path {
+		if index&1 == 0 {
+			node = hashNodes(&node, &p.Path[i])
+		} else {
+			node = hashNodes(&p.Path[i], &node)
+		}
+		index >>= 1
+	}
+	return node, nil
+}
+
+// ProofForPieceInfo returns the proof of data segment inclusion for the given sub-piece.
+func (a *Aggregate) ProofForPieceInfo(subPiece abi.PieceInfo) (*InclusionProof, error) {
+	commDs, err := NodeFromCID(subPiece.PieceCID)
+	if err != nil {
+		return nil, err
+	}
+	for i, entry := range a.Index {
+		if entry.CommDs != commDs || entry.Size != uint64(subPiece.Size) {
+			continue
+		}
+		return &InclusionProof{
+			ProofSubtree: a.tree.proof(entry.Offset, entry.Size),
+			ProofIndex:   a.tree.proof(uint64(a.IndexStartOffset())+uint64(i)*EntrySize, EntrySize),
+		}, nil
+	}
+	return nil, ErrSubPieceNotFound
+}
+
+// ComputeExpectedAuxData verifies that both the sub-piece and its data segment index entry are included in the
+// same tree, and returns the piece commitment and size of that tree.
+// The returned aux data must then be compared with the expected aggregate.
+func (ip *InclusionProof) ComputeExpectedAuxData(data InclusionVerifierData) (*InclusionAuxData, error) {
+	if err := data.SizePc.Validate(); err != nil {
+		return nil, err
+	}
+	commPc, err := NodeFromCID(data.CommPc)
+	if err != nil {
+		return nil, err
+	}
+
+	// Compute the aggregate root from the sub-piece proof.
+	commPa, err := ip.ProofSubtree.ComputeRoot(commPc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sub-piece proof: %w", err)
+	}
+	depth := len(ip.ProofSubtree.Path)
+	if log2SizePa := depth + level(uint64(data.SizePc)) + 5; log2SizePa >= 64 {
+		return nil, fmt.Errorf("sub-piece proof depth %d is too large", depth)
+	}
+	sizePa := data.SizePc << depth
+
+	// Reconstruct the index entry of the sub-piece, and check that it is included in the same aggregate.
+	entry, err := NewEntry(data.CommPc, data.SizePc*abi.PaddedPieceSize(ip.ProofSubtree.Index), data.SizePc)
+	if err != nil {
+		return nil, err
+	}
+	if indexSize := abi.PaddedPieceSize(EntrySize) << len(ip.ProofIndex.Path); indexSize != sizePa {
+		return nil, fmt.Errorf("index proof implies aggregate size %d, but sub-piece proof implies %d", indexSize, sizePa)
+	}
+	if entryOffset := abi.PaddedPieceSize(ip.ProofIndex.Index * EntrySize); entryOffset < IndexStartOffset(sizePa) {
+		return nil, fmt.Errorf("index entry offset %d does not fall within the data segment index", entryOffset)
+	}
+	left, right := entry.nodes()
+	entryNode := hashNodes(&left, &right)
+	indexRoot, err := ip.ProofIndex.ComputeRoot(entryNode)
+	if err != nil {
+		return nil, fmt.Errorf("invalid index proof: %w", err)
+	}
+	if indexRoot != commPa {
+		return nil, errors.New("sub-piece proof and index proof do not share the same root")
+	}
+
+	commPaCid, err := commPa.CID()
+	if err != nil {
+		return nil, err
+	}
+	return &InclusionAuxData{
+		CommPa: commPaCid,
+		SizePa: sizePa,
+	}, nil
+}
@@ -0,0 +1,258 @@
+package jiffy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/builtin"
+	"github.com/filecoin-project/go-state-types/builtin/v11/datacap"
+	"github.com/filecoin-project/go-state-types/builtin/v11/verifreg"
+	"github.com/filecoin-project/go-state-types/builtin/v9/market"
+	"github.com/filecoin-shipyard/boostly"
+	"github.com/google/uuid"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+const (
+	// ddoTermMaxExtension is the number of epochs by which the maximum term of allocations exceeds the deal duration.
+	ddoTermMaxExtension = 90 * builtin.EpochsInDay
+)
+
+var (
+	_ Dealer          = (*directDataOnboardingDealer)(nil)
+	_ replicaVerifier = (*directDataOnboardingDealer)(nil)
+	_ dealPricer      = (*directDataOnboardingDealer)(nil)
+)
+
+type (
+	// directDataOnboardingDealer onboards pieces via verified registry allocations, without a storage market deal.
+	// It transfers DataCap to the verified registry actor with an allocation request for each piece. The storage
+	// provider then claims the allocation upon sealing the piece data, which it receives out of band.
+	//
+	// Since there is no market deal, the returned boostly.DealProposal is not signed and its DealUUID is only
+	// meaningful locally; the proposal captures the terms of the allocation for the purpose of replica tracking.
+	directDataOnboardingDealer struct {
+		j *Jiffy
+	}
+)
+
+func newDirectDataOnboardingDealer(j *Jiffy) (*directDataOnboardingDealer, error) {
+	return &directDataOnboardingDealer{j: j}, nil
+}
+
+func (d *directDataOnboardingDealer) Deal(ctx context.Context, piece *Piece, sp address.Address) (*boostly.DealProposal, error) {
+	entry := newDealJournalEntry(piece, sp)
+	proposal, err := d.deal(ctx, piece, sp, entry)
+	d.j.journal.record(entry, err)
+	return proposal, err
+}
+
+// deal makes an allocation for the given piece with sp, capturing the details of the attempt in the given journal
+// entry.
+func (d *directDataOnboardingDealer) deal(ctx context.Context, piece *Piece, sp address.Address, entry *DealJournalEntry) (*boostly.DealProposal, error) {
+	client, err := d.j.wallet.Address()
+	if err != nil {
+		return nil, err
+	}
+	spID, err := d.actorID(ctx, sp)
+	if err != nil {
+		return nil, err
+	}
+	head, err := d.j.fil.ChainHead(ctx)
+	if err != nil {
+		return nil, err
+	}
+	termMin := d.j.dealDuration
+	if termMin < verifreg.MinimumVerifiedAllocationTerm {
+		return nil, fmt.Errorf("deal duration must be at least %d epochs for direct data onboarding, got: %d", verifreg.MinimumVerifiedAllocationTerm, termMin)
+	}
+	termMax := termMin + ddoTermMaxExtension
+	if termMax > verifreg.MaximumVerifiedAllocationTerm {
+		termMax = verifreg.MaximumVerifiedAllocationTerm
+	}
+	if termMin > termMax {
+		return nil, fmt.Errorf("deal duration must be at most %d epochs for direct data onboarding, got: %d", verifreg.MaximumVerifiedAllocationTerm, termMin)
+	}
+	expiration := head.Height + d.j.dealStartDelay
+	if d.j.dealStartDelay > verifreg.MaximumVerifiedAllocationExpiration {
+		expiration = head.Height + verifreg.MaximumVerifiedAllocationExpiration
+	}
+
+	dealUuid, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+	entry.DealUUID = dealUuid
+	// Direct data onboarding cannot fall back on unverified deals, since allocations are paid for with DataCap.
+	if err := d.j.dataCap.reserve(ctx, client, address.Undef, dealUuid, piece.Info.Size, expiration, head.Height); err != nil {
+		_, err = d.j.dataCap.onShortfall(ctx, client, err)
+		return nil, err
+	}
+
+	var operatorData bytes.Buffer
+	if err := encodeAllocationRequests(&operatorData, verifreg.AllocationRequest{
+		Provider:   spID,
+		Data:       piece.Info.PieceCID,
+		Size:       piece.Info.Size,
+		TermMin:    termMin,
+		TermMax:    termMax,
+		Expiration: expiration,
+	}); err != nil {
+		return nil, err
+	}
+	var params bytes.Buffer
+	if err := (&datacap.TransferParams{
+		To:           builtin.VerifiedRegistryActorAddr,
+		Amount:       big.Mul(big.NewIntUnsigned(uint64(piece.Info.Size)), builtin.TokenPrecision),
+		OperatorData: operatorData.Bytes(),
+	}).MarshalCBOR(&params); err != nil {
+		return nil, err
+	}
+	proposal := &boostly.DealProposal{
+		DealUUID: dealUuid,
+		ClientDealProposal: market.ClientDealProposal{
+			Proposal: market.DealProposal{
+				PieceCID:             piece.Info.PieceCID,
+				PieceSize:            piece.Info.Size,
+				VerifiedDeal:         true,
+				Client:               client,
+				Provider:             sp,
+				StartEpoch:           expiration,
+				EndEpoch:             expiration + termMin,
+				StoragePricePerEpoch: big.Zero(),
+				ProviderCollateral:   big.Zero(),
+				ClientCollateral:     big.Zero(),
+			},
+		},
+		DealDataRoot: piece.Info.PieceCID,
+		IsOffline:    true,
+	}
+	if d.j.dealDryRun != DealDryRunDisabled {
+		entry.DryRun = true
+		d.j.dataCap.release(dealUuid)
+		logger.Infow("dry run: built allocation message without pushing it", "piece", piece.Info.PieceCID, "sp", sp)
+		return proposal, nil
+	}
+	msgCid, err := pushMessage(ctx, d.j.chain, d.j.wallet, &chainMessage{
+		To:     builtin.DatacapActorAddr,
+		From:   client,
+		Value:  big.Zero(),
+		Method: builtin.MethodsDatacap.TransferExported,
+		Params: params.Bytes(),
+	})
+	if err != nil {
+		d.j.dataCap.release(dealUuid)
+		return nil, fmt.Errorf("failed to push allocation message: %w", err)
+	}
+	entry.ChainMessage = &msgCid
+	d.j.dataCap.spentBy(dealUuid, msgCid)
+	logger.Infow("pushed allocation message", "piece", piece.Info.PieceCID, "sp", sp, "message", msgCid)
+	return proposal, nil
+}
+
+// verifyReplica populates the allocation and claim state of the given replica from chain.
+// A replica is matched to the allocation and claim with the same client, provider, piece CID and size. A replica with
+// neither, once the chain head has reached the allocation expiration, is marked as expired so that it is replicated
+// again; its allocation message either failed or the allocation expired or was removed before being claimed.
+func (d *directDataOnboardingDealer) verifyReplica(ctx context.Context, replica *Replica, head abi.ChainEpoch) {
+	proposal := replica.DealProposal.ClientDealProposal.Proposal
+	clientID, err := d.actorID(ctx, proposal.Client)
+	if err != nil {
+		replica.LastError = fmt.Errorf("failed to look up client ID: %w", err)
+		return
+	}
+	spID, err := d.actorID(ctx, proposal.Provider)
+	if err != nil {
+		replica.LastError = fmt.Errorf("failed to look up provider ID: %w", err)
+		return
+	}
+	claims, err := d.j.chain.StateGetClaims(ctx, proposal.Provider)
+	if err != nil {
+		replica.LastError = fmt.Errorf("failed to get claims from chain: %w", err)
+		return
+	}
+	for _, claim := range claims {
+		if claim.Client == clientID && claim.Provider == spID && claim.Data.Equals(proposal.PieceCID) && claim.Size == proposal.PieceSize {
+			claim := claim
+			replica.LastClaim = &claim
+			d.j.dataCap.release(replica.DealProposal.DealUUID)
+			return
+		}
+	}
+	allocations, err := d.j.chain.StateGetAllocations(ctx, proposal.Client)
+	if err != nil {
+		replica.LastError = fmt.Errorf("failed to get allocations from chain: %w", err)
+		return
+	}
+	for _, allocation := range allocations {
+		if allocation.Client == clientID && allocation.Provider == spID && allocation.Data.Equals(proposal.PieceCID) && allocation.Size == proposal.PieceSize {
+			allocation := allocation
+			replica.LastAllocation = &allocation
+			d.j.dataCap.release(replica.DealProposal.DealUUID)
+			return
+		}
+	}
+	// The proposal start epoch is the allocation expiration.
+	if head >= proposal.StartEpoch {
+		replica.LastError = fmt.Errorf("%w at epoch %d", ErrAllocationExpired, proposal.StartEpoch)
+		d.j.dataCap.release(replica.DealProposal.DealUUID)
+	}
+}
+
+// pickPrice returns zero, since allocations carry no storage price.
+func (d *directDataOnboardingDealer) pickPrice(context.Context, address.Address, abi.PaddedPieceSize, abi.ChainEpoch, abi.ChainEpoch, bool) (abi.TokenAmount, error) {
+	return big.Zero(), nil
+}
+
+func (d *directDataOnboardingDealer) actorID(ctx context.Context, addr address.Address) (abi.ActorID, error) {
+	if addr.Protocol() != address.ID {
+		var err error
+		if addr, err = d.j.chain.StateLookupID(ctx, addr); err != nil {
+			return 0, err
+		}
+	}
+	id, err := address.IDFromAddress(addr)
+	if err != nil {
+		return 0, err
+	}
+	return abi.ActorID(id), nil
+}
+
+// encodeAllocationRequests encodes the given allocation requests as verifreg.AllocationRequests with no claim
+// extensions, since go-state-types does not generate its CBOR encoder.
+func encodeAllocationRequests(w io.Writer, requests ...verifreg.AllocationRequest) error {
+	cw := cbg.NewCborWriter(w)
+	// AllocationRequests is a tuple of allocations and extensions.
+	if err := cw.WriteMajorTypeHeader(cbg.MajArray, 2); err != nil {
+		return err
+	}
+	if err := cw.WriteMajorTypeHeader(cbg.MajArray, uint64(len(requests))); err != nil {
+		return err
+	}
+	for _, request := range requests {
+		// AllocationRequest is a tuple of 6 fields.
+		if err := cw.WriteMajorTypeHeader(cbg.MajArray, 6); err != nil {
+			return err
+		}
+		if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(request.Provider)); err != nil {
+			return err
+		}
+		if err := cbg.WriteCid(cw, request.Data); err != nil {
+			return err
+		}
+		if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(request.Size)); err != nil {
+			return err
+		}
+		for _, epoch := range []abi.ChainEpoch{request.TermMin, request.TermMax, request.Expiration} {
+			if err := writeCborInt64(cw, int64(epoch)); err != nil {
+				return err
+			}
+		}
+	}
+	return cw.WriteMajorTypeHeader(cbg.MajArray, 0)
+}
@@ -0,0 +1,77 @@
+package jiffy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/builtin/v9/market"
+	"github.com/filecoin-shipyard/boostly"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirectDataOnboardingDealer_VerifyReplicaExpiresMissingAllocation(t *testing.T) {
+	ctx := context.Background()
+	client, err := address.NewIDAddress(1413)
+	require.NoError(t, err)
+	sp, err := address.NewIDAddress(1414)
+	require.NoError(t, err)
+
+	// Neither allocations nor claims are found on chain.
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"jsonrpc": "2.0",
+			"id":      0,
+			"result":  map[string]any{},
+		})
+	}))
+	defer api.Close()
+
+	opts, err := applyTestOptions()
+	require.NoError(t, err)
+	opts.chain = newChainClient(api.URL)
+	j := &Jiffy{options: opts}
+	j.dataCap, err = newDataCapTracker(j)
+	require.NoError(t, err)
+	subject, err := newDirectDataOnboardingDealer(j)
+	require.NoError(t, err)
+
+	const expiration = abi.ChainEpoch(100)
+	dealUUID := uuid.New()
+	newReplica := func() *Replica {
+		return &Replica{DealProposal: boostly.DealProposal{
+			DealUUID: dealUUID,
+			ClientDealProposal: market.ClientDealProposal{
+				Proposal: market.DealProposal{
+					PieceCID:   newFakeSegment(t, 1<<10, time.Now()).Info.PieceCID,
+					PieceSize:  1 << 10,
+					Client:     client,
+					Provider:   sp,
+					StartEpoch: expiration,
+				},
+			},
+		}}
+	}
+	j.dataCap.reserved[dealUUID] = reservedFunds{amount: big.NewInt(1 << 10), startEpoch: expiration}
+
+	// Before the allocation expiration, the allocation message may still be pending.
+	replica := newReplica()
+	subject.verifyReplica(ctx, replica, expiration-1)
+	require.NoError(t, replica.LastError)
+	require.Equal(t, Accepted, replica.Status(expiration-1))
+	require.Contains(t, j.dataCap.reserved, dealUUID)
+
+	// Past it, the replica is expired and its DataCap reservation released.
+	replica = newReplica()
+	subject.verifyReplica(ctx, replica, expiration)
+	require.ErrorIs(t, replica.LastError, ErrAllocationExpired)
+	require.Equal(t, Expired, replica.Status(expiration))
+	require.NotContains(t, j.dataCap.reserved, dealUUID)
+}
@@ -3,60 +3,104 @@ package jiffy
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sync/atomic"
+	"time"
 
 	"github.com/filecoin-project/go-address"
 	cborutil "github.com/filecoin-project/go-cbor-util"
+	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/builtin"
 	"github.com/filecoin-project/go-state-types/builtin/v9/market"
 	"github.com/filecoin-shipyard/boostly"
 	"github.com/google/uuid"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
 )
 
 const (
 	epochsInMinDeal = builtin.EpochsInDay * 6 * 30
+	// dealStatusTimeout bounds the deal status query made when the outcome of a proposal is unknown.
+	dealStatusTimeout = 10 * time.Second
+
+	// FilStorageMarketProtocol_1_2_1 is the 1.2.1 storage market deal protocol. Its proposals are of the same wire
+	// format as 1.2.0.
+	FilStorageMarketProtocol_1_2_1 = "/fil/storage/mk/1.2.1"
+)
+
+const (
+	// DealDryRunDisabled makes deals for real.
+	DealDryRunDisabled DealDryRunMode = iota
+	// DealDryRunOffline rehearses deals without connecting to storage providers. Deal proposals assume the most
+	// preferred deal protocol, and are priced at the configured price without querying storage asks.
+	DealDryRunOffline
+	// DealDryRunCapabilityChecks rehearses deals while connecting to storage providers to negotiate the deal protocol
+	// and query their storage asks, without proposing deals to them.
+	DealDryRunCapabilityChecks
 )
 
 var (
-	_ Dealer = (*storageMarketDealer_1_2_0)(nil)
+	_ Dealer     = (*storageMarketDealer)(nil)
+	_ dealPricer = (*storageMarketDealer)(nil)
+
+	// dealProtocols maps the supported storage market deal protocols to the function that adapts proposals to their
+	// wire format. Supporting a new protocol version amounts to adding it here and to the default protocols in
+	// options. Both 1.2.0 and 1.2.1 carry all the proposal fields set by the dealer, including
+	// boostly.DealProposal.RemoveUnsealedCopy and boostly.DealProposal.SkipIPNIAnnounce.
+	dealProtocols = map[protocol.ID]dealProposalAdapter{
+		FilStorageMarketProtocol_1_2_1:         adaptDealProposal_1_2_0,
+		boostly.FilStorageMarketProtocol_1_2_0: adaptDealProposal_1_2_0,
+	}
 )
 
 type (
 	Dealer interface {
 		Deal(context.Context, *Piece, address.Address) (*boostly.DealProposal, error)
 	}
-	storageMarketDealer_1_2_0 struct {
+	// DealDryRunMode determines whether and how deals are rehearsed instead of made. See WithDealDryRun.
+	DealDryRunMode int
+	// dealProposalAdapter returns the message sent to propose the given deal over a deal protocol.
+	dealProposalAdapter func(*boostly.DealProposal) any
+	// storageMarketDealer makes storage market deals over the most preferred deal protocol supported by the provider.
+	// See WithDealProtocols.
+	storageMarketDealer struct {
 		j *Jiffy
 	}
 )
 
-func newStorageMarketDealer_1_2_0(j *Jiffy) (*storageMarketDealer_1_2_0, error) {
-	return &storageMarketDealer_1_2_0{j: j}, nil
+func newStorageMarketDealer(j *Jiffy) (*storageMarketDealer, error) {
+	return &storageMarketDealer{j: j}, nil
+}
+
+func (d *storageMarketDealer) Deal(ctx context.Context, piece *Piece, sp address.Address) (*boostly.DealProposal, error) {
+	entry := newDealJournalEntry(piece, sp)
+	proposal, err := d.deal(ctx, piece, sp, entry)
+	d.j.journal.record(entry, err)
+	return proposal, err
 }
 
-func (d *storageMarketDealer_1_2_0) Deal(ctx context.Context, piece *Piece, sp address.Address) (*boostly.DealProposal, error) {
+// deal proposes a deal for the given piece to sp, capturing the details of the attempt in the given journal entry.
+func (d *storageMarketDealer) deal(ctx context.Context, piece *Piece, sp address.Address, entry *DealJournalEntry) (*boostly.DealProposal, error) {
 	client, err := d.j.wallet.Address()
 	if err != nil {
 		return nil, err
 	}
-	label, err := market.NewLabelFromString(piece.Info.PieceCID.String()) // TODO what would make a good label?
+	label, err := d.j.dealLabeler(ctx, piece)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to label deal: %w", err)
 	}
-	spAddr, err := d.j.fil.StateMinerInfo(ctx, sp) // Cache sp -> peer.AddrInfo or maybe integrate with HeyFil
+	info, err := d.j.providers.info(ctx, sp)
 	if err != nil {
 		return nil, err
 	}
-	if err := d.j.h.Connect(ctx, *spAddr); err != nil {
-		return nil, err
-	}
-	protocol, err := d.j.h.Peerstore().FirstSupportedProtocol(spAddr.ID, boostly.FilStorageMarketProtocol_1_2_0)
+	entry.DryRun = d.j.dealDryRun != DealDryRunDisabled
+	protocol, err := d.negotiateProtocol(ctx, sp)
 	if err != nil {
 		return nil, err
 	}
-	if protocol == "" {
-		return nil, fmt.Errorf("sp %s does not support %s", sp.String(), boostly.FilStorageMarketProtocol_1_2_0)
-	}
+	entry.Protocol = protocol
 	head, err := d.j.fil.ChainHead(ctx)
 	if err != nil {
 		return nil, err
@@ -68,16 +112,44 @@ func (d *storageMarketDealer_1_2_0) Deal(ctx context.Context, piece *Piece, sp a
 	}
 	// TODO check max for network v1 or should we bother?
 
-	bounds, err := d.j.fil.StateDealProviderCollateralBounds(ctx, piece.Info.Size, d.j.dealVerified)
+	dealUuid, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+	entry.DealUUID = dealUuid
+	// Release any funds and DataCap reserved for the proposal unless it is, or may have been, accepted.
+	var accepted, outcomeUnknown bool
+	defer func() {
+		if !accepted && !outcomeUnknown {
+			d.j.escrow.release(dealUuid)
+			d.j.dataCap.release(dealUuid)
+			d.j.budget.release(dealUuid)
+		}
+	}()
+	verified := d.j.dealVerified
+	if verified {
+		if err := d.j.dataCap.reserve(ctx, client, sp, dealUuid, piece.Info.Size, start, head.Height); err != nil {
+			fallback, err := d.j.dataCap.onShortfall(ctx, client, err)
+			if !fallback {
+				return nil, err
+			}
+			verified = false
+		}
+	}
+
+	bounds, err := d.j.fil.StateDealProviderCollateralBounds(ctx, piece.Info.Size, verified)
 	if err != nil {
 		return nil, err
 	}
 	collateral := d.j.dealProviderCollateralPicker(bounds.Min, bounds.Max)
-	price := d.j.dealPricePerEpochPicker(piece.Info.Size, start, end)
+	price, err := d.pickPrice(ctx, sp, piece.Info.Size, start, end, verified)
+	if err != nil {
+		return nil, err
+	}
 	mp := market.DealProposal{
 		PieceCID:             piece.Info.PieceCID,
 		PieceSize:            piece.Info.Size,
-		VerifiedDeal:         d.j.dealVerified,
+		VerifiedDeal:         verified,
 		Client:               client,
 		Provider:             sp,
 		Label:                label,
@@ -85,6 +157,7 @@ func (d *storageMarketDealer_1_2_0) Deal(ctx context.Context, piece *Piece, sp a
 		EndEpoch:             end,
 		StoragePricePerEpoch: price,
 		ProviderCollateral:   collateral,
+		ClientCollateral:     d.j.dealClientCollateral,
 	}
 	mpb, err := cborutil.Dump(mp)
 	if err != nil {
@@ -95,51 +168,229 @@ func (d *storageMarketDealer_1_2_0) Deal(ctx context.Context, piece *Piece, sp a
 		return nil, err
 	}
 
-	offload, err := d.j.offloader.Offload(piece)
-	if err != nil {
-		return nil, err
-	}
-	params, err := json.Marshal(boostly.HttpRequest{
-		URL:     offload.URL.String(),
-		Headers: offload.Headers,
-	})
-	if err != nil {
-		return nil, err
+	entry.Proposal = &market.ClientDealProposal{
+		Proposal:        mp,
+		ClientSignature: *signature,
 	}
 
-	dealUuid, err := uuid.NewRandom()
-	if err != nil {
-		return nil, err
+	// Offline deals carry no transfer, since providers import their data out of band; see ExportOfflineDeals.
+	transfer := boostly.Transfer{Size: uint64(piece.Info.Size.Unpadded())}
+	if !d.j.dealOffline {
+		offload, err := d.j.offloader.Offload(piece, sp, dealUuid)
+		if err != nil {
+			return nil, err
+		}
+		entry.OffloadType = offload.Type
+		entry.OffloadURL = offload.URL.String()
+		if transfer.Params, err = json.Marshal(boostly.HttpRequest{
+			URL:     offload.URL.String(),
+			Headers: offload.Headers,
+		}); err != nil {
+			return nil, err
+		}
+		transfer.Type = offload.Type
 	}
 
 	proposal := boostly.DealProposal{
-		DealUUID:  dealUuid,
-		IsOffline: d.j.options.dealOffline,
-		ClientDealProposal: market.ClientDealProposal{
-			Proposal:        mp,
-			ClientSignature: *signature,
-		},
+		DealUUID:           dealUuid,
+		IsOffline:          d.j.options.dealOffline,
+		ClientDealProposal: *entry.Proposal,
 		// TODO: data root means nothing in the context of jiffy; rivisit for unixfs CAR files.
-		DealDataRoot: piece.Info.PieceCID,
-
-		// Boost ignores transfer if IsOffline is set to true.
-		// Regardless, set the transfer as documentation of how the SP is going to get the data.
-		// TODO: Discuss options to read this with Boost team if set for offline deals.
-		Transfer: boostly.Transfer{
-			Type:   offload.Type,
-			Params: params,
-			Size:   piece.TotalSegmentedSize,
-		},
+		DealDataRoot:       piece.Info.PieceCID,
+		Transfer:           transfer,
 		RemoveUnsealedCopy: d.j.dealRemoveUnsealedCopy,
 		SkipIPNIAnnounce:   d.j.dealSkipIPNIAnnounce,
 	}
 
-	resp, err := boostly.ProposeDeal(ctx, d.j.h, spAddr.ID, proposal)
+	charge := newBudgetCharge(piece, mp)
+	if len(charge.tenants) > 0 {
+		entry.TenantCharges = charge.tenants
+	}
+	if entry.DryRun {
+		if err := d.j.budget.check(charge); err != nil {
+			return nil, err
+		}
+		// Check the escrow without reserving it, since topping it up would commit funds.
+		if err := d.j.escrow.check(ctx, client, mp.ClientBalanceRequirement()); err != nil {
+			return nil, err
+		}
+		logger.Infow("dry run: built deal proposal without proposing it", "piece", piece.Info.PieceCID, "sp", sp, "deal", dealUuid)
+		return &proposal, nil
+	}
+	if err := d.j.budget.reserve(dealUuid, charge); err != nil {
+		return nil, err
+	}
+	if err := d.j.escrow.reserve(ctx, client, sp, dealUuid, mp.ClientBalanceRequirement(), start, head.Height); err != nil {
+		return nil, err
+	}
+	resp, err := d.propose(ctx, info.AddrInfo.ID, protocol, proposal)
+	if errors.Is(err, ErrDealOutcomeUnknown) {
+		// The proposal may have been accepted: count its charge, and keep its funds and DataCap reserved until the
+		// provider reports it published or its start epoch passes.
+		outcomeUnknown = true
+		entry.OutcomeUnknown = true
+		d.j.budget.commit(dealUuid)
+	}
 	if err != nil {
 		return nil, err
 	}
+	entry.Accepted, entry.Message = resp.Accepted, resp.Message
 	if !resp.Accepted {
-		return nil, fmt.Errorf("deal was not accepted by %s: %s", sp, resp.Message)
+		return nil, fmt.Errorf("%w by %s: %s", ErrDealRejected, sp, resp.Message)
 	}
+	accepted = true
+	d.j.budget.commit(dealUuid)
 	return &proposal, nil
 }
+
+// negotiateProtocol returns the most preferred deal protocol supported by sp. See WithDealProtocols. It returns an
+// error wrapping ErrProtocolUnsupported if sp supports none. Offline dry runs assume the most preferred protocol,
+// since they make no connections.
+func (d *storageMarketDealer) negotiateProtocol(ctx context.Context, sp address.Address) (protocol.ID, error) {
+	if d.j.dealDryRun == DealDryRunOffline {
+		return d.j.dealProtocols[0], nil
+	}
+	_, protocol, err := d.j.providers.firstSupportedProtocol(ctx, sp, d.j.dealProtocols...)
+	if err != nil {
+		return "", err
+	}
+	if protocol == "" {
+		return "", fmt.Errorf("%w: sp %s does not support any of %v", ErrProtocolUnsupported, sp.String(), d.j.dealProtocols)
+	}
+	return protocol, nil
+}
+
+// pickPrice queries the storage ask of the given provider and picks the price per epoch of deal accordingly.
+// It returns an error wrapping ErrAskNotSatisfiable if the deal cannot be made within the ask or the maximum price.
+// Offline dry runs pick the configured price without querying the storage ask, subject to the maximum price.
+func (d *storageMarketDealer) pickPrice(ctx context.Context, sp address.Address, pieceSize abi.PaddedPieceSize, start, end abi.ChainEpoch, verified bool) (abi.TokenAmount, error) {
+	hasMaxPrice := d.j.dealMaxPricePerGiBEpoch.Int != nil
+	if d.j.dealDryRun == DealDryRunOffline {
+		price := d.j.dealPricePerEpochPicker(pieceSize, start, end)
+		if hasMaxPrice {
+			if maxPrice := askPricePerEpoch(d.j.dealMaxPricePerGiBEpoch, pieceSize); price.GreaterThan(maxPrice) {
+				return abi.TokenAmount{}, fmt.Errorf("%w: configured price %s per epoch exceeds the maximum of %s", ErrAskNotSatisfiable, price, maxPrice)
+			}
+		}
+		return price, nil
+	}
+	ask, err := d.j.providers.ask(ctx, sp)
+	if err != nil {
+		return abi.TokenAmount{}, fmt.Errorf("failed to query storage ask of %s: %w", sp, err)
+	}
+	if pieceSize < ask.MinPieceSize || (ask.MaxPieceSize > 0 && pieceSize > ask.MaxPieceSize) {
+		return abi.TokenAmount{}, fmt.Errorf("%w: piece size %d is outside the range of %d to %d accepted by %s", ErrAskNotSatisfiable, pieceSize, ask.MinPieceSize, ask.MaxPieceSize, sp)
+	}
+	askPrice := ask.Price
+	if verified {
+		askPrice = ask.VerifiedPrice
+	}
+	if hasMaxPrice && askPrice.GreaterThan(d.j.dealMaxPricePerGiBEpoch) {
+		return abi.TokenAmount{}, fmt.Errorf("%w: %s asks %s per GiB-epoch, exceeding the maximum of %s", ErrAskNotSatisfiable, sp, askPrice, d.j.dealMaxPricePerGiBEpoch)
+	}
+	price, err := d.j.dealAskPricePicker(ask, pieceSize, start, end, verified)
+	if err != nil {
+		return abi.TokenAmount{}, fmt.Errorf("%w: %s", ErrAskNotSatisfiable, err)
+	}
+	if hasMaxPrice {
+		if maxPrice := askPricePerEpoch(d.j.dealMaxPricePerGiBEpoch, pieceSize); price.GreaterThan(maxPrice) {
+			return abi.TokenAmount{}, fmt.Errorf("%w: picked price %s per epoch exceeds the maximum of %s", ErrAskNotSatisfiable, price, maxPrice)
+		}
+	}
+	return price, nil
+}
+
+// propose proposes the given deal to the provider with the given peer ID over the given deal protocol. If the proposal
+// is sent but its response is not read, the provider is asked for the status of the deal, since it may well have
+// accepted the proposal; proposing the piece again under a new deal UUID would then make a duplicate deal. It returns
+// an error wrapping ErrDealOutcomeUnknown if whether the proposal was accepted cannot be told.
+func (d *storageMarketDealer) propose(ctx context.Context, id peer.ID, protocol protocol.ID, proposal boostly.DealProposal) (*boostly.DealProposalResponse, error) {
+	resp, sent, err := proposeDeal(ctx, d.j.h, id, protocol, proposal)
+	if err == nil || !sent {
+		return resp, err
+	}
+	switch known, statusErr := dealKnown(d.j, id, proposal.DealUUID); {
+	case statusErr != nil:
+		return nil, fmt.Errorf("%w: %s; failed to get deal status: %s", ErrDealOutcomeUnknown, err, statusErr)
+	case known:
+		logger.Infow("provider knows of deal despite failure to read proposal response", "deal", proposal.DealUUID, "err", err)
+		return &boostly.DealProposalResponse{Accepted: true}, nil
+	default:
+		return nil, err
+	}
+}
+
+// proposeDeal sends the given proposal to the provider over the given deal protocol, and reads its response. It
+// reports whether the proposal was sent, regardless of error. The stream is opened on the given protocol, rather
+// than via boostly, which only speaks 1.2.0.
+func proposeDeal(ctx context.Context, h host.Host, id peer.ID, protocol protocol.ID, proposal boostly.DealProposal) (*boostly.DealProposalResponse, bool, error) {
+	adapt, ok := dealProtocols[protocol]
+	if !ok {
+		return nil, false, fmt.Errorf("%w: %s", ErrProtocolUnsupported, protocol)
+	}
+	s, err := h.NewStream(ctx, id, protocol)
+	if err != nil {
+		return nil, false, err
+	}
+	defer func() { _ = s.Close() }()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = s.SetDeadline(deadline)
+	}
+
+	var resp boostly.DealProposalResponse
+	var sent atomic.Bool
+	errc := make(chan error, 1)
+	go func() {
+		if err := cborutil.WriteCborRPC(s, adapt(&proposal)); err != nil {
+			errc <- fmt.Errorf("failed to send request: %w", err)
+			return
+		}
+		sent.Store(true)
+		if err := cborutil.ReadCborRPC(s, &resp); err != nil {
+			errc <- fmt.Errorf("failed to read response: %w", err)
+			return
+		}
+		errc <- nil
+	}()
+	select {
+	case err := <-errc:
+		if err != nil {
+			return nil, sent.Load(), err
+		}
+		return &resp, true, nil
+	case <-ctx.Done():
+		_ = s.Reset()
+		return nil, sent.Load(), ctx.Err()
+	}
+}
+
+// dealKnown queries the status of the deal with the given UUID from the provider with the given peer ID, and reports
+// whether the provider knows of the deal, i.e. has accepted its proposal. The query is bounded by its own timeout,
+// since the context of the proposal may have ended.
+func dealKnown(j *Jiffy, id peer.ID, dealUUID uuid.UUID) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dealStatusTimeout)
+	defer cancel()
+	resp, err := boostly.GetDealStatus(ctx, j.h, id, dealUUID, j.wallet.Sign)
+	if err != nil {
+		return false, err
+	}
+	return resp.Error == "" && resp.DealStatus != nil, nil
+}
+
+// dealPublished queries the status of the deal with the given UUID from sp, and reports whether sp has published it.
+func dealPublished(ctx context.Context, j *Jiffy, sp address.Address, dealUUID uuid.UUID) (bool, error) {
+	info, err := j.providers.connect(ctx, sp)
+	if err != nil {
+		return false, fmt.Errorf("failed to connect to provider: %w", err)
+	}
+	resp, err := boostly.GetDealStatus(ctx, j.h, info.AddrInfo.ID, dealUUID, j.wallet.Sign)
+	if err != nil {
+		return false, fmt.Errorf("failed to get deal status from provider: %w", err)
+	}
+	return resp.DealStatus != nil && resp.DealStatus.PublishCid != nil, nil
+}
+
+// adaptDealProposal_1_2_0 returns the proposal as is, since it is of the 1.2.0 wire format.
+func adaptDealProposal_1_2_0(proposal *boostly.DealProposal) any {
+	return proposal
+}
@@ -0,0 +1,240 @@
+package jiffy
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	cborutil "github.com/filecoin-project/go-cbor-util"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/builtin/v9/market"
+	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/filecoin-shipyard/boostly"
+	"github.com/google/uuid"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStorageMarketDealer_NegotiatesProtocolAndProposes(t *testing.T) {
+	tests := []struct {
+		name         string
+		supported    []protocol.ID
+		wantProtocol protocol.ID
+		wantErr      error
+	}{
+		{name: "1.2.0", supported: []protocol.ID{boostly.FilStorageMarketProtocol_1_2_0}, wantProtocol: boostly.FilStorageMarketProtocol_1_2_0},
+		{name: "1.2.1", supported: []protocol.ID{FilStorageMarketProtocol_1_2_1}, wantProtocol: FilStorageMarketProtocol_1_2_1},
+		{
+			name:         "1.2.0 and 1.2.1",
+			supported:    []protocol.ID{boostly.FilStorageMarketProtocol_1_2_0, FilStorageMarketProtocol_1_2_1},
+			wantProtocol: FilStorageMarketProtocol_1_2_1,
+		},
+		{name: "none", supported: []protocol.ID{"/fil/storage/mk/1.1.0"}, wantErr: ErrProtocolUnsupported},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			spHost, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+			require.NoError(t, err)
+			defer spHost.Close()
+			client, err := libp2p.New(libp2p.NoListenAddrs)
+			require.NoError(t, err)
+			defer client.Close()
+
+			received := make(chan boostly.DealProposal, 1)
+			receivedOver := make(chan protocol.ID, 1)
+			for _, p := range test.supported {
+				spHost.SetStreamHandler(p, func(s network.Stream) {
+					defer s.Close()
+					var proposal boostly.DealProposal
+					if err := cborutil.ReadCborRPC(s, &proposal); err != nil {
+						return
+					}
+					received <- proposal
+					receivedOver <- s.Protocol()
+					_ = cborutil.WriteCborRPC(s, &boostly.DealProposalResponse{Accepted: true})
+				})
+			}
+
+			sp, err := address.NewIDAddress(1413)
+			require.NoError(t, err)
+			opts, err := applyTestOptions(WithDealProtocols(FilStorageMarketProtocol_1_2_1, boostly.FilStorageMarketProtocol_1_2_0))
+			require.NoError(t, err)
+			opts.h = client
+			j := &Jiffy{options: opts}
+			j.providers, err = newProviderDirectory(j)
+			require.NoError(t, err)
+			j.providers.entries[sp] = &providerEntry{
+				info:       ProviderInfo{Provider: sp, AddrInfo: peer.AddrInfo{ID: spHost.ID(), Addrs: spHost.Addrs()}},
+				infoExpiry: time.Now().Add(time.Hour),
+			}
+			subject, err := newStorageMarketDealer(j)
+			require.NoError(t, err)
+
+			got, err := subject.negotiateProtocol(ctx, sp)
+			if test.wantErr != nil {
+				require.ErrorIs(t, err, test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.wantProtocol, got)
+
+			// Options carried by proposals reach the provider as set, over the negotiated protocol.
+			proposal := newTestDealProposal(t)
+			proposal.RemoveUnsealedCopy = true
+			proposal.SkipIPNIAnnounce = true
+			resp, err := subject.propose(ctx, spHost.ID(), got, proposal)
+			require.NoError(t, err)
+			require.True(t, resp.Accepted)
+			gotProposal := <-received
+			require.True(t, gotProposal.RemoveUnsealedCopy)
+			require.True(t, gotProposal.SkipIPNIAnnounce)
+			require.Equal(t, test.wantProtocol, <-receivedOver)
+		})
+	}
+	_, err := applyTestOptions(WithDealProtocols("/fil/storage/mk/1.3.0"))
+	require.Error(t, err)
+}
+
+func TestStorageMarketDealer_ProposeChecksStatusOfLostResponse(t *testing.T) {
+	proposal := newTestDealProposal(t)
+	known := &boostly.DealStatus{
+		Status:            "Accepted",
+		Proposal:          proposal.ClientDealProposal.Proposal,
+		SignedProposalCid: proposal.DealDataRoot,
+	}
+	tests := []struct {
+		name         string
+		loseResponse bool
+		status       *boostly.DealStatusResponse
+		wantAccepted bool
+		wantErr      error
+	}{
+		{name: "response read", wantAccepted: true},
+		{name: "response lost and deal known", loseResponse: true, status: &boostly.DealStatusResponse{DealStatus: known}, wantAccepted: true},
+		{name: "response lost and deal unknown", loseResponse: true, status: &boostly.DealStatusResponse{Error: "no such deal"}, wantErr: errors.New("failed to read response")},
+		{name: "response lost and status unavailable", loseResponse: true, wantErr: ErrDealOutcomeUnknown},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			sp, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+			require.NoError(t, err)
+			defer sp.Close()
+			client, err := libp2p.New(libp2p.NoListenAddrs)
+			require.NoError(t, err)
+			defer client.Close()
+
+			sp.SetStreamHandler(boostly.FilStorageMarketProtocol_1_2_0, func(s network.Stream) {
+				var proposal boostly.DealProposal
+				if err := cborutil.ReadCborRPC(s, &proposal); err != nil || test.loseResponse {
+					_ = s.Reset()
+					return
+				}
+				defer s.Close()
+				_ = cborutil.WriteCborRPC(s, &boostly.DealProposalResponse{Accepted: true})
+			})
+			if test.status != nil {
+				sp.SetStreamHandler(boostly.FilStorageStatusProtocol_1_2_0, func(s network.Stream) {
+					defer s.Close()
+					var req boostly.DealStatusRequest
+					if err := cborutil.ReadCborRPC(s, &req); err != nil {
+						return
+					}
+					_ = cborutil.WriteCborRPC(s, test.status)
+				})
+			}
+			require.NoError(t, client.Connect(ctx, peer.AddrInfo{ID: sp.ID(), Addrs: sp.Addrs()}))
+
+			opts, err := applyTestOptions()
+			require.NoError(t, err)
+			opts.h = client
+			opts.wallet = fakeWallet{}
+			subject, err := newStorageMarketDealer(&Jiffy{options: opts})
+			require.NoError(t, err)
+			resp, err := subject.propose(ctx, sp.ID(), boostly.FilStorageMarketProtocol_1_2_0, proposal)
+			if test.wantErr != nil {
+				require.ErrorContains(t, err, test.wantErr.Error())
+				require.Equal(t, errors.Is(test.wantErr, ErrDealOutcomeUnknown), errors.Is(err, ErrDealOutcomeUnknown))
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.wantAccepted, resp.Accepted)
+		})
+	}
+}
+
+func TestStorageMarketDealer_PickPriceOfflineDryRun(t *testing.T) {
+	sp, err := address.NewIDAddress(1413)
+	require.NoError(t, err)
+	tests := []struct {
+		name     string
+		maxPrice abi.TokenAmount
+		wantErr  bool
+	}{
+		{name: "no maximum"},
+		{name: "within maximum", maxPrice: big.NewInt(100)},
+		{name: "exceeds maximum", maxPrice: big.NewInt(10), wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts, err := applyTestOptions(WithDealDryRun(DealDryRunOffline))
+			require.NoError(t, err)
+			opts.dealMaxPricePerGiBEpoch = test.maxPrice
+			opts.dealPricePerEpochPicker = func(abi.PaddedPieceSize, abi.ChainEpoch, abi.ChainEpoch) abi.TokenAmount {
+				return big.NewInt(50)
+			}
+			// The dealer must not query the ask, i.e. must not use the absent libp2p host.
+			subject, err := newStorageMarketDealer(&Jiffy{options: opts})
+			require.NoError(t, err)
+			got, err := subject.pickPrice(context.Background(), sp, 1*GiB, 10, 20, false)
+			if test.wantErr {
+				require.ErrorIs(t, err, ErrAskNotSatisfiable)
+			} else {
+				require.NoError(t, err)
+				require.True(t, big.NewInt(50).Equals(got))
+			}
+		})
+	}
+}
+
+func newTestDealProposal(t *testing.T) boostly.DealProposal {
+	root := testRootCid(t, "fish")
+	provider, err := address.NewIDAddress(1413)
+	require.NoError(t, err)
+	return boostly.DealProposal{
+		DealUUID: uuid.New(),
+		ClientDealProposal: market.ClientDealProposal{
+			Proposal: market.DealProposal{
+				PieceCID:             root,
+				Client:               provider,
+				Provider:             provider,
+				Label:                market.EmptyDealLabel,
+				StoragePricePerEpoch: big.Zero(),
+				ProviderCollateral:   big.Zero(),
+				ClientCollateral:     big.Zero(),
+			},
+			ClientSignature: crypto.Signature{Type: crypto.SigTypeSecp256k1, Data: []byte("fish")},
+		},
+		DealDataRoot: root,
+	}
+}
+
+// fakeWallet signs anything with a fixed signature.
+type fakeWallet struct{}
+
+func (fakeWallet) Sign(context.Context, []byte) (*crypto.Signature, error) {
+	return &crypto.Signature{Type: crypto.SigTypeSecp256k1, Data: []byte("fish")}, nil
+}
+
+func (fakeWallet) Address() (address.Address, error) {
+	return address.NewIDAddress(1414)
+}
@@ -8,4 +8,53 @@ var (
 
 	//ErrSegmentNotFound signals that the segment corresponding to a given piece CID is not found.
 	ErrSegmentNotFound = errors.New("segment not found")
+
+	// ErrSegmentAffinityConflict signals that identical segment data already belongs to another affinity group, e.g.
+	// another tenant. Segments are identified by piece CID; therefore, they cannot belong to more than one group.
+	ErrSegmentAffinityConflict = errors.New("segment belongs to another affinity group")
+
+	// ErrPieceNotFound signals that no manifest is recorded for a given aggregate piece CID.
+	ErrPieceNotFound = errors.New("piece not found")
+
+	// ErrPieceCIDMismatch signals that the aggregate data of a piece does not hash to its piece CID.
+	ErrPieceCIDMismatch = errors.New("piece data does not match piece CID")
+
+	// ErrAskNotSatisfiable signals that a deal cannot be made with a storage provider within the constraints of its
+	// storage ask, e.g. because the ask price exceeds the maximum price.
+	ErrAskNotSatisfiable = errors.New("storage ask cannot be satisfied")
+
+	// ErrInsufficientEscrow signals that the storage market escrow of the client cannot cover the funds needed by a
+	// deal proposal.
+	ErrInsufficientEscrow = errors.New("insufficient market escrow")
+
+	// ErrInsufficientDataCap signals that the remaining DataCap of the client cannot cover a verified deal.
+	ErrInsufficientDataCap = errors.New("insufficient DataCap")
+
+	// ErrDealRejected signals that a storage provider rejected a deal proposal.
+	ErrDealRejected = errors.New("deal was rejected")
+
+	// ErrDealOutcomeUnknown signals that a deal proposal was sent to a storage provider, but whether the provider
+	// accepted it cannot be told. Such proposals are not retried, since doing so may make a duplicate deal.
+	ErrDealOutcomeUnknown = errors.New("deal outcome unknown")
+
+	// ErrProtocolUnsupported signals that a storage provider does not support the protocol needed to make a deal.
+	ErrProtocolUnsupported = errors.New("protocol not supported")
+
+	// ErrProviderCoolingDown signals that a storage provider is not dealt with temporarily, after repeated deal
+	// failures.
+	ErrProviderCoolingDown = errors.New("provider is cooling down")
+
+	// ErrBudgetExceeded signals that a deal proposal would commit more storage price than allowed by the daily, total
+	// or tenant budget.
+	ErrBudgetExceeded = errors.New("budget exceeded")
+
+	// ErrAllocationExpired signals that a replica onboarded without a market deal was neither allocated nor claimed on
+	// chain by the expiration of its allocation.
+	ErrAllocationExpired = errors.New("allocation expired")
+
+	// ErrDealLabelTooLong signals that a deal label exceeds market.DealMaxLabelSize bytes.
+	ErrDealLabelTooLong = errors.New("deal label too long")
+
+	// ErrReadOnlyBlockstore signals that an attempt was made to modify the read-only blockstore view over segments.
+	ErrReadOnlyBlockstore = errors.New("blockstore is read-only")
 )
@@ -0,0 +1,235 @@
+package jiffy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/builtin"
+	"github.com/filecoin-project/go-state-types/exitcode"
+	"github.com/google/uuid"
+	"github.com/ipfs/go-cid"
+)
+
+type (
+	// marketEscrow keeps track of the storage market escrow funds of the client, as needed by proposals that are not
+	// yet published on chain, and tops up the escrow if configured to do so.
+	marketEscrow struct {
+		j *Jiffy
+
+		mutex sync.Mutex
+		// reserved maps the deal UUID of proposals that are not yet published to the funds they need.
+		reserved map[uuid.UUID]reservedFunds
+		// toppingUp maps the CID of pushed AddBalance messages that are not yet executed to their value.
+		toppingUp map[cid.Cid]abi.TokenAmount
+		// pushingTopUp is the total value of AddBalance messages that are being pushed.
+		pushingTopUp abi.TokenAmount
+		// published reports whether the given storage provider has published the deal with the given UUID.
+		published func(context.Context, address.Address, uuid.UUID) (bool, error)
+	}
+	reservedFunds struct {
+		amount abi.TokenAmount
+		// provider is the storage provider to which the deal is proposed, if proposed over the storage market.
+		provider address.Address
+		// message is the CID of the client message that spends the funds once executed, if any.
+		message cid.Cid
+		// startEpoch is the start epoch of deal, after which the proposal can no longer be published.
+		startEpoch abi.ChainEpoch
+	}
+)
+
+func newMarketEscrow(j *Jiffy) (*marketEscrow, error) {
+	return &marketEscrow{
+		j:            j,
+		reserved:     make(map[uuid.UUID]reservedFunds),
+		toppingUp:    make(map[cid.Cid]abi.TokenAmount),
+		pushingTopUp: big.Zero(),
+		published: func(ctx context.Context, sp address.Address, dealUUID uuid.UUID) (bool, error) {
+			return dealPublished(ctx, j, sp, dealUUID)
+		},
+	}, nil
+}
+
+// reserve reserves the given amount of escrow funds for the proposal with the given deal UUID made to sp. If the
+// available funds fall short, it tops up the escrow by the shortfall when top-up is enabled and within its cap.
+// Otherwise, it returns an error wrapping ErrInsufficientEscrow. The mutex lock is not held while calling the chain,
+// so that concurrent reservations and releases are not held up by it.
+func (e *marketEscrow) reserve(ctx context.Context, client, sp address.Address, dealUUID uuid.UUID, amount abi.TokenAmount, startEpoch, head abi.ChainEpoch) error {
+	balance, err := e.balance(ctx, client)
+	if err != nil {
+		return err
+	}
+	e.mutex.Lock()
+	for id, funds := range e.reserved {
+		if funds.startEpoch <= head {
+			delete(e.reserved, id)
+		}
+	}
+	reserved, toppingUp := e.totals()
+	shortfall := escrowShortfall(balance, reserved, toppingUp, amount)
+	if shortfall.GreaterThan(big.Zero()) && len(e.reserved) > 0 {
+		// Funds of proposals published since they were last verified are locked on chain as well as reserved.
+		// Stop counting them twice before concluding that the escrow falls short.
+		e.mutex.Unlock()
+		if e.releasePublished(ctx) {
+			if balance, err = e.balance(ctx, client); err != nil {
+				return err
+			}
+		}
+		e.mutex.Lock()
+		reserved, toppingUp = e.totals()
+		shortfall = escrowShortfall(balance, reserved, toppingUp, amount)
+	}
+	if shortfall.LessThanEqual(big.Zero()) {
+		e.reserved[dealUUID] = reservedFunds{amount: amount, provider: sp, startEpoch: startEpoch}
+		e.mutex.Unlock()
+		return nil
+	}
+	if e.j.dealEscrowTopUpCap.Int == nil {
+		e.mutex.Unlock()
+		return fmt.Errorf("%w: short of %s for deal %s", ErrInsufficientEscrow, shortfall, dealUUID)
+	}
+	if projected := big.Sum(balance.Escrow, toppingUp, shortfall); projected.GreaterThan(e.j.dealEscrowTopUpCap) {
+		e.mutex.Unlock()
+		return fmt.Errorf("%w: topping up %s would bring escrow to %s, exceeding the cap of %s", ErrInsufficientEscrow, shortfall, projected, e.j.dealEscrowTopUpCap)
+	}
+	// Count both the reservation and the top-up before pushing the message, so that concurrent reservations do not
+	// top up for the same shortfall.
+	e.reserved[dealUUID] = reservedFunds{amount: amount, provider: sp, startEpoch: startEpoch}
+	e.pushingTopUp = big.Add(e.pushingTopUp, shortfall)
+	e.mutex.Unlock()
+
+	msg, err := e.addBalance(ctx, client, shortfall)
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.pushingTopUp = big.Sub(e.pushingTopUp, shortfall)
+	if err != nil {
+		delete(e.reserved, dealUUID)
+		return fmt.Errorf("failed to top up escrow: %w", err)
+	}
+	logger.Infow("topping up market escrow", "client", client, "amount", shortfall, "message", msg)
+	e.toppingUp[msg] = shortfall
+	return nil
+}
+
+// balance gets the market balance of client, having stopped counting the executed top-up messages. The balance is
+// got first, so that a top-up executed in between is at worst counted as pending rather than twice.
+func (e *marketEscrow) balance(ctx context.Context, client address.Address) (*marketBalance, error) {
+	balance, err := e.j.chain.StateMarketBalance(ctx, client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get market balance: %w", err)
+	}
+	e.settleTopUps(ctx)
+	return balance, nil
+}
+
+// releasePublished releases the funds reserved for proposals that their storage provider reports as published, and
+// reports whether any were released.
+func (e *marketEscrow) releasePublished(ctx context.Context) bool {
+	e.mutex.Lock()
+	reserved := make(map[uuid.UUID]address.Address, len(e.reserved))
+	for id, funds := range e.reserved {
+		reserved[id] = funds.provider
+	}
+	e.mutex.Unlock()
+
+	var released bool
+	for id, sp := range reserved {
+		switch published, err := e.published(ctx, sp, id); {
+		case err != nil:
+			logger.Warnw("failed to check whether deal is published", "sp", sp, "deal", id, "err", err)
+		case published:
+			e.release(id)
+			released = true
+		}
+	}
+	return released
+}
+
+// settleTopUps stops counting the top-up messages that have been executed towards available funds.
+func (e *marketEscrow) settleTopUps(ctx context.Context) {
+	e.mutex.Lock()
+	msgs := make([]cid.Cid, 0, len(e.toppingUp))
+	for msg := range e.toppingUp {
+		msgs = append(msgs, msg)
+	}
+	e.mutex.Unlock()
+
+	for _, msg := range msgs {
+		switch lookup, err := e.j.chain.StateSearchMsg(ctx, msg); {
+		case err != nil:
+			logger.Warnw("failed to look up escrow top-up message", "message", msg, "err", err)
+		case lookup == nil:
+			// Not executed yet; keep counting it towards available funds.
+		default:
+			if lookup.Receipt.ExitCode != exitcode.Ok {
+				logger.Errorw("escrow top-up message failed", "message", msg, "exitCode", lookup.Receipt.ExitCode)
+			}
+			e.mutex.Lock()
+			delete(e.toppingUp, msg)
+			e.mutex.Unlock()
+		}
+	}
+}
+
+// check checks that the available escrow funds cover the given amount, without reserving them or topping up the
+// escrow. It returns an error wrapping ErrInsufficientEscrow otherwise.
+func (e *marketEscrow) check(ctx context.Context, client address.Address, amount abi.TokenAmount) error {
+	balance, err := e.j.chain.StateMarketBalance(ctx, client)
+	if err != nil {
+		return fmt.Errorf("failed to get market balance: %w", err)
+	}
+	e.mutex.Lock()
+	reserved, toppingUp := e.totals()
+	e.mutex.Unlock()
+	if shortfall := escrowShortfall(balance, reserved, toppingUp, amount); shortfall.GreaterThan(big.Zero()) {
+		return fmt.Errorf("%w: short of %s", ErrInsufficientEscrow, shortfall)
+	}
+	return nil
+}
+
+// release releases the funds reserved for the given deal UUID, e.g. once the proposal is rejected or published.
+func (e *marketEscrow) release(dealUUID uuid.UUID) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	delete(e.reserved, dealUUID)
+}
+
+// totals sums the reserved and topping up funds. The caller must hold the mutex lock.
+func (e *marketEscrow) totals() (abi.TokenAmount, abi.TokenAmount) {
+	reserved, toppingUp := big.Zero(), e.pushingTopUp
+	for _, funds := range e.reserved {
+		reserved = big.Add(reserved, funds.amount)
+	}
+	for _, amount := range e.toppingUp {
+		toppingUp = big.Add(toppingUp, amount)
+	}
+	return reserved, toppingUp
+}
+
+// addBalance pushes a storage market AddBalance message that adds the given amount to the escrow of client.
+func (e *marketEscrow) addBalance(ctx context.Context, client address.Address, amount abi.TokenAmount) (cid.Cid, error) {
+	var params bytes.Buffer
+	if err := client.MarshalCBOR(&params); err != nil {
+		return cid.Undef, err
+	}
+	return pushMessage(ctx, e.j.chain, e.j.wallet, &chainMessage{
+		To:     builtin.StorageMarketActorAddr,
+		From:   client,
+		Value:  amount,
+		Method: builtin.MethodsMarket.AddBalance,
+		Params: params.Bytes(),
+	})
+}
+
+// escrowShortfall computes how much the available escrow falls short of the given amount, where available escrow is
+// the balance not locked on chain nor reserved by pending proposals, plus the funds that are being topped up.
+func escrowShortfall(balance *marketBalance, reserved, toppingUp, amount abi.TokenAmount) abi.TokenAmount {
+	available := big.Sub(big.Add(big.Sub(balance.Escrow, balance.Locked), toppingUp), reserved)
+	return big.Max(big.Sub(amount, available), big.Zero())
+}
@@ -0,0 +1,86 @@
+package jiffy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEscrowShortfall(t *testing.T) {
+	tests := []struct {
+		name      string
+		balance   marketBalance
+		reserved  int64
+		toppingUp int64
+		amount    int64
+		want      int64
+	}{
+		{name: "sufficient", balance: marketBalance{Escrow: big.NewInt(100), Locked: big.NewInt(40)}, amount: 60, want: 0},
+		{name: "locked funds", balance: marketBalance{Escrow: big.NewInt(100), Locked: big.NewInt(40)}, amount: 70, want: 10},
+		{name: "reserved funds", balance: marketBalance{Escrow: big.NewInt(100), Locked: big.NewInt(0)}, reserved: 80, amount: 30, want: 10},
+		{name: "topping up", balance: marketBalance{Escrow: big.NewInt(100), Locked: big.NewInt(0)}, reserved: 80, toppingUp: 10, amount: 30, want: 0},
+		{name: "empty", balance: marketBalance{Escrow: big.NewInt(0), Locked: big.NewInt(0)}, amount: 30, want: 30},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := escrowShortfall(&test.balance, big.NewInt(test.reserved), big.NewInt(test.toppingUp), big.NewInt(test.amount))
+			require.True(t, abi.NewTokenAmount(test.want).Equals(got), "expected %d, got %s", test.want, got)
+		})
+	}
+}
+
+func TestMarketEscrow_ReserveReleasesPublished(t *testing.T) {
+	ctx := context.Background()
+	client, err := address.NewIDAddress(1413)
+	require.NoError(t, err)
+	sp, err := address.NewIDAddress(1414)
+	require.NoError(t, err)
+
+	var subject *marketEscrow
+	var lockedDuringCall atomic.Bool
+	// The first deal is published, and its funds are locked on chain.
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subject.mutex.TryLock() {
+			subject.mutex.Unlock()
+		} else {
+			lockedDuringCall.Store(true)
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"jsonrpc": "2.0",
+			"id":      0,
+			"result":  marketBalance{Escrow: big.NewInt(100), Locked: big.NewInt(60)},
+		})
+	}))
+	defer api.Close()
+
+	opts, err := applyTestOptions()
+	require.NoError(t, err)
+	opts.chain = newChainClient(api.URL)
+	subject, err = newMarketEscrow(&Jiffy{options: opts})
+	require.NoError(t, err)
+	published, pending := uuid.New(), uuid.New()
+	subject.published = func(_ context.Context, _ address.Address, dealUUID uuid.UUID) (bool, error) {
+		return dealUUID == published, nil
+	}
+	subject.reserved[published] = reservedFunds{amount: big.NewInt(60), provider: sp, startEpoch: 100}
+
+	// Without counting the published deal twice, the remaining 40 cover the next proposal.
+	require.NoError(t, subject.reserve(ctx, client, sp, pending, big.NewInt(30), 100, 10))
+	require.NotContains(t, subject.reserved, published)
+	require.Contains(t, subject.reserved, pending)
+
+	// Funds reserved by proposals that are not published yet still count.
+	err = subject.reserve(ctx, client, sp, uuid.New(), big.NewInt(30), 100, 10)
+	require.ErrorIs(t, err, ErrInsufficientEscrow)
+	// The escrow is not locked while calling the chain.
+	require.False(t, lockedDuringCall.Load())
+}
@@ -0,0 +1,50 @@
+package jiffy
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-shipyard/jiffy/datasegment"
+)
+
+// ProveInclusion returns the proof of data segment inclusion (PoDSI) for the given segment in the piece.
+// The proof links the segment piece CID to the piece CID of the aggregate, which is the piece CID of deals made
+// for the piece. It consists of the proof that the segment piece commitment sits at its offset in the aggregate
+// tree, and the proof that the data segment index at the tail of the piece contains an entry for it.
+//
+// See VerifyInclusion.
+func (p *Piece) ProveInclusion(segment abi.PieceInfo) (*datasegment.InclusionProof, error) {
+	aggregate, err := p.aggregate()
+	if err != nil {
+		return nil, err
+	}
+	switch proof, err := aggregate.ProofForPieceInfo(segment); {
+	case errors.Is(err, datasegment.ErrSubPieceNotFound):
+		return nil, ErrSegmentNotFound
+	case err != nil:
+		return nil, err
+	default:
+		return proof, nil
+	}
+}
+
+// VerifyInclusion verifies that the given proof of data segment inclusion proves that the segment is included in
+// the piece, typically the piece of an on-chain deal.
+func VerifyInclusion(segment abi.PieceInfo, piece abi.PieceInfo, proof *datasegment.InclusionProof) error {
+	aux, err := proof.ComputeExpectedAuxData(datasegment.InclusionVerifierData{
+		CommPc: segment.PieceCID,
+		SizePc: segment.Size,
+	})
+	if err != nil {
+		return err
+	}
+	switch {
+	case !aux.CommPa.Equals(piece.PieceCID):
+		return fmt.Errorf("proven piece CID mismatch; expected '%s' but got: '%s'", piece.PieceCID, aux.CommPa)
+	case aux.SizePa != piece.Size:
+		return fmt.Errorf("proven piece size mismatch; expected '%d' but got: '%d'", piece.Size, aux.SizePa)
+	default:
+		return nil
+	}
+}
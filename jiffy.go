@@ -4,16 +4,21 @@ import (
 	"context"
 	"io"
 
+	"github.com/filecoin-project/go-address"
 	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-log/v2"
 )
 
 var (
 	logger = log.Logger("jiffy")
 
-	_ Segmentor  = (*Jiffy)(nil)
-	_ Replicator = (*Jiffy)(nil)
-	_ Retriever  = (*Jiffy)(nil)
+	_ Segmentor    = (*Jiffy)(nil)
+	_ Replicator   = (*Jiffy)(nil)
+	_ Retriever    = (*Jiffy)(nil)
+	_ PieceCatalog = (*Jiffy)(nil)
+	_ Planner      = (*Jiffy)(nil)
 )
 
 type (
@@ -23,8 +28,17 @@ type (
 		offloader  Offloader
 		segmentor  Segmentor
 		replicator Replicator
+		planner    Planner
 		retriever  Retriever
 		dealer     Dealer
+		blockstore blockstore.Blockstore
+		catalog    *localPieceCatalog
+		journal    *dealJournal
+		exporter   *offlineDealExporter
+		providers  *providerDirectory
+		budget     *dealBudget
+		escrow     *marketEscrow
+		dataCap    *dataCapTracker
 	}
 )
 
@@ -42,11 +56,42 @@ func New(o ...Option) (*Jiffy, error) {
 		// Using the segmentor in this way essentially means we get local retrieval only.
 		// TODO replace with remote retriever with local retrieval fallback.
 		j.retriever = s
+		if j.blockstore, err = newSegmentBlockstore(s); err != nil {
+			return nil, err
+		}
+	}
+	if j.providers, err = newProviderDirectory(&j); err != nil {
+		return nil, err
+	}
+	if j.escrow, err = newMarketEscrow(&j); err != nil {
+		return nil, err
+	}
+	if j.dataCap, err = newDataCapTracker(&j); err != nil {
+		return nil, err
+	}
+	if j.catalog, err = newLocalPieceCatalog(&j); err != nil {
+		return nil, err
+	}
+	if j.journal, err = newDealJournal(&j); err != nil {
+		return nil, err
 	}
-	if j.replicator, err = newSimpleReplicator(&j); err != nil {
+	if j.budget, err = newDealBudget(&j); err != nil {
 		return nil, err
 	}
-	if j.dealer, err = newStorageMarketDealer_1_2_0(&j); err != nil {
+	if j.exporter, err = newOfflineDealExporter(&j); err != nil {
+		return nil, err
+	}
+	if r, err := newSimpleReplicator(&j); err != nil {
+		return nil, err
+	} else {
+		j.replicator = r
+		j.planner = r
+	}
+	if j.dealDirectOnboarding {
+		if j.dealer, err = newDirectDataOnboardingDealer(&j); err != nil {
+			return nil, err
+		}
+	} else if j.dealer, err = newStorageMarketDealer(&j); err != nil {
 		return nil, err
 	}
 	if j.offloader, err = newHttpOffloader(&j); err != nil {
@@ -77,8 +122,14 @@ func (j *Jiffy) GetReplicas(ctx context.Context, info abi.PieceInfo) ([]Replica,
 	return j.replicator.GetReplicas(ctx, info)
 }
 
-func (j *Jiffy) Segment(ctx context.Context, closer io.ReadCloser) (*Segment, error) {
-	return j.segmentor.Segment(ctx, closer)
+// Plan returns the pieces that would be dealt if a replication cycle were to run now, along with the storage
+// providers that would be picked and the estimated deal prices. No deals are made.
+func (j *Jiffy) Plan(ctx context.Context) (*Plan, error) {
+	return j.planner.Plan(ctx)
+}
+
+func (j *Jiffy) Segment(ctx context.Context, closer io.ReadCloser, o ...SegmentOption) (*Segment, error) {
+	return j.segmentor.Segment(ctx, closer, o...)
 }
 
 func (j *Jiffy) GetSegment(ctx context.Context, info abi.PieceInfo) (*Segment, error) {
@@ -89,6 +140,74 @@ func (j *Jiffy) ListSegments(ctx context.Context) ([]*Segment, error) {
 	return j.segmentor.ListSegments(ctx)
 }
 
+// NewPieceReader returns a reader over the aggregate data of the given piece, as it would be received by storage
+// providers. The data read from it hashes to Piece.Info.PieceCID.
+// The returned reader must be closed when no longer in use.
+func (j *Jiffy) NewPieceReader(ctx context.Context, piece *Piece) (io.ReadSeekCloser, error) {
+	return newPieceReader(ctx, piece, j.retriever)
+}
+
+// VerifyPiece checks that the aggregate data of the given piece hashes to its piece CID and size. It returns an
+// error wrapping ErrPieceCIDMismatch if it does not.
+func (j *Jiffy) VerifyPiece(ctx context.Context, piece *Piece) error {
+	return verifyPiece(ctx, piece, j.retriever)
+}
+
+// Blockstore returns a read-only blockstore.Blockstore view over the CAR sections of local segments.
+// It can be used to serve segment data to IPFS components, such as a Bitswap server or a gateway handler.
+func (j *Jiffy) Blockstore() blockstore.Blockstore {
+	return j.blockstore
+}
+
+// GetPieceManifest returns the manifest of the aggregate piece with the given piece CID, recording the padded
+// offset of each of its segments and the deals made for it.
+func (j *Jiffy) GetPieceManifest(ctx context.Context, pieceCID cid.Cid) (*PieceManifest, error) {
+	return j.catalog.GetPieceManifest(ctx, pieceCID)
+}
+
+func (j *Jiffy) ListPieceManifests(ctx context.Context) ([]*PieceManifest, error) {
+	return j.catalog.ListPieceManifests(ctx)
+}
+
+// FindPieceManifests returns the manifests of aggregate pieces that contain the given segment.
+func (j *Jiffy) FindPieceManifests(ctx context.Context, segment abi.PieceInfo) ([]*PieceManifest, error) {
+	return j.catalog.FindPieceManifests(ctx, segment)
+}
+
+// OfflineDealManifest lists the offline deals made with the given storage provider that are yet to start, along with
+// their pieces and start epochs. See ExportOfflineDeals to materialise the piece data for import by the provider.
+func (j *Jiffy) OfflineDealManifest(ctx context.Context, sp address.Address) (*OfflineDealManifest, error) {
+	manifest, _, err := j.exporter.manifest(ctx, sp)
+	return manifest, err
+}
+
+// ExportOfflineDeals materialises the pieces of offline deals made with the given storage provider that are yet to
+// start under dir/<sp>, e.g. on a removable disk, as <piece CID>.dat files of aggregate piece data ready for import by
+// the provider. The manifest of exported deals, including the path, format and SHA-256 checksum of each piece file,
+// is written alongside them as manifest.csv and manifest.json.
+func (j *Jiffy) ExportOfflineDeals(ctx context.Context, sp address.Address, dir string) (*OfflineDealManifest, error) {
+	return j.exporter.export(ctx, sp, dir)
+}
+
+// GetProviderInfo returns the addressing and sector size of the given storage provider, along with its protocols,
+// transports and storage ask if known. The information is cached, and refreshed from chain once expired. See
+// WithProviderInfoTTL.
+func (j *Jiffy) GetProviderInfo(ctx context.Context, sp address.Address) (*ProviderInfo, error) {
+	return j.providers.info(ctx, sp)
+}
+
+// GetDealBudget returns the storage price committed by deal proposals, overall, today and per tenant, along with the
+// configured limits. See WithDailyBudget, WithTotalBudget and WithTenantBudget.
+func (j *Jiffy) GetDealBudget() *DealBudget {
+	return j.budget.status()
+}
+
+// QueryDealJournal returns the recorded deal attempts that match the given query, oldest first. Every attempt is
+// recorded, including the ones that fail before a proposal is made.
+func (j *Jiffy) QueryDealJournal(ctx context.Context, q DealJournalQuery) ([]DealJournalEntry, error) {
+	return j.journal.query(ctx, q)
+}
+
 func (j *Jiffy) Shutdown(ctx context.Context) error {
 	type shutdowner interface {
 		Shutdown(ctx context.Context) error
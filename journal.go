@@ -0,0 +1,171 @@
+package jiffy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/builtin/v9/market"
+	"github.com/google/uuid"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// maxDealJournalEntrySize is the maximum size of a single encoded journal entry.
+const maxDealJournalEntrySize = 1 << 20
+
+type (
+	// DealJournalEntry records a single attempt at dealing a piece with a storage provider.
+	DealJournalEntry struct {
+		Time     time.Time
+		Piece    abi.PieceInfo
+		Provider address.Address
+		// DealUUID is the UUID of the deal proposal, if one was generated.
+		DealUUID uuid.UUID
+		// Proposal is the signed deal proposal, if one was made. It is absent for direct data onboarding.
+		Proposal *market.ClientDealProposal `json:",omitempty"`
+		// TenantCharges is the share of the storage price of the proposal charged to each tenant budget, if any.
+		TenantCharges map[string]abi.TokenAmount `json:",omitempty"`
+		// Protocol is the deal protocol negotiated with the provider, if any.
+		Protocol protocol.ID `json:",omitempty"`
+		// OffloadType and OffloadURL record the offload used to transfer piece data, if any. Offload headers are
+		// deliberately not recorded since they may carry credentials.
+		OffloadType string `json:",omitempty"`
+		OffloadURL  string `json:",omitempty"`
+		// ChainMessage is the CID of the message pushed to chain as part of the attempt, if any.
+		ChainMessage *cid.Cid `json:",omitempty"`
+		// Accepted and Message record the response of the provider to the proposal, if any.
+		Accepted bool
+		Message  string `json:",omitempty"`
+		// OutcomeUnknown signals that the proposal was sent, but whether the provider accepted it could not be told.
+		// Its storage price is counted against the budget as if accepted. See ErrDealOutcomeUnknown.
+		OutcomeUnknown bool `json:",omitempty"`
+		// DryRun signals that the proposal was built but not proposed. See WithDealDryRun.
+		DryRun bool `json:",omitempty"`
+		// Error is the error that failed the attempt, if any.
+		Error string `json:",omitempty"`
+	}
+	// DealJournalQuery filters the entries returned by a deal journal query. Zero-valued fields match any entry.
+	DealJournalQuery struct {
+		PieceCID cid.Cid
+		Provider address.Address
+		DealUUID uuid.UUID
+		Since    time.Time
+		// FailedOnly restricts the results to failed attempts.
+		FailedOnly bool
+	}
+
+	// dealJournal is an append-only journal of deal attempts, stored as JSON lines in a file on local disk.
+	dealJournal struct {
+		j *Jiffy
+
+		mutex sync.Mutex
+	}
+)
+
+func newDealJournal(j *Jiffy) (*dealJournal, error) {
+	if err := os.MkdirAll(filepath.Dir(j.dealJournalPath), 0755); err != nil {
+		return nil, err
+	}
+	return &dealJournal{j: j}, nil
+}
+
+func newDealJournalEntry(piece *Piece, sp address.Address) *DealJournalEntry {
+	return &DealJournalEntry{
+		Time:     time.Now(),
+		Piece:    piece.Info,
+		Provider: sp,
+	}
+}
+
+// record appends the given entry to the journal, along with the error that failed the attempt, if any.
+// Failure to record is logged, since it must not fail the deal attempt itself.
+func (dj *dealJournal) record(entry *DealJournalEntry, err error) {
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	if err := dj.append(entry); err != nil {
+		logger.Errorw("failed to record deal journal entry", "piece", entry.Piece.PieceCID, "sp", entry.Provider, "err", err)
+	}
+}
+
+func (dj *dealJournal) append(entry *DealJournalEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	dj.mutex.Lock()
+	defer dj.mutex.Unlock()
+	f, err := os.OpenFile(dj.j.dealJournalPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(line); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// query returns the journal entries that match the given query, in the order in which they were recorded.
+func (dj *dealJournal) query(ctx context.Context, q DealJournalQuery) ([]DealJournalEntry, error) {
+	dj.mutex.Lock()
+	defer dj.mutex.Unlock()
+	f, err := os.Open(dj.j.dealJournalPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	var entries []DealJournalEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxDealJournalEntrySize)
+	for line := 1; scanner.Scan(); line++ {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+		var entry DealJournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("failed to decode deal journal entry at line %d: %w", line, err)
+		}
+		if q.matches(&entry) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+func (q DealJournalQuery) matches(entry *DealJournalEntry) bool {
+	switch {
+	case q.PieceCID.Defined() && !q.PieceCID.Equals(entry.Piece.PieceCID):
+		return false
+	case q.Provider != address.Undef && q.Provider != entry.Provider:
+		return false
+	case q.DealUUID != uuid.Nil && q.DealUUID != entry.DealUUID:
+		return false
+	case entry.Time.Before(q.Since):
+		return false
+	case q.FailedOnly && entry.Error == "":
+		return false
+	default:
+		return true
+	}
+}
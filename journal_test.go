@@ -0,0 +1,124 @@
+package jiffy
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/builtin/v9/market"
+	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDealJournal_Query(t *testing.T) {
+	ctx := context.Background()
+	j := &Jiffy{options: &options{dealJournalPath: filepath.Join(t.TempDir(), "journal", "deals.jsonl")}}
+	subject, err := newDealJournal(j)
+	require.NoError(t, err)
+
+	// Querying an empty journal must succeed.
+	got, err := subject.query(ctx, DealJournalQuery{})
+	require.NoError(t, err)
+	require.Empty(t, got)
+
+	now := time.Now()
+	piece1 := &Piece{Info: newFakeSegment(t, 2*KiB, now).Info}
+	piece2 := &Piece{Info: newFakeSegment(t, 4*KiB, now).Info}
+	sp1, err := address.NewIDAddress(1413)
+	require.NoError(t, err)
+	sp2, err := address.NewIDAddress(1414)
+	require.NoError(t, err)
+
+	accepted := newDealJournalEntry(piece1, sp1)
+	accepted.DealUUID = uuid.New()
+	accepted.Proposal = &market.ClientDealProposal{
+		Proposal: market.DealProposal{
+			PieceCID:             piece1.Info.PieceCID,
+			PieceSize:            piece1.Info.Size,
+			Provider:             sp1,
+			StoragePricePerEpoch: big.NewInt(42),
+			ProviderCollateral:   big.Zero(),
+			ClientCollateral:     big.Zero(),
+		},
+		ClientSignature: crypto.Signature{Type: crypto.SigTypeSecp256k1, Data: []byte("fish")},
+	}
+	accepted.OffloadType = "http"
+	accepted.OffloadURL = "http://localhost/piece/" + piece1.Info.PieceCID.String()
+	accepted.Accepted = true
+	subject.record(accepted, nil)
+
+	rejected := newDealJournalEntry(piece1, sp2)
+	rejected.Message = "not accepting deals"
+	subject.record(rejected, errors.New("deal was not accepted"))
+
+	failed := newDealJournalEntry(piece2, sp1)
+	subject.record(failed, errors.New("connection refused"))
+
+	// Reload to assert that entries are persisted.
+	subject, err = newDealJournal(j)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name  string
+		query DealJournalQuery
+		want  []*DealJournalEntry
+	}{
+		{
+			name: "all",
+			want: []*DealJournalEntry{accepted, rejected, failed},
+		},
+		{
+			name:  "by piece",
+			query: DealJournalQuery{PieceCID: piece1.Info.PieceCID},
+			want:  []*DealJournalEntry{accepted, rejected},
+		},
+		{
+			name:  "by provider",
+			query: DealJournalQuery{Provider: sp1},
+			want:  []*DealJournalEntry{accepted, failed},
+		},
+		{
+			name:  "by deal UUID",
+			query: DealJournalQuery{DealUUID: accepted.DealUUID},
+			want:  []*DealJournalEntry{accepted},
+		},
+		{
+			name:  "failed only",
+			query: DealJournalQuery{FailedOnly: true},
+			want:  []*DealJournalEntry{rejected, failed},
+		},
+		{
+			name:  "since",
+			query: DealJournalQuery{Since: now.Add(time.Hour)},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := subject.query(ctx, test.query)
+			require.NoError(t, err)
+			require.Len(t, got, len(test.want))
+			for i, want := range test.want {
+				require.True(t, want.Time.Equal(got[i].Time))
+				require.Equal(t, want.Piece, got[i].Piece)
+				require.Equal(t, want.Provider, got[i].Provider)
+				require.Equal(t, want.DealUUID, got[i].DealUUID)
+				require.Equal(t, want.OffloadURL, got[i].OffloadURL)
+				require.Equal(t, want.Accepted, got[i].Accepted)
+				require.Equal(t, want.Message, got[i].Message)
+				require.Equal(t, want.Error, got[i].Error)
+				if want.Proposal == nil {
+					require.Nil(t, got[i].Proposal)
+				} else {
+					require.Equal(t, want.Proposal.ClientSignature, got[i].Proposal.ClientSignature)
+					require.Equal(t, want.Proposal.Proposal.PieceCID, got[i].Proposal.Proposal.PieceCID)
+					require.True(t, want.Proposal.Proposal.StoragePricePerEpoch.Equals(got[i].Proposal.Proposal.StoragePricePerEpoch))
+				}
+			}
+		})
+	}
+}
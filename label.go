@@ -0,0 +1,181 @@
+package jiffy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/builtin/v9/market"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+var (
+	_ DealLabeler = PieceCIDDealLabel
+	_ DealLabeler = RootCIDDealLabel
+	_ DealLabeler = SegmentListCIDDealLabel
+)
+
+type (
+	// DealLabeler returns the label of deals made for the given piece. Labels are limited to
+	// market.DealMaxLabelSize bytes, and may be either a UTF-8 string or arbitrary bytes; see market.NewLabelFromString
+	// and market.NewLabelFromBytes.
+	DealLabeler func(ctx context.Context, piece *Piece) (market.DealLabel, error)
+
+	// DealLabelTemplateData is the data with which the template of TemplateDealLabeler is executed.
+	DealLabelTemplateData struct {
+		PieceCID cid.Cid
+		Size     abi.PaddedPieceSize
+		// Roots are the distinct root CIDs of the piece segments, in the order in which they appear in the piece.
+		Roots []cid.Cid
+		// SegmentListCID is the CID of the list of piece segments, as returned by SegmentListCID.
+		SegmentListCID cid.Cid
+		// Tenant is the affinity group of the piece segments. See SegmentWithAffinityGroup. If the piece contains
+		// segments of more than one group, e.g. when groups share pieces, Tenant is the first group in lexical order.
+		Tenant string
+		// Tenants are the distinct affinity groups of the piece segments, in lexical order.
+		Tenants []string
+		// Metadata is the metadata of Tenant, as passed to TemplateDealLabeler.
+		Metadata map[string]string
+	}
+)
+
+// SegmentWithRoot sets the root CID of the DAG that the segment data represents, e.g. the root of a UnixFS DAG or a
+// CAR file. The root is recorded in the piece catalog and can be used to label deals via RootCIDDealLabel.
+// Defaults to cid.Undef, i.e. unknown.
+func SegmentWithRoot(root cid.Cid) SegmentOption {
+	return func(o *segmentOptions) {
+		o.root = root
+	}
+}
+
+// PieceCIDDealLabel labels deals with the string form of the piece CID.
+func PieceCIDDealLabel(_ context.Context, piece *Piece) (market.DealLabel, error) {
+	return market.NewLabelFromString(piece.Info.PieceCID.String())
+}
+
+// RootCIDDealLabel labels deals with the string form of the root CID of the piece segments. See SegmentWithRoot.
+// If no segment has a root, or segments have more than one distinct root, deals are labelled with the piece CID.
+func RootCIDDealLabel(ctx context.Context, piece *Piece) (market.DealLabel, error) {
+	if roots := pieceRoots(piece); len(roots) == 1 {
+		return market.NewLabelFromString(roots[0].String())
+	}
+	return PieceCIDDealLabel(ctx, piece)
+}
+
+// SegmentListCIDDealLabel labels deals with the string form of the CID of the list of piece segments. See
+// SegmentListCID.
+func SegmentListCIDDealLabel(_ context.Context, piece *Piece) (market.DealLabel, error) {
+	listCid, err := SegmentListCID(piece)
+	if err != nil {
+		return market.EmptyDealLabel, err
+	}
+	return market.NewLabelFromString(listCid.String())
+}
+
+// BytesDealLabeler labels deals with the bytes returned by the given function. It returns an error wrapping
+// ErrDealLabelTooLong if the bytes exceed market.DealMaxLabelSize.
+func BytesDealLabeler(label func(ctx context.Context, piece *Piece) ([]byte, error)) DealLabeler {
+	return func(ctx context.Context, piece *Piece) (market.DealLabel, error) {
+		b, err := label(ctx, piece)
+		if err != nil {
+			return market.EmptyDealLabel, err
+		}
+		if len(b) > market.DealMaxLabelSize {
+			return market.EmptyDealLabel, fmt.Errorf("%w: %d bytes exceed the maximum of %d", ErrDealLabelTooLong, len(b), market.DealMaxLabelSize)
+		}
+		return market.NewLabelFromBytes(b)
+	}
+}
+
+// TemplateDealLabeler labels deals with the result of executing the given text/template with DealLabelTemplateData,
+// where tenantMetadata maps each affinity group to its metadata. Deals fail with an error wrapping ErrDealLabelTooLong
+// if the result exceeds market.DealMaxLabelSize bytes. For example:
+//
+//	{{.Tenant}}/{{index .Metadata "dataset"}}/{{.PieceCID}}
+func TemplateDealLabeler(text string, tenantMetadata map[string]map[string]string) (DealLabeler, error) {
+	tmpl, err := template.New("label").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse deal label template: %w", err)
+	}
+	return func(_ context.Context, piece *Piece) (market.DealLabel, error) {
+		listCid, err := SegmentListCID(piece)
+		if err != nil {
+			return market.EmptyDealLabel, err
+		}
+		data := DealLabelTemplateData{
+			PieceCID:       piece.Info.PieceCID,
+			Size:           piece.Info.Size,
+			Roots:          pieceRoots(piece),
+			SegmentListCID: listCid,
+			Tenants:        pieceTenants(piece),
+		}
+		if len(data.Tenants) > 0 {
+			data.Tenant = data.Tenants[0]
+		}
+		data.Metadata = tenantMetadata[data.Tenant]
+		var label strings.Builder
+		if err := tmpl.Execute(&label, data); err != nil {
+			return market.EmptyDealLabel, fmt.Errorf("failed to execute deal label template: %w", err)
+		}
+		if label.Len() > market.DealMaxLabelSize {
+			return market.EmptyDealLabel, fmt.Errorf("%w: %d bytes exceed the maximum of %d", ErrDealLabelTooLong, label.Len(), market.DealMaxLabelSize)
+		}
+		return market.NewLabelFromString(label.String())
+	}, nil
+}
+
+// SegmentListCID computes the sha2-256 DAG-CBOR CID of the list of the piece CIDs of the given piece segments, in the
+// order in which they appear in the piece, including the empty CAR header segment. The list can be reconstructed from
+// the piece catalog; see PieceManifest.
+func SegmentListCID(piece *Piece) (cid.Cid, error) {
+	var buf bytes.Buffer
+	cw := cbg.NewCborWriter(&buf)
+	if err := cw.WriteMajorTypeHeader(cbg.MajArray, uint64(len(piece.Segments))); err != nil {
+		return cid.Undef, err
+	}
+	for _, segment := range piece.Segments {
+		if err := cbg.WriteCid(cw, segment.Info.PieceCID); err != nil {
+			return cid.Undef, err
+		}
+	}
+	return cid.V1Builder{Codec: cid.DagCBOR, MhType: multihash.SHA2_256}.Sum(buf.Bytes())
+}
+
+// pieceRoots returns the distinct root CIDs of the segments in the given piece, in order of appearance.
+func pieceRoots(piece *Piece) []cid.Cid {
+	var roots []cid.Cid
+	seen := make(map[cid.Cid]struct{})
+	for _, segment := range piece.Segments {
+		if !segment.Root.Defined() {
+			continue
+		}
+		if _, ok := seen[segment.Root]; !ok {
+			seen[segment.Root] = struct{}{}
+			roots = append(roots, segment.Root)
+		}
+	}
+	return roots
+}
+
+// pieceTenants returns the distinct non-empty affinity groups of the segments in the given piece, in lexical order.
+func pieceTenants(piece *Piece) []string {
+	var tenants []string
+	seen := make(map[string]struct{})
+	for _, segment := range piece.Segments {
+		if segment.AffinityGroup == "" {
+			continue
+		}
+		if _, ok := seen[segment.AffinityGroup]; !ok {
+			seen[segment.AffinityGroup] = struct{}{}
+			tenants = append(tenants, segment.AffinityGroup)
+		}
+	}
+	sort.Strings(tenants)
+	return tenants
+}
@@ -0,0 +1,117 @@
+package jiffy
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/builtin/v9/market"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDealLabelers(t *testing.T) {
+	ctx := context.Background()
+	root1 := testRootCid(t, "fish")
+	root2 := testRootCid(t, "lobster")
+
+	newPiece := func(t *testing.T, roots []cid.Cid, groups []string) *Piece {
+		now := time.Now()
+		var segments []*Segment
+		for i := range roots {
+			segment := newFakeSegment(t, 2*KiB, now)
+			segment.Root = roots[i]
+			segment.AffinityGroup = groups[i]
+			segments = append(segments, segment)
+		}
+		pieces, _, err := NewBestFitPacker().Pack(segments, 64*KiB, 1)
+		require.NoError(t, err)
+		return pieces[0]
+	}
+	singleRoot := newPiece(t, []cid.Cid{root1, cid.Undef}, []string{"tenant-b", "tenant-a"})
+	multiRoot := newPiece(t, []cid.Cid{root1, root2}, []string{"", ""})
+	singleRootList, err := SegmentListCID(singleRoot)
+	require.NoError(t, err)
+
+	template, err := TemplateDealLabeler(`{{.Tenant}}/{{index .Metadata "dataset"}}/{{range .Roots}}{{.}}{{end}}/{{.SegmentListCID}}`,
+		map[string]map[string]string{"tenant-a": {"dataset": "fish-pics"}})
+	require.NoError(t, err)
+	tooLong, err := TemplateDealLabeler(strings.Repeat("x", market.DealMaxLabelSize+1), nil)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		labeler   DealLabeler
+		piece     *Piece
+		wantStr   string
+		wantBytes []byte
+		wantErr   error
+	}{
+		{name: "piece CID", labeler: PieceCIDDealLabel, piece: singleRoot, wantStr: singleRoot.Info.PieceCID.String()},
+		{name: "single root", labeler: RootCIDDealLabel, piece: singleRoot, wantStr: root1.String()},
+		{name: "multiple roots", labeler: RootCIDDealLabel, piece: multiRoot, wantStr: multiRoot.Info.PieceCID.String()},
+		{name: "segment list CID", labeler: SegmentListCIDDealLabel, piece: singleRoot, wantStr: singleRootList.String()},
+		{name: "template", labeler: template, piece: singleRoot, wantStr: "tenant-a/fish-pics/" + root1.String() + "/" + singleRootList.String()},
+		{name: "template too long", labeler: tooLong, piece: singleRoot, wantErr: ErrDealLabelTooLong},
+		{
+			name:      "bytes",
+			labeler:   BytesDealLabeler(func(context.Context, *Piece) ([]byte, error) { return root1.Bytes(), nil }),
+			piece:     singleRoot,
+			wantBytes: root1.Bytes(),
+		},
+		{
+			name:    "bytes too long",
+			labeler: BytesDealLabeler(func(context.Context, *Piece) ([]byte, error) { return make([]byte, market.DealMaxLabelSize+1), nil }),
+			piece:   singleRoot,
+			wantErr: ErrDealLabelTooLong,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.labeler(ctx, test.piece)
+			if test.wantErr != nil {
+				require.ErrorIs(t, err, test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			if test.wantBytes != nil {
+				require.True(t, got.IsBytes())
+				gotBytes, err := got.ToBytes()
+				require.NoError(t, err)
+				require.Equal(t, test.wantBytes, gotBytes)
+			} else {
+				require.True(t, got.IsString())
+				gotStr, err := got.ToString()
+				require.NoError(t, err)
+				require.Equal(t, test.wantStr, gotStr)
+			}
+		})
+	}
+}
+
+func TestSegmentListCID_IsDeterministic(t *testing.T) {
+	now := time.Now()
+	segments := []*Segment{newFakeSegment(t, 2*KiB, now), newFakeSegment(t, 4*KiB, now)}
+	pieces, _, err := NewBestFitPacker().Pack(segments, 64*KiB, 1)
+	require.NoError(t, err)
+	got, err := SegmentListCID(pieces[0])
+	require.NoError(t, err)
+	require.Equal(t, uint64(cid.DagCBOR), got.Prefix().Codec)
+
+	// A piece reconstructed from its manifest must have the same segment list CID.
+	manifest := PieceManifest{Info: pieces[0].Info}
+	for _, s := range pieces[0].Segments {
+		manifest.Segments = append(manifest.Segments, PieceManifestSegment{Info: s.Info})
+	}
+	reconstructed, err := SegmentListCID(manifest.Piece())
+	require.NoError(t, err)
+	require.Equal(t, got, reconstructed)
+}
+
+func testRootCid(t *testing.T, data string) cid.Cid {
+	c, err := cid.V1Builder{Codec: cid.Raw, MhType: multihash.SHA2_256}.Sum([]byte(data))
+	require.NoError(t, err)
+	return c
+}
@@ -0,0 +1,125 @@
+package jiffy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+type (
+	// chainMessage is a Filecoin chain message, encoded in the same way as Lotus encodes it both in CBOR and JSON.
+	chainMessage struct {
+		Version    uint64          `json:"Version"`
+		To         address.Address `json:"To"`
+		From       address.Address `json:"From"`
+		Nonce      uint64          `json:"Nonce"`
+		Value      abi.TokenAmount `json:"Value"`
+		GasLimit   int64           `json:"GasLimit"`
+		GasFeeCap  abi.TokenAmount `json:"GasFeeCap"`
+		GasPremium abi.TokenAmount `json:"GasPremium"`
+		Method     abi.MethodNum   `json:"Method"`
+		Params     []byte          `json:"Params"`
+	}
+	signedChainMessage struct {
+		Message   chainMessage     `json:"Message"`
+		Signature crypto.Signature `json:"Signature"`
+	}
+)
+
+func (m *chainMessage) MarshalCBOR(w io.Writer) error {
+	cw := cbg.NewCborWriter(w)
+	// Messages are encoded as a tuple of 10 fields.
+	if _, err := cw.Write([]byte{0x8a}); err != nil {
+		return err
+	}
+	if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, m.Version); err != nil {
+		return err
+	}
+	if err := m.To.MarshalCBOR(cw); err != nil {
+		return err
+	}
+	if err := m.From.MarshalCBOR(cw); err != nil {
+		return err
+	}
+	if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, m.Nonce); err != nil {
+		return err
+	}
+	if err := m.Value.MarshalCBOR(cw); err != nil {
+		return err
+	}
+	if err := writeCborInt64(cw, m.GasLimit); err != nil {
+		return err
+	}
+	if err := m.GasFeeCap.MarshalCBOR(cw); err != nil {
+		return err
+	}
+	if err := m.GasPremium.MarshalCBOR(cw); err != nil {
+		return err
+	}
+	if err := cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(m.Method)); err != nil {
+		return err
+	}
+	if len(m.Params) > cbg.ByteArrayMaxLen {
+		return fmt.Errorf("message params too long: %d", len(m.Params))
+	}
+	if err := cw.WriteMajorTypeHeader(cbg.MajByteString, uint64(len(m.Params))); err != nil {
+		return err
+	}
+	_, err := cw.Write(m.Params)
+	return err
+}
+
+// cid computes the CID of message, the bytes of which are signed by the sender.
+func (m *chainMessage) cid() (cid.Cid, error) {
+	var buf bytes.Buffer
+	if err := m.MarshalCBOR(&buf); err != nil {
+		return cid.Undef, err
+	}
+	return cid.Prefix{
+		Version:  1,
+		Codec:    cid.DagCBOR,
+		MhType:   multihash.BLAKE2B_MIN + 31,
+		MhLength: -1,
+	}.Sum(buf.Bytes())
+}
+
+// pushMessage sets the nonce of, estimates gas for, signs and pushes the given message, returning its CID. Messages
+// from the same sender are pushed one at a time, since the nonce is that of the next message in the message pool.
+func pushMessage(ctx context.Context, chain *chainClient, wallet Wallet, msg *chainMessage) (cid.Cid, error) {
+	unlock := chain.lockSender(msg.From)
+	defer unlock()
+	var err error
+	if msg.Nonce, err = chain.MpoolGetNonce(ctx, msg.From); err != nil {
+		return cid.Undef, err
+	}
+	if msg, err = chain.GasEstimateMessageGas(ctx, msg); err != nil {
+		return cid.Undef, err
+	}
+	msgCid, err := msg.cid()
+	if err != nil {
+		return cid.Undef, err
+	}
+	signature, err := wallet.Sign(ctx, msgCid.Bytes())
+	if err != nil {
+		return cid.Undef, err
+	}
+	return chain.MpoolPush(ctx, &signedChainMessage{
+		Message:   *msg,
+		Signature: *signature,
+	})
+}
+
+func writeCborInt64(cw *cbg.CborWriter, v int64) error {
+	if v >= 0 {
+		return cw.WriteMajorTypeHeader(cbg.MajUnsignedInt, uint64(v))
+	}
+	return cw.WriteMajorTypeHeader(cbg.MajNegativeInt, uint64(-v-1))
+}
@@ -0,0 +1,102 @@
+package jiffy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChainMessage_Cid(t *testing.T) {
+	to, err := address.NewIDAddress(7)
+	require.NoError(t, err)
+	from, err := address.NewIDAddress(1234)
+	require.NoError(t, err)
+	subject := chainMessage{
+		To:         to,
+		From:       from,
+		Nonce:      42,
+		Value:      big.NewInt(5),
+		GasLimit:   1000000,
+		GasFeeCap:  big.NewInt(100),
+		GasPremium: big.NewInt(7),
+		Method:     3,
+		Params:     []byte{1, 2, 3},
+	}
+	got, err := subject.cid()
+	require.NoError(t, err)
+	// Expected CID is computed by Lotus for the same message.
+	require.Equal(t, "bafy2bzacedlkdov3uglargwc3kl4zzr75lku3mg7kypov2tisphzj4zv7fces", got.String())
+}
+
+func TestPushMessage_AssignsDistinctNoncesPerSender(t *testing.T) {
+	ctx := context.Background()
+	from, err := address.NewIDAddress(1234)
+	require.NoError(t, err)
+	to, err := address.NewIDAddress(7)
+	require.NoError(t, err)
+
+	// The fake message pool counts pushed messages towards the next nonce, like Lotus does with pending messages.
+	var mutex sync.Mutex
+	var pushed []uint64
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var result any
+		switch req.Method {
+		case methodFilMpoolGetNonce:
+			mutex.Lock()
+			result = len(pushed)
+			mutex.Unlock()
+		case methodFilGasEstimateMessageGas:
+			var params []json.RawMessage
+			_ = json.Unmarshal(req.Params, &params)
+			result = params[0]
+		case methodFilMpoolPush:
+			// A single struct parameter is sent as is, rather than in an array.
+			var msg signedChainMessage
+			_ = json.Unmarshal(req.Params, &msg)
+			mutex.Lock()
+			pushed = append(pushed, msg.Message.Nonce)
+			mutex.Unlock()
+			result = map[string]string{"/": testRootCid(t, "fish").String()}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"jsonrpc": "2.0",
+			"id":      0,
+			"result":  result,
+		})
+	}))
+	defer api.Close()
+	chain := newChainClient(api.URL)
+
+	const messages = 10
+	errs := make(chan error, messages)
+	for i := 0; i < messages; i++ {
+		go func() {
+			_, err := pushMessage(ctx, chain, fakeWallet{}, &chainMessage{To: to, From: from, Value: big.Zero(), GasFeeCap: big.Zero(), GasPremium: big.Zero()})
+			errs <- err
+		}()
+	}
+	for i := 0; i < messages; i++ {
+		require.NoError(t, <-errs)
+	}
+	sort.Slice(pushed, func(i, j int) bool { return pushed[i] < pushed[j] })
+	for i, nonce := range pushed {
+		require.Equal(t, uint64(i), nonce)
+	}
+	require.Len(t, pushed, messages)
+}
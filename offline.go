@@ -0,0 +1,228 @@
+package jiffy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/google/uuid"
+	"github.com/ipfs/go-cid"
+)
+
+const (
+	// OfflineDealManifestCSV is the name of the CSV manifest file written by ExportOfflineDeals.
+	OfflineDealManifestCSV = "manifest.csv"
+	// OfflineDealManifestJSON is the name of the JSON manifest file written by ExportOfflineDeals.
+	OfflineDealManifestJSON = "manifest.json"
+	// OfflinePieceFormatAggregate is the format of the piece files written by ExportOfflineDeals: the raw data of the
+	// FRC-0058 aggregate piece, i.e. its segments laid out at their offsets followed by the data segment index. It is
+	// not a CAR file, and is imported by the provider as piece data as is.
+	OfflinePieceFormatAggregate = "aggregate-piece-data"
+
+	// offlinePieceFileExt is the extension of the piece files written by ExportOfflineDeals. It is deliberately
+	// neutral, since the files are aggregate piece data rather than CAR files.
+	offlinePieceFileExt = ".dat"
+)
+
+var (
+	offlineDealCSVHeader = []string{"deal_uuid", "piece_cid", "piece_size", "path", "format", "sha256", "start_epoch"}
+)
+
+type (
+	// OfflineDealManifest lists the offline deals made with a storage provider that are yet to start, along with
+	// where the provider can find the data to import for each deal once exported.
+	OfflineDealManifest struct {
+		Provider   address.Address
+		CreateTime time.Time
+		Deals      []OfflineDeal
+	}
+	// OfflineDeal captures the information needed by a storage provider to import the data of an offline deal, e.g.
+	// via `boostd import-data <DealUUID> <Path>`.
+	OfflineDeal struct {
+		DealUUID  uuid.UUID
+		PieceCID  cid.Cid
+		PieceSize abi.PaddedPieceSize
+		// Path is the path of the materialised piece file, relative to the manifest, if exported.
+		Path string `json:",omitempty"`
+		// Format is the format of the materialised piece file, i.e. OfflinePieceFormatAggregate, if exported.
+		Format string `json:",omitempty"`
+		// SHA256 is the hex-encoded SHA-256 checksum of the materialised piece file, if exported.
+		SHA256 string `json:",omitempty"`
+		// StartEpoch is the epoch by which the data must be sealed by the provider.
+		StartEpoch abi.ChainEpoch
+	}
+
+	// offlineDealExporter materialises the pieces of offline deals for shipping to storage providers.
+	offlineDealExporter struct {
+		j *Jiffy
+	}
+)
+
+func newOfflineDealExporter(j *Jiffy) (*offlineDealExporter, error) {
+	return &offlineDealExporter{j: j}, nil
+}
+
+// manifest lists the offline deals with sp that are yet to start as of the current chain head, along with their
+// pieces.
+func (e *offlineDealExporter) manifest(ctx context.Context, sp address.Address) (*OfflineDealManifest, []*Piece, error) {
+	head, err := e.j.fil.ChainHead(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return e.offlineDeals(ctx, sp, head.Height)
+}
+
+// offlineDeals lists the offline deals with sp recorded in the piece catalog whose start epoch is after head, along
+// with their pieces.
+func (e *offlineDealExporter) offlineDeals(ctx context.Context, sp address.Address, head abi.ChainEpoch) (*OfflineDealManifest, []*Piece, error) {
+	manifests, err := e.j.catalog.ListPieceManifests(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	manifest := &OfflineDealManifest{
+		Provider:   sp,
+		CreateTime: time.Now(),
+	}
+	var pieces []*Piece
+	for _, pm := range manifests {
+		piece := pm.Piece()
+		for _, deal := range pm.Deals {
+			if !deal.Offline || deal.Provider != sp || deal.StartEpoch <= head {
+				continue
+			}
+			manifest.Deals = append(manifest.Deals, OfflineDeal{
+				DealUUID:   deal.DealUUID,
+				PieceCID:   pm.Info.PieceCID,
+				PieceSize:  pm.Info.Size,
+				StartEpoch: deal.StartEpoch,
+			})
+			pieces = append(pieces, piece)
+		}
+	}
+	return manifest, pieces, nil
+}
+
+// export materialises the pieces of offline deals with sp that are yet to start under the given directory.
+func (e *offlineDealExporter) export(ctx context.Context, sp address.Address, dir string) (*OfflineDealManifest, error) {
+	manifest, pieces, err := e.manifest(ctx, sp)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.write(ctx, manifest, pieces, dir); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// write materialises the given pieces of the manifest deals under the given directory, in the layout:
+//
+//	<dir>/<sp>/manifest.csv
+//	<dir>/<sp>/manifest.json
+//	<dir>/<sp>/<piece CID>.dat
+//
+// Piece files hold the aggregate piece data; see OfflinePieceFormatAggregate. Pieces are written once, even if more
+// than one deal is made for them.
+func (e *offlineDealExporter) write(ctx context.Context, manifest *OfflineDealManifest, pieces []*Piece, dir string) error {
+	sp := manifest.Provider
+	spDir := filepath.Join(dir, sp.String())
+	if err := os.MkdirAll(spDir, 0755); err != nil {
+		return err
+	}
+	checksums := make(map[cid.Cid]string)
+	for i := range manifest.Deals {
+		deal := &manifest.Deals[i]
+		deal.Path = deal.PieceCID.String() + offlinePieceFileExt
+		deal.Format = OfflinePieceFormatAggregate
+		checksum, written := checksums[deal.PieceCID]
+		if !written {
+			var err error
+			if checksum, err = e.materialise(ctx, pieces[i], filepath.Join(spDir, deal.Path)); err != nil {
+				return err
+			}
+			checksums[deal.PieceCID] = checksum
+			logger.Infow("exported piece for offline deal", "piece", deal.PieceCID, "sp", sp, "dir", spDir)
+		}
+		deal.SHA256 = checksum
+	}
+	if err := writeFileAtomically(filepath.Join(spDir, OfflineDealManifestCSV), manifest.WriteCSV); err != nil {
+		return err
+	}
+	return writeFileAtomically(filepath.Join(spDir, OfflineDealManifestJSON), manifest.WriteJSON)
+}
+
+// materialise writes the aggregate data of the given piece to path, and returns its hex-encoded SHA-256 checksum.
+func (e *offlineDealExporter) materialise(ctx context.Context, piece *Piece, path string) (string, error) {
+	var checksum string
+	err := writeFileAtomically(path, func(w io.Writer) error {
+		reader, err := newPieceReader(ctx, piece, e.j.retriever)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = reader.Close() }()
+		hash := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(w, hash), reader); err != nil {
+			return err
+		}
+		checksum = hex.EncodeToString(hash.Sum(nil))
+		return nil
+	})
+	return checksum, err
+}
+
+// WriteCSV writes the manifest as CSV, with a header row followed by a row per deal.
+func (m *OfflineDealManifest) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(offlineDealCSVHeader); err != nil {
+		return err
+	}
+	for _, deal := range m.Deals {
+		if err := cw.Write([]string{
+			deal.DealUUID.String(),
+			deal.PieceCID.String(),
+			strconv.FormatUint(uint64(deal.PieceSize), 10),
+			deal.Path,
+			deal.Format,
+			deal.SHA256,
+			strconv.FormatInt(int64(deal.StartEpoch), 10),
+		}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteJSON writes the manifest as indented JSON.
+func (m *OfflineDealManifest) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(m)
+}
+
+// writeFileAtomically writes a file at path with the content written by write, via a temporary file in the same
+// directory that is renamed to path on success.
+func writeFileAtomically(path string, write func(io.Writer) error) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "*.temp")
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,120 @@
+package jiffy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/builtin/v9/market"
+	"github.com/filecoin-shipyard/boostly"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOfflineDealExporter(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSegmentor(t)
+	s.j.pieceCatalogDir = t.TempDir()
+	s.j.segmentor = s
+	s.j.retriever = s
+	var err error
+	s.j.catalog, err = newLocalPieceCatalog(s.j)
+	require.NoError(t, err)
+	subject, err := newOfflineDealExporter(s.j)
+	require.NoError(t, err)
+
+	pieces, _, err := packBestFit([]*Segment{newTestSegment(t, s, 3*KiB), newTestSegment(t, s, 9*KiB)}, 64*KiB, 2)
+	require.NoError(t, err)
+	require.Len(t, pieces, 1)
+	piece := pieces[0]
+	sp1, err := address.NewIDAddress(1413)
+	require.NoError(t, err)
+	sp2, err := address.NewIDAddress(1414)
+	require.NoError(t, err)
+
+	recordDeal := func(sp address.Address, start abi.ChainEpoch, offline bool) uuid.UUID {
+		deal := &boostly.DealProposal{
+			DealUUID:  uuid.New(),
+			IsOffline: offline,
+			ClientDealProposal: market.ClientDealProposal{
+				Proposal: market.DealProposal{Provider: sp, StartEpoch: start, EndEpoch: start + 100},
+			},
+		}
+		require.NoError(t, s.j.catalog.recordDeal(piece, deal))
+		return deal.DealUUID
+	}
+	want1 := recordDeal(sp1, 100, true)
+	want2 := recordDeal(sp1, 200, true)
+	recordDeal(sp1, 10, true)   // Already started.
+	recordDeal(sp1, 100, false) // Online.
+	recordDeal(sp2, 100, true)  // Another provider.
+
+	manifest, manifestPieces, err := subject.offlineDeals(ctx, sp1, 50)
+	require.NoError(t, err)
+	require.Equal(t, sp1, manifest.Provider)
+	require.Len(t, manifest.Deals, 2)
+	require.Len(t, manifestPieces, 2)
+	require.Equal(t, want1, manifest.Deals[0].DealUUID)
+	require.Equal(t, want2, manifest.Deals[1].DealUUID)
+	for _, deal := range manifest.Deals {
+		require.Equal(t, piece.Info.PieceCID, deal.PieceCID)
+		require.Equal(t, piece.Info.Size, deal.PieceSize)
+		require.Empty(t, deal.Path)
+		require.Empty(t, deal.Format)
+	}
+
+	dir := t.TempDir()
+	require.NoError(t, subject.write(ctx, manifest, manifestPieces, dir))
+
+	// The exported piece must be the piece data, with matching checksum.
+	reader, err := newPieceReader(ctx, piece, s)
+	require.NoError(t, err)
+	wantData, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	wantChecksum := sha256.Sum256(wantData)
+	spDir := filepath.Join(dir, sp1.String())
+	gotData, err := os.ReadFile(filepath.Join(spDir, piece.Info.PieceCID.String()+".dat"))
+	require.NoError(t, err)
+	require.Equal(t, wantData, gotData)
+	for _, deal := range manifest.Deals {
+		require.Equal(t, piece.Info.PieceCID.String()+".dat", deal.Path)
+		require.Equal(t, OfflinePieceFormatAggregate, deal.Format)
+		require.Equal(t, hex.EncodeToString(wantChecksum[:]), deal.SHA256)
+	}
+
+	// Assert the manifests written alongside the piece.
+	csvFile, err := os.ReadFile(filepath.Join(spDir, OfflineDealManifestCSV))
+	require.NoError(t, err)
+	rows, err := csv.NewReader(bytes.NewReader(csvFile)).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, rows, 3)
+	require.Equal(t, offlineDealCSVHeader, rows[0])
+	// Offload URLs are only served to bearers of their token, so they have no place in the manifest.
+	require.NotContains(t, rows[0], "url")
+	require.Equal(t, []string{
+		want1.String(),
+		piece.Info.PieceCID.String(),
+		"65536",
+		manifest.Deals[0].Path,
+		OfflinePieceFormatAggregate,
+		manifest.Deals[0].SHA256,
+		"100",
+	}, rows[1])
+
+	jsonFile, err := os.ReadFile(filepath.Join(spDir, OfflineDealManifestJSON))
+	require.NoError(t, err)
+	var gotManifest OfflineDealManifest
+	require.NoError(t, json.Unmarshal(jsonFile, &gotManifest))
+	require.NotContains(t, string(jsonFile), "URL")
+	require.Equal(t, manifest.Deals, gotManifest.Deals)
+}
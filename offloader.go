@@ -1,37 +1,247 @@
 package jiffy
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/builtin"
+	"github.com/gbrlsnchs/jwt/v3"
+	"github.com/google/uuid"
+	"github.com/ipfs/go-cid"
+)
+
+const (
+	httpOffloadPiecePath = "piece"
+	// httpOffloadSecretSize is the size of the secret generated to sign offload tokens, if none is set.
+	httpOffloadSecretSize = 32
 )
 
 var (
-	_ Offloader = (*httpOffloader)(nil)
+	_ Offloader    = (*httpOffloader)(nil)
+	_ http.Handler = (*httpOffloader)(nil)
 )
 
 type (
 	Offloader interface {
-		Offload(*Piece) (*Offload, error)
+		// Offload makes the data of the given piece available to sp for the deal proposal with the given UUID.
+		Offload(piece *Piece, sp address.Address, dealUUID uuid.UUID) (*Offload, error)
 	}
 	Offload struct {
 		Type    string
 		URL     *url.URL
 		Headers map[string]string
 	}
+	// httpOffloader serves the data of pieces to storage providers over HTTP. Each offload gets an unguessable URL
+	// and a JWT bound to the deal proposal, which the provider must present as a bearer token.
 	httpOffloader struct {
-		j *Jiffy
+		j      *Jiffy
+		alg    *jwt.HMACSHA
+		server *http.Server
+
+		mutex sync.RWMutex
+		// offloaded maps the CID of offloaded pieces to the piece, so that pieces can be served before their deals
+		// are recorded in the piece catalog.
+		offloaded map[cid.Cid]offloadedPiece
+	}
+	offloadedPiece struct {
+		piece  *Piece
+		expiry time.Time
+	}
+	// offloadToken is the JWT payload that binds an offload to a deal proposal. The JWT ID is the last element of
+	// the offload URL path.
+	offloadToken struct {
+		jwt.Payload
+		DealUUID uuid.UUID `json:"deal"`
+		PieceCID string    `json:"piece"`
+		Provider string    `json:"sp"`
 	}
 )
 
 func newHttpOffloader(j *Jiffy) (*httpOffloader, error) {
-	return &httpOffloader{j: j}, nil
+	secret := j.httpOffloadSecret
+	if len(secret) == 0 {
+		var err error
+		if secret, err = loadOrGenerateSecret(j.httpOffloadSecretPath); err != nil {
+			return nil, fmt.Errorf("failed to load offload secret: %w", err)
+		}
+	}
+	return &httpOffloader{
+		j:         j,
+		alg:       jwt.NewHS256(secret),
+		offloaded: make(map[cid.Cid]offloadedPiece),
+	}, nil
 }
 
-func (h *httpOffloader) Offload(_ *Piece) (*Offload, error) {
-	// TODO implement
-	// TODO add auth : "golang.org/x/oauth2"
+// Offload returns the URL at which sp can download the data of the given piece, along with the authorization
+// header it must present. The token expires once the deal can no longer start, i.e. after the deal start delay.
+func (h *httpOffloader) Offload(piece *Piece, sp address.Address, dealUUID uuid.UUID) (*Offload, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	jti := hex.EncodeToString(id)
+	now := time.Now()
+	expiry := now.Add(time.Duration(h.j.dealStartDelay) * builtin.EpochDurationSeconds * time.Second)
+	token, err := jwt.Sign(&offloadToken{
+		Payload: jwt.Payload{
+			JWTID:          jti,
+			IssuedAt:       jwt.NumericDate(now),
+			ExpirationTime: jwt.NumericDate(expiry),
+		},
+		DealUUID: dealUUID,
+		PieceCID: piece.Info.PieceCID.String(),
+		Provider: sp.String(),
+	}, h.alg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign offload token: %w", err)
+	}
+
+	h.mutex.Lock()
+	for c, offloaded := range h.offloaded {
+		if now.After(offloaded.expiry) {
+			delete(h.offloaded, c)
+		}
+	}
+	if existing, ok := h.offloaded[piece.Info.PieceCID]; !ok || existing.expiry.Before(expiry) {
+		h.offloaded[piece.Info.PieceCID] = offloadedPiece{piece: piece, expiry: expiry}
+	}
+	h.mutex.Unlock()
+
 	return &Offload{
 		Type:    "http",
-		URL:     nil,
-		Headers: nil,
+		URL:     h.j.httpOffloadPublicURL.JoinPath(httpOffloadPiecePath, piece.Info.PieceCID.String(), jti),
+		Headers: map[string]string{"Authorization": "Bearer " + string(token)},
 	}, nil
 }
+
+// Start serves offloaded pieces if deals are made online. Offline deals and DDO leave providers to receive piece data
+// out of band, so no server is started for them.
+func (h *httpOffloader) Start(_ context.Context) error {
+	if !h.j.onlineDeals() {
+		return nil
+	}
+	listener, err := net.Listen("tcp", h.j.httpOffloadListenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for offload requests: %w", err)
+	}
+	h.server = &http.Server{Handler: h}
+	go func() {
+		if err := h.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Errorw("offload server stopped", "err", err)
+		}
+	}()
+	logger.Infow("serving offloaded pieces", "addr", listener.Addr(), "url", h.j.httpOffloadPublicURL)
+	return nil
+}
+
+// ServeHTTP serves the data of the piece at /piece/<piece CID>/<JWT ID> to bearers of the matching offload token.
+// Range requests are supported, so that storage providers can resume interrupted transfers.
+func (h *httpOffloader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	elements := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(elements) != 3 || elements[0] != httpOffloadPiecePath {
+		http.NotFound(w, r)
+		return
+	}
+	pieceCID, err := cid.Decode(elements[1])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	jti := elements[2]
+	bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	var token offloadToken
+	if _, err := jwt.Verify([]byte(bearer), h.alg, &token, jwt.ValidatePayload(&token.Payload,
+		jwt.ExpirationTimeValidator(time.Now()),
+		jwt.IDValidator(jti),
+	)); err != nil {
+		logger.Debugw("rejected offload request with invalid token", "piece", pieceCID, "remote", r.RemoteAddr, "err", err)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	if token.PieceCID != pieceCID.String() {
+		logger.Warnw("rejected offload request with token for another piece", "piece", pieceCID, "tokenPiece", token.PieceCID, "sp", token.Provider, "deal", token.DealUUID)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	piece, err := h.piece(r.Context(), pieceCID)
+	if err != nil {
+		logger.Errorw("failed to find offloaded piece", "piece", pieceCID, "sp", token.Provider, "deal", token.DealUUID, "err", err)
+		http.NotFound(w, r)
+		return
+	}
+	reader, err := newPieceReader(r.Context(), piece, h.j.retriever)
+	if err != nil {
+		logger.Errorw("failed to read offloaded piece", "piece", pieceCID, "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer func() { _ = reader.Close() }()
+	logger.Infow("serving offloaded piece", "piece", pieceCID, "sp", token.Provider, "deal", token.DealUUID, "range", r.Header.Get("Range"))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", time.Time{}, reader)
+}
+
+// piece returns the offloaded piece with the given CID, or its manifest in the piece catalog otherwise.
+func (h *httpOffloader) piece(ctx context.Context, pieceCID cid.Cid) (*Piece, error) {
+	h.mutex.RLock()
+	offloaded, ok := h.offloaded[pieceCID]
+	h.mutex.RUnlock()
+	if ok {
+		return offloaded.piece, nil
+	}
+	manifest, err := h.j.catalog.GetPieceManifest(ctx, pieceCID)
+	if err != nil {
+		return nil, err
+	}
+	return manifest.Piece(), nil
+}
+
+func (h *httpOffloader) Shutdown(ctx context.Context) error {
+	if h.server == nil {
+		return nil
+	}
+	return h.server.Shutdown(ctx)
+}
+
+// loadOrGenerateSecret reads the secret at path, or generates and writes one if absent, so that offload tokens
+// remain valid across restarts.
+func loadOrGenerateSecret(path string) ([]byte, error) {
+	secret, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		return secret, nil
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	}
+	secret = make([]byte, httpOffloadSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, secret, 0600); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
@@ -0,0 +1,152 @@
+package jiffy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHttpOffloader_ServesPieceWithToken(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSegmentor(t)
+	s.j.retriever = s
+	subject := newTestHttpOffloader(t, s.j, bytes.Repeat([]byte("fish"), 8))
+	server := httptest.NewServer(subject)
+	defer server.Close()
+
+	pieces, _, err := packBestFit([]*Segment{newTestSegment(t, s, 3*KiB), newTestSegment(t, s, 9*KiB)}, 64*KiB, 1)
+	require.NoError(t, err)
+	otherPieces, _, err := packBestFit([]*Segment{newTestSegment(t, s, 5*KiB)}, 64*KiB, 1)
+	require.NoError(t, err)
+	piece, other := pieces[0], otherPieces[0]
+	reader, err := newPieceReader(ctx, piece, s)
+	require.NoError(t, err)
+	wantData, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+
+	sp, err := address.NewIDAddress(1413)
+	require.NoError(t, err)
+	offload, err := subject.Offload(piece, sp, uuid.New())
+	require.NoError(t, err)
+	require.Equal(t, "http", offload.Type)
+	require.True(t, strings.HasPrefix(offload.URL.String(), "https://jiffy.example/offload/piece/"+piece.Info.PieceCID.String()+"/"))
+	otherOffload, err := subject.Offload(other, sp, uuid.New())
+	require.NoError(t, err)
+
+	// Tokens signed with another secret must be rejected.
+	stranger := newTestHttpOffloader(t, s.j, bytes.Repeat([]byte("lobster"), 8))
+	strangerOffload, err := stranger.Offload(piece, sp, uuid.New())
+	require.NoError(t, err)
+	// Tokens that expired must be rejected.
+	s.j.dealStartDelay = -1
+	expiredOffload, err := subject.Offload(piece, sp, uuid.New())
+	require.NoError(t, err)
+	s.j.dealStartDelay = 10
+
+	// The path under which pieces are served, i.e. without the public URL prefix.
+	pathOf := func(u *url.URL) string { return strings.TrimPrefix(u.Path, "/offload") }
+	tests := []struct {
+		name       string
+		path       string
+		headers    map[string]string
+		rangeHdr   string
+		wantStatus int
+		wantData   []byte
+	}{
+		{name: "valid", path: pathOf(offload.URL), headers: offload.Headers, wantStatus: http.StatusOK, wantData: wantData},
+		{name: "range", path: pathOf(offload.URL), headers: offload.Headers, rangeHdr: "bytes=100-199", wantStatus: http.StatusPartialContent, wantData: wantData[100:200]},
+		{name: "no token", path: pathOf(offload.URL), wantStatus: http.StatusUnauthorized},
+		{name: "token of other offload", path: pathOf(offload.URL), headers: otherOffload.Headers, wantStatus: http.StatusUnauthorized},
+		{name: "token of other piece", path: pathOf(otherOffload.URL), headers: offload.Headers, wantStatus: http.StatusUnauthorized},
+		{
+			name:       "piece other than token",
+			path:       strings.Replace(pathOf(offload.URL), piece.Info.PieceCID.String(), other.Info.PieceCID.String(), 1),
+			headers:    offload.Headers,
+			wantStatus: http.StatusForbidden,
+		},
+		{name: "token of other secret", path: pathOf(strangerOffload.URL), headers: strangerOffload.Headers, wantStatus: http.StatusUnauthorized},
+		{name: "expired token", path: pathOf(expiredOffload.URL), headers: expiredOffload.Headers, wantStatus: http.StatusUnauthorized},
+		{name: "unknown path", path: "/fish", headers: offload.Headers, wantStatus: http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, server.URL+test.path, nil)
+			require.NoError(t, err)
+			for k, v := range test.headers {
+				req.Header.Set(k, v)
+			}
+			if test.rangeHdr != "" {
+				req.Header.Set("Range", test.rangeHdr)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, test.wantStatus, resp.StatusCode)
+			if test.wantData != nil {
+				gotData, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				require.Equal(t, test.wantData, gotData)
+			}
+		})
+	}
+}
+
+func TestHttpOffloader_StartsOnlyForOnlineDeals(t *testing.T) {
+	tests := []struct {
+		name        string
+		offline     bool
+		ddo         bool
+		wantServing bool
+	}{
+		{name: "offline", offline: true},
+		{name: "ddo", ddo: true},
+		{name: "online", wantServing: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts, err := applyTestOptions(
+				WithOfflineDeals(test.offline),
+				WithDirectDataOnboarding(test.ddo),
+				WithHttpOffloadListenAddr("127.0.0.1:0"),
+			)
+			require.NoError(t, err)
+			subject := newTestHttpOffloader(t, &Jiffy{options: opts}, bytes.Repeat([]byte("fish"), 8))
+			require.NoError(t, subject.Start(context.Background()))
+			defer func() { require.NoError(t, subject.Shutdown(context.Background())) }()
+			require.Equal(t, test.wantServing, subject.server != nil)
+		})
+	}
+}
+
+func TestLoadOrGenerateSecret(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jiffy", "offload.key")
+	generated, err := loadOrGenerateSecret(path)
+	require.NoError(t, err)
+	require.Len(t, generated, httpOffloadSecretSize)
+	loaded, err := loadOrGenerateSecret(path)
+	require.NoError(t, err)
+	require.Equal(t, generated, loaded)
+}
+
+func newTestHttpOffloader(t *testing.T, j *Jiffy, secret []byte) *httpOffloader {
+	publicURL, err := url.Parse("https://jiffy.example/offload")
+	require.NoError(t, err)
+	j.httpOffloadSecret = secret
+	j.httpOffloadPublicURL = publicURL
+	j.dealStartDelay = abi.ChainEpoch(10)
+	subject, err := newHttpOffloader(j)
+	require.NoError(t, err)
+	return subject
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/url"
 	"os"
 	"path/filepath"
 	"time"
@@ -12,20 +13,37 @@ import (
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/big"
 	"github.com/filecoin-project/go-state-types/builtin"
+	"github.com/filecoin-shipyard/boostly"
 	"github.com/filecoin-shipyard/telefil"
 	"github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/multiformats/go-multiaddr"
 )
 
 type (
 	// Option represents a configurable parameter in Motion service.
 	Option  func(*options) error
 	options struct {
-		h      host.Host
-		fil    *telefil.Telefil
-		wallet Wallet
+		h           host.Host
+		fil         *telefil.Telefil
+		chain       *chainClient
+		filecoinAPI string
+		wallet      Wallet
 
 		replicatorSpPicker             func(context.Context, *Piece) ([]address.Address, error)
+		replicatorPacker               Packer
+		replicatorAffinityPools        map[string]string
+		replicatorVerifyPieces         bool
+		replicatorMinPieceFillRatio    float64
+		replicatorMinPieceBytes        uint64
+		replicatorMaxSegmentWait       time.Duration
+		replicatorPieceCapacity        abi.PaddedPieceSize
+		replicatorProviderPieceSizes   map[address.Address]abi.PaddedPieceSize
+		replicatorMaxConcurrentDeals   int
+		replicatorMaxProviderDeals     int
+		replicatorTargetReplicas       int
+		replicatorExtraReplicaPolicy   ExtraReplicaPolicy
 		replicatorInterval             *time.Ticker
 		replicatorVerificationInterval *time.Ticker
 
@@ -33,17 +51,45 @@ type (
 		segmentorChunkSizeBytes    int64
 		segmentorMaxTotalSizeBytes int64
 
+		pieceCatalogDir string
+		dealJournalPath string
+
+		httpOffloadListenAddr string
+		httpOffloadPublicURL  *url.URL
+		httpOffloadSecret     []byte
+		httpOffloadSecretPath string
+
 		dealProviderCollateralPicker func(min, max abi.TokenAmount) abi.TokenAmount
 		dealPricePerEpochPicker      func(pieceSize abi.PaddedPieceSize, start, end abi.ChainEpoch) abi.TokenAmount
 		dealVerified                 bool
 		dealSkipIPNIAnnounce         bool
 		dealRemoveUnsealedCopy       bool
 		dealOffline                  bool
+		dealDirectOnboarding         bool
 		dealPricePerGiBEpoch         abi.TokenAmount
 		dealPricePerGiB              abi.TokenAmount
 		dealPricePerDeal             abi.TokenAmount
+		dealAskPricePicker           func(ask *boostly.StorageAsk, pieceSize abi.PaddedPieceSize, start, end abi.ChainEpoch, verified bool) (abi.TokenAmount, error)
+		dealMaxPricePerGiBEpoch      abi.TokenAmount
+		dealClientCollateral         abi.TokenAmount
+		dealEscrowTopUpCap           abi.TokenAmount
+		dealDataCapShortfallPolicy   DataCapShortfallPolicy
+		dealDataCapAlert             func(ctx context.Context, client address.Address, err error)
+		dealRetryPolicies            map[DealFailureClass]DealRetryPolicy
+		dealLabeler                  DealLabeler
+		dealProtocols                []protocol.ID
+		dealDryRun                   DealDryRunMode
 		dealStartDelay               abi.ChainEpoch
 		dealDuration                 abi.ChainEpoch
+		dealProposalTimeout          time.Duration
+
+		budgetDaily   abi.TokenAmount
+		budgetTotal   abi.TokenAmount
+		budgetTenants map[string]abi.TokenAmount
+
+		providerAddrs   map[address.Address][]multiaddr.Multiaddr
+		providerInfoTTL time.Duration
+		providerAskTTL  time.Duration
 	}
 )
 
@@ -56,7 +102,20 @@ func newOptions(o ...Option) (*options, error) {
 		segmentorMaxTotalSizeBytes:   31 * GiB,
 		segmentorChunkSizeBytes:      1 * MiB,
 		dealVerified:                 true,
+		dealClientCollateral:         big.Zero(),
+		dealRetryPolicies:            defaultDealRetryPolicies(),
+		dealLabeler:                  PieceCIDDealLabel,
+		dealProtocols:                []protocol.ID{FilStorageMarketProtocol_1_2_1, boostly.FilStorageMarketProtocol_1_2_0},
+		dealProposalTimeout:          5 * time.Minute,
+		providerInfoTTL:              time.Hour,
+		providerAskTTL:               10 * time.Minute,
 
+		replicatorPacker:               NewBestFitPacker(),
+		replicatorPieceCapacity:        32 * GiB,
+		httpOffloadListenAddr:          "0.0.0.0:40080",
+		replicatorMaxConcurrentDeals:   8,
+		replicatorMaxProviderDeals:     1,
+		filecoinAPI:                    defaultFilecoinAPI,
 		replicatorInterval:             time.NewTicker(1 * time.Hour),
 		replicatorVerificationInterval: time.NewTicker(1 * time.Hour),
 	}
@@ -81,15 +140,41 @@ func newOptions(o ...Option) (*options, error) {
 		}
 		opts.segmentorStoreDir = filepath.Join(userHome, ".jiffy", "segments")
 	}
+	if opts.pieceCatalogDir == "" {
+		userHome, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		opts.pieceCatalogDir = filepath.Join(userHome, ".jiffy", "pieces")
+	}
+	if opts.dealJournalPath == "" {
+		userHome, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		opts.dealJournalPath = filepath.Join(userHome, ".jiffy", "journal", "deals.jsonl")
+	}
+	if len(opts.httpOffloadSecret) == 0 && opts.httpOffloadSecretPath == "" {
+		userHome, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		opts.httpOffloadSecretPath = filepath.Join(userHome, ".jiffy", "offload.key")
+	}
+	if opts.onlineDeals() && opts.httpOffloadPublicURL == nil {
+		return nil, errors.New("offload URL must be set for online deals")
+	}
 	if opts.replicatorSpPicker == nil {
 		return nil, fmt.Errorf("storage provider picker must be set or at least one storage provider must be configured")
 	}
 	if opts.fil == nil {
 		var err error
-		if opts.fil, err = telefil.New(); err != nil {
+		if opts.fil, err = telefil.New(telefil.WithFilecoinAPI(opts.filecoinAPI)); err != nil {
 			return nil, err
 		}
 	}
+	opts.chain = newChainClient(opts.filecoinAPI)
+	opts.replicatorPacker = newAffinityPacker(opts.replicatorPacker, opts.replicatorAffinityPools)
 	if opts.dealPricePerEpochPicker == nil {
 		opts.dealPricePerEpochPicker = func(pieceSize abi.PaddedPieceSize, start, end abi.ChainEpoch) abi.TokenAmount {
 			// TODO  maybe pass the draft deal proposal for a more sophisticated price picking e.g. per Provider?
@@ -101,7 +186,538 @@ func newOptions(o ...Option) (*options, error) {
 			return big.Max(big.Max(perGiB, perGiBEpoch), opts.dealPricePerDeal)
 		}
 	}
+	if opts.dealAskPricePicker == nil {
+		opts.dealAskPricePicker = func(ask *boostly.StorageAsk, pieceSize abi.PaddedPieceSize, start, end abi.ChainEpoch, verified bool) (abi.TokenAmount, error) {
+			// Meet the ask price if the picked price falls short of it; maximum price is enforced by the dealer.
+			askPrice := ask.Price
+			if verified {
+				askPrice = ask.VerifiedPrice
+			}
+			return big.Max(opts.dealPricePerEpochPicker(pieceSize, start, end), askPricePerEpoch(askPrice, pieceSize)), nil
+		}
+	}
 	return &opts, nil
 }
 
-// TODO add With* option setting
+// onlineDeals returns whether storage providers download piece data from the HTTP offload server.
+func (o *options) onlineDeals() bool {
+	return !o.dealOffline && !o.dealDirectOnboarding
+}
+
+// TODO add With* option setting for the remaining options
+
+// WithPacker sets the Packer used to bin-pack under-replicated segments into pieces prior to dealing.
+// Defaults to NewBestFitPacker.
+func WithPacker(p Packer) Option {
+	return func(o *options) error {
+		if p == nil {
+			return errors.New("packer must not be nil")
+		}
+		o.replicatorPacker = p
+		return nil
+	}
+}
+
+// WithSharedAffinityGroups allows segments of the given affinity groups to be packed into the same pieces.
+// By default, segments are only packed together with segments of the same affinity group.
+// Groups passed across multiple calls that overlap are merged into one shared set.
+//
+// See: SegmentWithAffinityGroup.
+func WithSharedAffinityGroups(groups ...string) Option {
+	return func(o *options) error {
+		if len(groups) < 2 {
+			return errors.New("at least two affinity groups must be specified to share pieces")
+		}
+		if o.replicatorAffinityPools == nil {
+			o.replicatorAffinityPools = make(map[string]string)
+		}
+		pool := groups[0]
+		if existing, ok := o.replicatorAffinityPools[pool]; ok {
+			pool = existing
+		}
+		merged := make(map[string]struct{})
+		for _, group := range groups {
+			if existing, ok := o.replicatorAffinityPools[group]; ok {
+				merged[existing] = struct{}{}
+			}
+		}
+		for group, existing := range o.replicatorAffinityPools {
+			if _, ok := merged[existing]; ok {
+				o.replicatorAffinityPools[group] = pool
+			}
+		}
+		for _, group := range groups {
+			o.replicatorAffinityPools[group] = pool
+		}
+		return nil
+	}
+}
+
+// WithPreDealVerification sets whether to verify that the aggregate data of each piece hashes to its piece CID
+// before it is dealt. Verification streams the entire piece, and blocks the deal upon mismatch.
+// Defaults to false.
+func WithPreDealVerification(enabled bool) Option {
+	return func(o *options) error {
+		o.replicatorVerifyPieces = enabled
+		return nil
+	}
+}
+
+// WithOfflineDeals sets whether storage market deals are made offline, in which case storage providers import the
+// piece data out of band, e.g. as exported by Jiffy.ExportOfflineDeals. Otherwise, providers download the piece data
+// from the HTTP offload server, which then requires WithHttpOffloadPublicURL.
+// Defaults to true.
+func WithOfflineDeals(enabled bool) Option {
+	return func(o *options) error {
+		o.dealOffline = enabled
+		return nil
+	}
+}
+
+// WithDirectDataOnboarding sets whether to onboard pieces via verified registry allocations, i.e. Direct Data
+// Onboarding (DDO), instead of making storage market deals through Boost. DDO requires the wallet to hold sufficient
+// DataCap, and storage providers to receive piece data out of band.
+// Defaults to false.
+func WithDirectDataOnboarding(enabled bool) Option {
+	return func(o *options) error {
+		o.dealDirectOnboarding = enabled
+		return nil
+	}
+}
+
+// WithDealAskPricePicker sets the function that picks the price per epoch of deals given the storage ask of the
+// storage provider, and whether the deal is verified. Returning an error skips dealing with the provider.
+// Defaults to the greater of the configured deal price and the ask price of the provider, where the verified price
+// of the ask is used for verified deals.
+func WithDealAskPricePicker(picker func(ask *boostly.StorageAsk, pieceSize abi.PaddedPieceSize, start, end abi.ChainEpoch, verified bool) (abi.TokenAmount, error)) Option {
+	return func(o *options) error {
+		if picker == nil {
+			return errors.New("ask price picker must not be nil")
+		}
+		o.dealAskPricePicker = picker
+		return nil
+	}
+}
+
+// WithDealMaxPricePerGiBEpoch sets the maximum price per GiB per epoch of deals. Storage providers that ask for more,
+// or deals priced at more, are skipped.
+// Defaults to no maximum.
+func WithDealMaxPricePerGiBEpoch(price abi.TokenAmount) Option {
+	return func(o *options) error {
+		if price.Int == nil || price.LessThan(big.Zero()) {
+			return errors.New("maximum price must be a non-negative amount")
+		}
+		o.dealMaxPricePerGiBEpoch = price
+		return nil
+	}
+}
+
+// WithDealClientCollateral sets the client collateral of deals, which is locked in the client's market escrow for
+// the duration of each deal.
+// Defaults to zero.
+func WithDealClientCollateral(collateral abi.TokenAmount) Option {
+	return func(o *options) error {
+		if collateral.Int == nil || collateral.LessThan(big.Zero()) {
+			return errors.New("client collateral must be a non-negative amount")
+		}
+		o.dealClientCollateral = collateral
+		return nil
+	}
+}
+
+// WithEscrowTopUp enables automatic top-up of the client's storage market escrow when it falls short of the funds
+// needed by deal proposals. Top-ups are made by pushing AddBalance messages signed by the wallet, and never bring the
+// escrow above the given cap.
+// Defaults to disabled, in which case deals that the escrow cannot cover are not proposed.
+func WithEscrowTopUp(cap abi.TokenAmount) Option {
+	return func(o *options) error {
+		if cap.Int == nil || cap.LessThan(big.Zero()) {
+			return errors.New("escrow top-up cap must be a non-negative amount")
+		}
+		o.dealEscrowTopUpCap = cap
+		return nil
+	}
+}
+
+// WithDataCapShortfallPolicy sets how verified deals are handled when the remaining DataCap of the client, minus the
+// DataCap needed by pending proposals, falls short.
+// Defaults to DataCapPause.
+func WithDataCapShortfallPolicy(policy DataCapShortfallPolicy) Option {
+	return func(o *options) error {
+		switch policy {
+		case DataCapPause, DataCapFallbackToUnverified, DataCapAlert:
+			o.dealDataCapShortfallPolicy = policy
+			return nil
+		default:
+			return fmt.Errorf("unknown DataCap shortfall policy: %d", policy)
+		}
+	}
+}
+
+// WithDataCapAlert sets the DataCap shortfall policy to DataCapAlert, and the function that is called with the
+// shortfall error when DataCap falls short.
+func WithDataCapAlert(alert func(ctx context.Context, client address.Address, err error)) Option {
+	return func(o *options) error {
+		if alert == nil {
+			return errors.New("DataCap alert function must not be nil")
+		}
+		o.dealDataCapShortfallPolicy = DataCapAlert
+		o.dealDataCapAlert = alert
+		return nil
+	}
+}
+
+// WithDealRetryPolicy sets how deals that fail with the given class are retried, and when the provider is cooled
+// down after repeated failures.
+// Defaults to three attempts with backoff from 10 seconds for transient failures, a 6 hour cooldown after three
+// consecutive rejections, a 24 hour cooldown for providers that do not support the deal protocol, and no retry for
+// other classes.
+func WithDealRetryPolicy(class DealFailureClass, policy DealRetryPolicy) Option {
+	return func(o *options) error {
+		if _, known := dealFailureClassNames[class]; !known {
+			return fmt.Errorf("unknown deal failure class: %d", class)
+		}
+		if policy.Backoff < 0 || policy.MaxBackoff < 0 || policy.Cooldown < 0 {
+			return errors.New("deal retry policy durations must not be negative")
+		}
+		if o.dealRetryPolicies == nil {
+			o.dealRetryPolicies = defaultDealRetryPolicies()
+		}
+		o.dealRetryPolicies[class] = policy
+		return nil
+	}
+}
+
+// WithDealLabeler sets the function that labels the deals made for each piece. Built-in labelers include
+// PieceCIDDealLabel, RootCIDDealLabel, SegmentListCIDDealLabel, TemplateDealLabeler and BytesDealLabeler.
+// Defaults to PieceCIDDealLabel.
+func WithDealLabeler(labeler DealLabeler) Option {
+	return func(o *options) error {
+		if labeler == nil {
+			return errors.New("deal labeler must not be nil")
+		}
+		o.dealLabeler = labeler
+		return nil
+	}
+}
+
+// WithDealProtocols sets the storage market deal protocols over which deals are made, in order of preference. Deals
+// are made over the most preferred protocol supported by each provider.
+// Defaults to FilStorageMarketProtocol_1_2_1 followed by boostly.FilStorageMarketProtocol_1_2_0, i.e. the highest
+// version supported by each provider.
+func WithDealProtocols(protocols ...protocol.ID) Option {
+	return func(o *options) error {
+		if len(protocols) == 0 {
+			return errors.New("at least one deal protocol must be specified")
+		}
+		for _, p := range protocols {
+			if _, supported := dealProtocols[p]; !supported {
+				return fmt.Errorf("unsupported deal protocol: %s", p)
+			}
+		}
+		o.dealProtocols = protocols
+		return nil
+	}
+}
+
+// WithDealDryRun sets whether deals are only rehearsed: proposals are built, signed and recorded in the deal journal,
+// but are not proposed to storage providers, nor are any funds committed. See DealDryRunMode.
+// Defaults to DealDryRunDisabled.
+func WithDealDryRun(mode DealDryRunMode) Option {
+	return func(o *options) error {
+		switch mode {
+		case DealDryRunDisabled, DealDryRunOffline, DealDryRunCapabilityChecks:
+			o.dealDryRun = mode
+			return nil
+		default:
+			return fmt.Errorf("unknown deal dry run mode: %d", mode)
+		}
+	}
+}
+
+// WithDailyBudget sets the maximum total storage price of deal proposals accepted per UTC day. Proposals that would
+// exceed it are refused, and deferred to replication cycles on subsequent days.
+// Defaults to no limit.
+func WithDailyBudget(amount abi.TokenAmount) Option {
+	return func(o *options) error {
+		if amount.Int == nil || amount.LessThan(big.Zero()) {
+			return errors.New("daily budget must be a non-negative amount")
+		}
+		o.budgetDaily = amount
+		return nil
+	}
+}
+
+// WithTotalBudget sets the maximum total storage price of all deal proposals ever accepted, as recorded in the deal
+// journal. Proposals that would exceed it are refused.
+// Defaults to no limit.
+func WithTotalBudget(amount abi.TokenAmount) Option {
+	return func(o *options) error {
+		if amount.Int == nil || amount.LessThan(big.Zero()) {
+			return errors.New("total budget must be a non-negative amount")
+		}
+		o.budgetTotal = amount
+		return nil
+	}
+}
+
+// WithTenantBudget sets the maximum total storage price of deal proposals charged to the given tenant, i.e. to the
+// segments of the given affinity group. The price of each proposal is shared across the tenants of its piece in
+// proportion to the size of their segments. See SegmentWithAffinityGroup.
+// Defaults to no limit.
+func WithTenantBudget(tenant string, amount abi.TokenAmount) Option {
+	return func(o *options) error {
+		if tenant == "" {
+			return errors.New("tenant must not be empty")
+		}
+		if amount.Int == nil || amount.LessThan(big.Zero()) {
+			return fmt.Errorf("budget of tenant %q must be a non-negative amount", tenant)
+		}
+		if o.budgetTenants == nil {
+			o.budgetTenants = make(map[string]abi.TokenAmount)
+		}
+		o.budgetTenants[tenant] = amount
+		return nil
+	}
+}
+
+// WithProviderAddrs overrides the libp2p addresses of the given storage provider advertised on chain, e.g. when they
+// are stale. The peer ID of the provider is still looked up on chain.
+func WithProviderAddrs(sp address.Address, addrs ...multiaddr.Multiaddr) Option {
+	return func(o *options) error {
+		if len(addrs) == 0 {
+			return fmt.Errorf("at least one address must be specified for provider %s", sp)
+		}
+		if o.providerAddrs == nil {
+			o.providerAddrs = make(map[address.Address][]multiaddr.Multiaddr)
+		}
+		o.providerAddrs[sp] = addrs
+		return nil
+	}
+}
+
+// WithProviderInfoTTL sets how long the on-chain information, addresses and retrieval transports of storage
+// providers are cached before they are refreshed.
+// Defaults to 1 hour.
+func WithProviderInfoTTL(ttl time.Duration) Option {
+	return func(o *options) error {
+		if ttl <= 0 {
+			return errors.New("provider info TTL must be larger than zero")
+		}
+		o.providerInfoTTL = ttl
+		return nil
+	}
+}
+
+// WithProviderAskTTL sets how long the storage asks of storage providers are cached before they are queried again.
+// Defaults to 10 minutes.
+func WithProviderAskTTL(ttl time.Duration) Option {
+	return func(o *options) error {
+		if ttl <= 0 {
+			return errors.New("provider ask TTL must be larger than zero")
+		}
+		o.providerAskTTL = ttl
+		return nil
+	}
+}
+
+// WithMinPieceFillRatio sets the minimum ratio of piece capacity that must be occupied by segments before the piece
+// is dealt. Pieces below the ratio are held back until more segments are added, or until the oldest segment in them
+// has waited longer than WithMaxSegmentWait. The capacity is the one set by WithPieceCapacity.
+// Defaults to zero, i.e. pieces are dealt regardless of their fill ratio.
+func WithMinPieceFillRatio(ratio float64) Option {
+	return func(o *options) error {
+		if ratio < 0 || ratio > 1 {
+			return fmt.Errorf("minimum piece fill ratio must be between 0 and 1, got: %f", ratio)
+		}
+		o.replicatorMinPieceFillRatio = ratio
+		return nil
+	}
+}
+
+// WithMinPieceBytes sets the minimum number of segment bytes a piece must hold before it is dealt. Pieces below
+// the threshold are held back until more segments are added, or until the oldest segment in them has waited longer
+// than WithMaxSegmentWait.
+// Defaults to zero, i.e. pieces are dealt regardless of the number of bytes they hold.
+func WithMinPieceBytes(bytes uint64) Option {
+	return func(o *options) error {
+		o.replicatorMinPieceBytes = bytes
+		return nil
+	}
+}
+
+// WithMaxSegmentWait sets the maximum time the oldest segment in a piece waits before the piece is dealt,
+// regardless of WithMinPieceFillRatio and WithMinPieceBytes thresholds.
+// Defaults to zero, i.e. pieces are held back for as long as they do not meet the thresholds.
+func WithMaxSegmentWait(wait time.Duration) Option {
+	return func(o *options) error {
+		if wait < 0 {
+			return fmt.Errorf("maximum segment wait must not be negative, got: %s", wait)
+		}
+		o.replicatorMaxSegmentWait = wait
+		return nil
+	}
+}
+
+// WithFilecoinAPI sets the Filecoin API endpoint used to query the chain state.
+// Defaults to https://api.node.glif.io
+func WithFilecoinAPI(url string) Option {
+	return func(o *options) error {
+		o.filecoinAPI = url
+		return nil
+	}
+}
+
+// WithPieceCapacity sets the capacity of candidate pieces into which under-replicated segments are packed, and
+// against which storage providers are picked and WithMinPieceFillRatio is checked. Pieces are then re-packed
+// against the maximum piece size of each provider: into smaller ones for providers with smaller sector size or with
+// a lower maximum piece size set via WithProviderMaxPieceSize, and into a larger one filled with the segments left
+// unpacked for providers with larger sector size.
+// Defaults to 32 GiB.
+func WithPieceCapacity(capacity abi.PaddedPieceSize) Option {
+	return func(o *options) error {
+		if err := capacity.Validate(); err != nil {
+			return err
+		}
+		o.replicatorPieceCapacity = capacity
+		return nil
+	}
+}
+
+// WithProviderMaxPieceSize sets the maximum size of pieces dealt to the given storage provider.
+// This allows dealing sub-sector pieces to providers that accept them. Otherwise, the maximum piece size of a
+// provider is its sector size.
+func WithProviderMaxPieceSize(sp address.Address, size abi.PaddedPieceSize) Option {
+	return func(o *options) error {
+		if err := size.Validate(); err != nil {
+			return err
+		}
+		if o.replicatorProviderPieceSizes == nil {
+			o.replicatorProviderPieceSizes = make(map[address.Address]abi.PaddedPieceSize)
+		}
+		o.replicatorProviderPieceSizes[sp] = size
+		return nil
+	}
+}
+
+// WithMaxConcurrentDeals sets the maximum number of storage providers dealt with concurrently across all pieces
+// within a replication cycle.
+// Defaults to 8.
+func WithMaxConcurrentDeals(n int) Option {
+	return func(o *options) error {
+		if n < 1 {
+			return fmt.Errorf("maximum concurrent deals must be at least 1, got: %d", n)
+		}
+		o.replicatorMaxConcurrentDeals = n
+		return nil
+	}
+}
+
+// WithMaxConcurrentDealsPerProvider sets the maximum number of pieces dealt concurrently with any one storage
+// provider.
+// Defaults to 1.
+func WithMaxConcurrentDealsPerProvider(n int) Option {
+	return func(o *options) error {
+		if n < 1 {
+			return fmt.Errorf("maximum concurrent deals per provider must be at least 1, got: %d", n)
+		}
+		o.replicatorMaxProviderDeals = n
+		return nil
+	}
+}
+
+// WithDealProposalTimeout sets the maximum time an attempt at dealing a piece with a storage provider may take,
+// including connecting to the provider and querying its ask. Attempts that time out are retried as transient
+// failures. See WithDealRetryPolicy.
+// Defaults to 5 minutes.
+func WithDealProposalTimeout(timeout time.Duration) Option {
+	return func(o *options) error {
+		if timeout <= 0 {
+			return fmt.Errorf("deal proposal timeout must be larger than zero, got: %s", timeout)
+		}
+		o.dealProposalTimeout = timeout
+		return nil
+	}
+}
+
+// WithTargetReplicas sets the number of storage providers that must accept a piece for it to be replicated. Once
+// reached, no further providers picked for the piece are dealt with. Replicas accepted beyond the target by
+// proposals already in flight are handled according to WithExtraReplicaPolicy.
+// Defaults to zero, i.e. every storage provider picked for a piece is dealt with.
+func WithTargetReplicas(n int) Option {
+	return func(o *options) error {
+		if n < 0 {
+			return fmt.Errorf("target replicas must not be negative, got: %d", n)
+		}
+		o.replicatorTargetReplicas = n
+		return nil
+	}
+}
+
+// WithExtraReplicaPolicy sets what happens to replicas accepted beyond the target set by WithTargetReplicas.
+// Defaults to ExtraReplicasKeep.
+func WithExtraReplicaPolicy(policy ExtraReplicaPolicy) Option {
+	return func(o *options) error {
+		switch policy {
+		case ExtraReplicasKeep, ExtraReplicasRollBack, ExtraReplicasAvoid:
+			o.replicatorExtraReplicaPolicy = policy
+			return nil
+		default:
+			return fmt.Errorf("unknown extra replica policy: %d", policy)
+		}
+	}
+}
+
+// WithPieceCatalogDir sets the directory in which the manifests of aggregate pieces are persisted.
+// Defaults to ".jiffy/pieces" under the user home directory.
+func WithPieceCatalogDir(dir string) Option {
+	return func(o *options) error {
+		o.pieceCatalogDir = dir
+		return nil
+	}
+}
+
+// WithHttpOffloadListenAddr sets the address on which the HTTP server that offloads piece data to storage providers
+// listens. The server is only started if deals are made online; see WithOfflineDeals.
+// Defaults to "0.0.0.0:40080".
+func WithHttpOffloadListenAddr(addr string) Option {
+	return func(o *options) error {
+		o.httpOffloadListenAddr = addr
+		return nil
+	}
+}
+
+// WithHttpOffloadPublicURL sets the base URL at which storage providers reach the HTTP offload server, e.g. when it
+// runs behind a reverse proxy. Offload URLs are of the form <base URL>/piece/<piece CID>/<token ID>.
+// Required if deals are made online; see WithOfflineDeals.
+func WithHttpOffloadPublicURL(u *url.URL) Option {
+	return func(o *options) error {
+		if u == nil || u.Scheme == "" || u.Host == "" {
+			return errors.New("offload URL must be an absolute URL")
+		}
+		o.httpOffloadPublicURL = u
+		return nil
+	}
+}
+
+// WithHttpOffloadSecret sets the secret with which offload tokens are signed. Tokens signed with a previous secret
+// are no longer accepted once it changes.
+// Defaults to a random secret, generated once and persisted at ".jiffy/offload.key" under the user home directory.
+func WithHttpOffloadSecret(secret []byte) Option {
+	return func(o *options) error {
+		if len(secret) < 32 {
+			return fmt.Errorf("offload secret must be at least 32 bytes, got: %d", len(secret))
+		}
+		o.httpOffloadSecret = secret
+		return nil
+	}
+}
+
+// WithDealJournalPath sets the path of the file to which every deal attempt is appended as a line of JSON.
+// Defaults to ".jiffy/journal/deals.jsonl" under the user home directory.
+func WithDealJournalPath(path string) Option {
+	return func(o *options) error {
+		o.dealJournalPath = path
+		return nil
+	}
+}
@@ -0,0 +1,222 @@
+package jiffy
+
+import (
+	"sort"
+
+	"github.com/filecoin-project/go-state-types/abi"
+)
+
+const (
+	// defaultExactPackerMaxSegments is the default maximum number of segments, above which exact packer falls back
+	// on best-fit packing.
+	defaultExactPackerMaxSegments = 20
+)
+
+var (
+	_ Packer = (*bestFitPacker)(nil)
+	_ Packer = (*firstFitDecreasingPacker)(nil)
+	_ Packer = (*fifoPacker)(nil)
+	_ Packer = (*exactPacker)(nil)
+)
+
+type (
+	// Packer bin-packs segments into pieces.
+	Packer interface {
+		// Pack packs the given segments into at most maxPieces pieces of the given capacity.
+		// It returns the finalized pieces, along with the segments that were left unpacked.
+		// The fill ratio of each piece is reported by Piece.FillRatio.
+		Pack(segments []*Segment, capacity abi.PaddedPieceSize, maxPieces int) ([]*Piece, []*Segment, error)
+	}
+
+	bestFitPacker            struct{}
+	firstFitDecreasingPacker struct{}
+	fifoPacker               struct{}
+	exactPacker              struct {
+		maxSegments int
+		fallback    Packer
+	}
+)
+
+// NewBestFitPacker instantiates a Packer that places each segment, largest first, into the piece that leaves the
+// least remaining capacity. This is the default packer.
+func NewBestFitPacker() Packer {
+	return bestFitPacker{}
+}
+
+// NewFirstFitDecreasingPacker instantiates a Packer that places each segment, largest first, into the first piece
+// that fits it.
+func NewFirstFitDecreasingPacker() Packer {
+	return firstFitDecreasingPacker{}
+}
+
+// NewFIFOPacker instantiates a Packer that places segments in order of their creation time, oldest first, into the
+// first piece that fits them. It favours latency-to-deal over density.
+func NewFIFOPacker() Packer {
+	return fifoPacker{}
+}
+
+// NewExactPacker instantiates a Packer that fills each piece with the subset of segments that maximises its fill
+// ratio. The search is exhaustive; therefore, it is only suitable for small sets of segments. When there are more
+// than maxSegments segments, it falls back on best-fit packing.
+// Defaults to 20 if maxSegments is not positive.
+func NewExactPacker(maxSegments int) Packer {
+	if maxSegments <= 0 {
+		maxSegments = defaultExactPackerMaxSegments
+	}
+	return exactPacker{
+		maxSegments: maxSegments,
+		fallback:    NewBestFitPacker(),
+	}
+}
+
+func (bestFitPacker) Pack(segments []*Segment, capacity abi.PaddedPieceSize, maxPieces int) ([]*Piece, []*Segment, error) {
+	return packBestFit(append([]*Segment{}, segments...), capacity, maxPieces)
+}
+
+func (firstFitDecreasingPacker) Pack(segments []*Segment, capacity abi.PaddedPieceSize, maxPieces int) ([]*Piece, []*Segment, error) {
+	segments = append([]*Segment{}, segments...)
+	sort.Stable(sort.Reverse(Segments(segments)))
+	return packFirstFit(segments, capacity, maxPieces)
+}
+
+func (fifoPacker) Pack(segments []*Segment, capacity abi.PaddedPieceSize, maxPieces int) ([]*Piece, []*Segment, error) {
+	segments = append([]*Segment{}, segments...)
+	sort.SliceStable(segments, func(i, j int) bool { return segments[i].CreateTime.Before(segments[j].CreateTime) })
+	return packFirstFit(segments, capacity, maxPieces)
+}
+
+func (e exactPacker) Pack(segments []*Segment, capacity abi.PaddedPieceSize, maxPieces int) ([]*Piece, []*Segment, error) {
+	if len(segments) > e.maxSegments {
+		return e.fallback.Pack(segments, capacity, maxPieces)
+	}
+	remaining := append([]*Segment{}, segments...)
+	sort.Stable(sort.Reverse(Segments(remaining)))
+	var pieces []*Piece
+	for len(pieces) < maxPieces && len(remaining) > 0 {
+		piece := NewPiece(capacity)
+		chosen := packExact(piece, remaining)
+		if len(chosen) == 0 {
+			break
+		}
+		var unchosen []*Segment
+		for i, segment := range remaining {
+			if chosen[i] {
+				piece.addSegment(segment)
+			} else {
+				unchosen = append(unchosen, segment)
+			}
+		}
+		pieces = append(pieces, piece)
+		remaining = unchosen
+	}
+	for _, p := range pieces {
+		if err := p.finalize(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return pieces, remaining, nil
+}
+
+// packExact searches for the subset of segments that occupies the most space in the given empty piece, and reports
+// whether each segment is in that subset. The segments must be sorted in descending order of size.
+func packExact(piece *Piece, segments []*Segment) []bool {
+	// Compute suffix sums to bound the search.
+	suffix := make([]abi.PaddedPieceSize, len(segments)+1)
+	for i := len(segments) - 1; i >= 0; i-- {
+		suffix[i] = suffix[i+1] + segments[i].Info.Size
+	}
+	var bestSize abi.PaddedPieceSize
+	best := make([]bool, len(segments))
+	current := make([]bool, len(segments))
+	var search func(i int)
+	search = func(i int) {
+		if piece.Info.Size > bestSize {
+			bestSize = piece.Info.Size
+			copy(best, current)
+		}
+		if i == len(segments) || piece.Info.Size+suffix[i] <= bestSize {
+			return
+		}
+		if piece.canAdd(segments[i]) {
+			piece.addSegment(segments[i])
+			current[i] = true
+			search(i + 1)
+			current[i] = false
+			piece.removeLastSegment()
+		}
+		search(i + 1)
+	}
+	search(0)
+	if bestSize == 0 {
+		return nil
+	}
+	return best
+}
+
+// packBestFit places each segment, largest first, into the piece that leaves the least remaining capacity. It sorts
+// the given segments in place.
+func packBestFit(segments []*Segment, pieceCapacity abi.PaddedPieceSize, maxPieces int) ([]*Piece, []*Segment, error) {
+	sort.Sort(sort.Reverse(Segments(segments)))
+	var pieces []*Piece
+	var unpackedSegments []*Segment
+	for _, segment := range segments {
+		minRemainder := pieceCapacity
+		bestPieceIndex := -1
+		for pieceIndex, piece := range pieces {
+			remaining := piece.Capacity - piece.Info.Size
+			if piece.canAdd(segment) && remaining-segment.Info.Size < minRemainder {
+				bestPieceIndex = pieceIndex
+				minRemainder = remaining - segment.Info.Size
+			}
+		}
+		if bestPieceIndex != -1 {
+			pieces[bestPieceIndex].addSegment(segment)
+			continue
+		}
+		if len(pieces) < maxPieces {
+			newPiece := NewPiece(pieceCapacity)
+			if newPiece.canAdd(segment) {
+				newPiece.addSegment(segment)
+				pieces = append(pieces, newPiece)
+				continue
+			}
+		}
+		unpackedSegments = append(unpackedSegments, segment)
+	}
+	for _, p := range pieces {
+		if err := p.finalize(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return pieces, unpackedSegments, nil
+}
+
+// packFirstFit places each segment, in the given order, into the first piece that fits it.
+func packFirstFit(segments []*Segment, pieceCapacity abi.PaddedPieceSize, maxPieces int) ([]*Piece, []*Segment, error) {
+	var pieces []*Piece
+	var unpackedSegments []*Segment
+NextSegment:
+	for _, segment := range segments {
+		for _, piece := range pieces {
+			if piece.canAdd(segment) {
+				piece.addSegment(segment)
+				continue NextSegment
+			}
+		}
+		if len(pieces) < maxPieces {
+			newPiece := NewPiece(pieceCapacity)
+			if newPiece.canAdd(segment) {
+				newPiece.addSegment(segment)
+				pieces = append(pieces, newPiece)
+				continue
+			}
+		}
+		unpackedSegments = append(unpackedSegments, segment)
+	}
+	for _, p := range pieces {
+		if err := p.finalize(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return pieces, unpackedSegments, nil
+}
@@ -0,0 +1,69 @@
+package jiffy
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPackers(t *testing.T) {
+	now := time.Now()
+	var segments []*Segment
+	for i, size := range []abi.PaddedPieceSize{16 * KiB, 2 * KiB, 8 * KiB, 4 * KiB, 32 * KiB, 2 * KiB, 1 * KiB} {
+		segments = append(segments, newFakeSegment(t, size, now.Add(time.Duration(i)*time.Minute)))
+	}
+	for name, subject := range map[string]Packer{
+		"best-fit":             NewBestFitPacker(),
+		"first-fit-decreasing": NewFirstFitDecreasingPacker(),
+		"fifo":                 NewFIFOPacker(),
+		"exact":                NewExactPacker(0),
+	} {
+		t.Run(name, func(t *testing.T) {
+			input := append([]*Segment{}, segments...)
+			pieces, unpacked, err := subject.Pack(input, 64*KiB, 1)
+			require.NoError(t, err)
+			// Assert that the caller's segments are left in order.
+			require.Equal(t, segments, input)
+			require.Len(t, pieces, 1)
+			piece := pieces[0]
+			require.NoError(t, piece.Info.Size.Validate())
+			require.LessOrEqual(t, piece.Info.Size, abi.PaddedPieceSize(64*KiB))
+			require.Greater(t, piece.FillRatio(), 0.0)
+			require.LessOrEqual(t, piece.FillRatio(), 1.0)
+			// Assert that every segment is either packed or reported as unpacked.
+			require.ElementsMatch(t, segments, append(append([]*Segment{}, piece.Segments[1:]...), unpacked...))
+		})
+	}
+}
+
+func TestExactPacker_MaximisesFill(t *testing.T) {
+	var segments []*Segment
+	for _, size := range []abi.PaddedPieceSize{32 * KiB, 16 * KiB, 8 * KiB, 8 * KiB, 4 * KiB, 2 * KiB, 1 * KiB} {
+		segments = append(segments, newFakeSegment(t, size, time.Time{}))
+	}
+	exact, _, err := NewExactPacker(0).Pack(append([]*Segment{}, segments...), 64*KiB, 1)
+	require.NoError(t, err)
+	for _, other := range []Packer{NewBestFitPacker(), NewFirstFitDecreasingPacker(), NewFIFOPacker()} {
+		pieces, _, err := other.Pack(append([]*Segment{}, segments...), 64*KiB, 1)
+		require.NoError(t, err)
+		require.GreaterOrEqual(t, exact[0].FillRatio(), pieces[0].FillRatio())
+	}
+}
+
+func newFakeSegment(t *testing.T, size abi.PaddedPieceSize, createTime time.Time) *Segment {
+	commP := make([]byte, 32)
+	_, err := rand.Read(commP)
+	require.NoError(t, err)
+	commP[31] &= 0b00111111
+	pieceCID, err := commcid.PieceCommitmentV1ToCID(commP)
+	require.NoError(t, err)
+	return &Segment{
+		Info:          abi.PieceInfo{Size: size, PieceCID: pieceCID},
+		SegmentedSize: uint64(size.Unpadded()),
+		CreateTime:    createTime,
+	}
+}
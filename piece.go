@@ -3,12 +3,13 @@ package jiffy
 import (
 	"math/bits"
 	"sort"
+	"time"
 
-	"github.com/filecoin-project/go-commp-utils/nonffi"
 	commcid "github.com/filecoin-project/go-fil-commcid"
 	commp "github.com/filecoin-project/go-fil-commp-hashhash"
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-shipyard/jiffy/car"
+	"github.com/filecoin-shipyard/jiffy/datasegment"
 )
 
 var (
@@ -57,6 +58,9 @@ type (
 		Segments Segments
 		// TotalSegmentedSize is the sum of all Segment.SegmentedSize segments in this piece.
 		TotalSegmentedSize uint64
+		// sizeCounts counts the segments added to the piece by log2 of their size, so that fit checks need not lay
+		// out every segment again.
+		sizeCounts [64]int
 	}
 	Segments []*Segment
 )
@@ -70,66 +74,131 @@ func NewPiece(capacity abi.PaddedPieceSize) *Piece {
 }
 
 func (p *Piece) canAdd(segment *Segment) bool {
-	return segment.Info.Size <= p.Capacity-p.Info.Size
+	if segment.Info.Size > p.Capacity-p.Info.Size {
+		return false
+	}
+	// Check that the segments still fit before the data segment index once laid out, accounting for the padding
+	// needed to align them, and that the index has room for an entry per segment.
+	counts := p.sizeCounts
+	counts[sizeExponent(segment.Info.Size)]++
+	counts[sizeExponent(emptyHeaderV1Segment.Info.Size)]++
+	return layoutEnd(counts) <= datasegment.IndexStartOffset(p.Capacity) && len(p.Segments)+2 <= datasegment.MaxIndexEntriesInDeal(p.Capacity)
 }
 
 func (p *Piece) addSegment(segment *Segment) {
 	p.Segments = append(p.Segments, segment)
 	p.Info.Size += segment.Info.Size
+	p.TotalSegmentedSize += segment.SegmentedSize
+	p.sizeCounts[sizeExponent(segment.Info.Size)]++
 }
 
-func packBestFit(segments []*Segment, pieceCapacity abi.PaddedPieceSize, maxPieces int) ([]*Piece, []*Segment, error) {
-	pieceCapacity = pieceCapacity - emptyHeaderV1Segment.Info.Size
-	sort.Sort(sort.Reverse(Segments(segments)))
-	var pieces []*Piece
-	var unpackedSegments []*Segment
-	for _, segment := range segments {
-		minRemainder := pieceCapacity
-		bestPieceIndex := -1
-		for pieceIndex, piece := range pieces {
-			remaining := piece.Capacity - piece.Info.Size
-			if piece.canAdd(segment) && remaining-segment.Info.Size < minRemainder {
-				bestPieceIndex = pieceIndex
-				minRemainder = remaining - segment.Info.Size
-			}
-		}
-		if bestPieceIndex != -1 {
-			pieces[bestPieceIndex].addSegment(segment)
+// removeLastSegment undoes the last addSegment.
+func (p *Piece) removeLastSegment() {
+	segment := p.Segments[len(p.Segments)-1]
+	p.Segments = p.Segments[:len(p.Segments)-1]
+	p.Info.Size -= segment.Info.Size
+	p.TotalSegmentedSize -= segment.SegmentedSize
+	p.sizeCounts[sizeExponent(segment.Info.Size)]--
+}
+
+// layoutEnd returns the padded offset right after segments laid out in ascending order of size, given the number
+// of segments of each size by log2 of size. It is equivalent to datasegment.ComputeOffsets over the sorted sizes,
+// since segment sizes are powers of two: segments of equal size are contiguous once aligned to the first of them.
+func layoutEnd(counts [64]int) abi.PaddedPieceSize {
+	var end abi.PaddedPieceSize
+	for exponent, count := range counts {
+		if count == 0 {
 			continue
 		}
-		if len(pieces) < maxPieces {
-			newPiece := NewPiece(pieceCapacity)
-			if newPiece.canAdd(segment) {
-				newPiece.addSegment(segment)
-				pieces = append(pieces, newPiece)
-				continue
-			}
+		size := abi.PaddedPieceSize(1) << exponent
+		if misalignment := end % size; misalignment != 0 {
+			end += size - misalignment
 		}
-		unpackedSegments = append(unpackedSegments, segment)
-	}
-
-	// Finalize pieces, i.e. for each piece:
-	// 1. sort pieces by segment piece size, to minimise the need for fr32 padding
-	// 2. prepend an empty car header, to turn the aggregate data represented by the piece into a valid CARv1.
-	// 3. calculate the aggregate piece CID and padded size.
-	for _, p := range pieces {
-		sort.Sort(p.Segments)
-		// Prepend the empty CAR header as a segment, which should always be of minimum piece payload size
-		p.Segments = append([]*Segment{emptyHeaderV1Segment}, p.Segments...)
-		p.Info.Size += emptyHeaderV1Segment.Info.Size
-		segmentInfos := make([]abi.PieceInfo, len(p.Segments))
-		for i, segment := range p.Segments {
-			segmentInfos[i] = segment.Info
+		end += size * abi.PaddedPieceSize(count)
+	}
+	return end
+}
+
+func sizeExponent(size abi.PaddedPieceSize) int {
+	return bits.TrailingZeros64(uint64(size))
+}
+
+func (s Segments) sizes() []abi.PaddedPieceSize {
+	sizes := make([]abi.PaddedPieceSize, len(s))
+	for i, segment := range s {
+		sizes[i] = segment.Info.Size
+	}
+	return sizes
+}
+
+// FillRatio returns the ratio of piece capacity occupied by its segments, including the empty CAR header segment.
+// The capacity is the size the piece was packed against, rather than its padded size, which is only as large as
+// needed to fit the segments. Pieces of unknown capacity are measured against their padded size.
+func (p *Piece) FillRatio() float64 {
+	capacity := p.Capacity
+	if capacity == 0 {
+		capacity = p.Info.Size
+	}
+	if capacity == 0 {
+		return 0
+	}
+	var used abi.PaddedPieceSize
+	for _, segment := range p.Segments {
+		used += segment.Info.Size
+	}
+	return float64(used) / float64(capacity)
+}
+
+// contentSegments returns a copy of the piece segments, excluding the empty CAR header segment.
+func (p *Piece) contentSegments() []*Segment {
+	segments := make([]*Segment, 0, len(p.Segments))
+	for _, segment := range p.Segments {
+		if segment != emptyHeaderV1Segment {
+			segments = append(segments, segment)
 		}
-		var err error
-		if p.Info.PieceCID, err = nonffi.GenerateUnsealedCID(abi.RegisteredSealProof_StackedDrg64GiBV1, segmentInfos); err != nil {
-			return nil, nil, err
+	}
+	return segments
+}
+
+// OldestSegmentCreateTime returns the creation time of the oldest segment in the piece, or zero time if unknown.
+func (p *Piece) OldestSegmentCreateTime() time.Time {
+	var oldest time.Time
+	for _, segment := range p.Segments {
+		if segment.CreateTime.IsZero() {
+			continue
 		}
-		// Check if total piece size is valid, i.e. is a power of 2
-		if bits.OnesCount64(uint64(p.Info.Size)) != 1 {
-			// Find the next largest power of 2 number
-			p.Info.Size = 1 << uint64(bits.Len64(uint64(p.Info.Size)))
+		if oldest.IsZero() || segment.CreateTime.Before(oldest) {
+			oldest = segment.CreateTime
 		}
 	}
-	return pieces, unpackedSegments, nil
+	return oldest
+}
+
+// finalize lays out the piece segments as an FRC-0058 aggregate and calculates the aggregate piece CID and size.
+// The segments are:
+// 1. sorted by segment piece size, so that smaller segments fill the padding needed to align the larger ones.
+// 2. prepended with an empty car header, to turn the aggregate data represented by the piece into a valid CARv1.
+// The piece size is then set to the smallest size that fits both the segments and the data segment index.
+func (p *Piece) finalize() error {
+	sort.Sort(p.Segments)
+	// Prepend the empty CAR header as a segment, which should always be of minimum piece payload size
+	p.Segments = append(Segments{emptyHeaderV1Segment}, p.Segments...)
+	p.TotalSegmentedSize += emptyHeaderV1Segment.SegmentedSize
+	_, end := datasegment.ComputeOffsets(p.Segments.sizes())
+	p.Info.Size = datasegment.MinDealSize(end, len(p.Segments))
+	aggregate, err := p.aggregate()
+	if err != nil {
+		return err
+	}
+	p.Info.PieceCID, err = aggregate.PieceCID()
+	return err
+}
+
+// aggregate places the piece segments in order, as sub-pieces of an FRC-0058 aggregate of the piece size.
+func (p *Piece) aggregate() (*datasegment.Aggregate, error) {
+	infos := make([]abi.PieceInfo, len(p.Segments))
+	for i, segment := range p.Segments {
+		infos[i] = segment.Info
+	}
+	return datasegment.NewAggregate(p.Info.Size, infos)
 }
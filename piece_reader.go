@@ -0,0 +1,234 @@
+package jiffy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-shipyard/jiffy/car"
+)
+
+var (
+	_ io.ReadSeekCloser = (*pieceReader)(nil)
+)
+
+type (
+	// pieceReader materialises the aggregate data represented by a Piece as a stream of unpadded bytes.
+	// The bytes read from it hash to Piece.Info.PieceCID, i.e. the segments are laid out at their aligned offsets,
+	// with zero padding in between, followed by the FRC-0058 data segment index at the tail of the piece.
+	// Segment data is opened lazily upon read.
+	pieceReader struct {
+		ctx context.Context
+
+		size    int64
+		extents []pieceExtent
+		offset  int64
+
+		// current is the index of the extent with an open source, or -1 if none is open.
+		current int
+		// source is the open reader of the current extent.
+		source io.ReadSeekCloser
+		// sourceOffset is the offset of source relative to the start of the current extent.
+		sourceOffset int64
+	}
+	// pieceExtent represents a contiguous range of non-padding bytes within a piece.
+	pieceExtent struct {
+		offset int64
+		length int64
+		open   func(context.Context) (io.ReadSeekCloser, error)
+	}
+	nopReadSeekCloser struct {
+		io.ReadSeeker
+	}
+)
+
+func newPieceReader(ctx context.Context, piece *Piece, retriever Retriever) (*pieceReader, error) {
+	aggregate, err := piece.aggregate()
+	if err != nil {
+		return nil, err
+	}
+	index, err := aggregate.IndexBytes()
+	if err != nil {
+		return nil, err
+	}
+	extents := make([]pieceExtent, 0, len(piece.Segments)+1)
+	extents = append(extents, pieceExtent{
+		offset: int64(aggregate.IndexStartOffset().Unpadded()),
+		length: int64(len(index)),
+		open: func(context.Context) (io.ReadSeekCloser, error) {
+			return nopReadSeekCloser{bytes.NewReader(index)}, nil
+		},
+	})
+	for i, segment := range piece.Segments {
+		segment := segment
+		if unpaddedSize := int64(segment.Info.Size.Unpadded()); int64(segment.SegmentedSize) > unpaddedSize {
+			return nil, fmt.Errorf("segment %s data size %d exceeds its unpadded size %d", segment.Info.PieceCID, segment.SegmentedSize, unpaddedSize)
+		}
+		extent := pieceExtent{
+			offset: int64(abi.PaddedPieceSize(aggregate.Index[i].Offset).Unpadded()),
+			length: int64(segment.SegmentedSize),
+		}
+		if segment == emptyHeaderV1Segment {
+			extent.open = func(context.Context) (io.ReadSeekCloser, error) {
+				return nopReadSeekCloser{bytes.NewReader(car.EmptyHeaderV1Bytes)}, nil
+			}
+		} else {
+			extent.open = func(ctx context.Context) (io.ReadSeekCloser, error) {
+				return retriever.Retrieve(ctx, segment.Info)
+			}
+		}
+		extents = append(extents, extent)
+	}
+	sort.Slice(extents, func(i, j int) bool { return extents[i].offset < extents[j].offset })
+	return &pieceReader{
+		ctx:     ctx,
+		size:    int64(piece.Info.Size.Unpadded()),
+		extents: extents,
+		current: -1,
+	}, nil
+}
+
+// verifyPiece streams the aggregate data of the given piece and checks that it hashes to Piece.Info.PieceCID and
+// Piece.Info.Size, i.e. that the data received by storage providers matches the deal proposal.
+func verifyPiece(ctx context.Context, piece *Piece, retriever Retriever) error {
+	reader, err := newPieceReader(ctx, piece, retriever)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = reader.Close() }()
+	var cc commp.Calc
+	if _, err := io.Copy(&cc, reader); err != nil {
+		return err
+	}
+	digest, size, err := cc.Digest()
+	if err != nil {
+		return err
+	}
+	pieceCID, err := commcid.PieceCommitmentV1ToCID(digest)
+	if err != nil {
+		return err
+	}
+	if !pieceCID.Equals(piece.Info.PieceCID) || abi.PaddedPieceSize(size) != piece.Info.Size {
+		return fmt.Errorf("%w: expected %s of size %d but got %s of size %d", ErrPieceCIDMismatch, piece.Info.PieceCID, piece.Info.Size, pieceCID, size)
+	}
+	return nil
+}
+
+func (r *pieceReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	select {
+	case <-r.ctx.Done():
+		return 0, r.ctx.Err()
+	default:
+	}
+	if remaining := r.size - r.offset; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	// Find the first extent that ends after the current offset.
+	next := sort.Search(len(r.extents), func(i int) bool {
+		return r.extents[i].offset+r.extents[i].length > r.offset
+	})
+	if next == len(r.extents) || r.extents[next].offset > r.offset {
+		// The current offset falls in padding; fill with zeros up to the next extent or the end of piece.
+		paddingEnd := r.size
+		if next < len(r.extents) {
+			paddingEnd = r.extents[next].offset
+		}
+		if paddingLength := paddingEnd - r.offset; int64(len(p)) > paddingLength {
+			p = p[:paddingLength]
+		}
+		for i := range p {
+			p[i] = 0
+		}
+		r.offset += int64(len(p))
+		return len(p), nil
+	}
+
+	extent := r.extents[next]
+	if err := r.openExtent(next); err != nil {
+		return 0, err
+	}
+	relativeOffset := r.offset - extent.offset
+	if r.sourceOffset != relativeOffset {
+		if _, err := r.source.Seek(relativeOffset, io.SeekStart); err != nil {
+			return 0, err
+		}
+		r.sourceOffset = relativeOffset
+	}
+	if remaining := extent.length - relativeOffset; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	read, err := r.source.Read(p)
+	r.sourceOffset += int64(read)
+	r.offset += int64(read)
+	if errors.Is(err, io.EOF) {
+		if r.sourceOffset < extent.length {
+			return read, io.ErrUnexpectedEOF
+		}
+		err = nil
+	}
+	return read, err
+}
+
+func (r *pieceReader) openExtent(index int) error {
+	if r.current == index {
+		return nil
+	}
+	if err := r.closeSource(); err != nil {
+		return err
+	}
+	source, err := r.extents[index].open(r.ctx)
+	if err != nil {
+		return err
+	}
+	if source == nil {
+		return ErrSegmentNotFound
+	}
+	r.current = index
+	r.source = source
+	r.sourceOffset = 0
+	return nil
+}
+
+func (r *pieceReader) closeSource() error {
+	if r.source == nil {
+		return nil
+	}
+	err := r.source.Close()
+	r.source = nil
+	r.current = -1
+	return err
+}
+
+func (r *pieceReader) Seek(offset int64, whence int) (int64, error) {
+	var newOffset int64
+	switch whence {
+	case io.SeekStart:
+		newOffset = offset
+	case io.SeekCurrent:
+		newOffset = r.offset + offset
+	case io.SeekEnd:
+		newOffset = r.size + offset
+	default:
+		return r.offset, fmt.Errorf("invalid whence: %d", whence)
+	}
+	if newOffset < 0 {
+		return r.offset, errors.New("seek to negative offset")
+	}
+	r.offset = newOffset
+	return r.offset, nil
+}
+
+func (r *pieceReader) Close() error {
+	return r.closeSource()
+}
+
+func (nopReadSeekCloser) Close() error { return nil }
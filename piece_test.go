@@ -1,9 +1,18 @@
 package jiffy
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	mrand "math/rand"
+	"sort"
 	"testing"
 
+	commcid "github.com/filecoin-project/go-fil-commcid"
+	commp "github.com/filecoin-project/go-fil-commp-hashhash"
 	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-shipyard/jiffy/datasegment"
 	"github.com/stretchr/testify/require"
 )
 
@@ -11,3 +20,158 @@ func TestEmptyHeaderV1SegmentSize(t *testing.T) {
 	require.NoError(t, emptyHeaderV1Segment.Info.Size.Validate())
 	require.Equal(t, emptyHeaderV1Segment.Info.Size, abi.PaddedPieceSize(128))
 }
+
+func TestLayoutEnd_MatchesComputeOffsets(t *testing.T) {
+	rng := mrand.New(mrand.NewSource(1413))
+	for i := 0; i < 100; i++ {
+		var counts [64]int
+		sizes := []abi.PaddedPieceSize{emptyHeaderV1Segment.Info.Size}
+		counts[sizeExponent(emptyHeaderV1Segment.Info.Size)]++
+		for j := rng.Intn(50); j > 0; j-- {
+			size := abi.PaddedPieceSize(128) << rng.Intn(12)
+			sizes = append(sizes, size)
+			counts[sizeExponent(size)]++
+		}
+		sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+		_, want := datasegment.ComputeOffsets(sizes)
+		require.Equal(t, want, layoutEnd(counts))
+	}
+}
+
+func TestPieceReader_MatchesPieceCID(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSegmentor(t)
+	var segments []*Segment
+	for _, size := range []int{100, 1 * KiB, 3 * KiB, 5 * KiB, 7 * KiB, 20 * KiB} {
+		segments = append(segments, newTestSegment(t, s, size))
+	}
+	pieces, unpacked, err := packBestFit(segments, 1*MiB, 1)
+	require.NoError(t, err)
+	require.Empty(t, unpacked)
+	require.Len(t, pieces, 1)
+	piece := pieces[0]
+
+	subject, err := newPieceReader(ctx, piece, s)
+	require.NoError(t, err)
+	defer subject.Close()
+
+	var cp commp.Calc
+	written, err := io.Copy(&cp, subject)
+	require.NoError(t, err)
+	require.EqualValues(t, piece.Info.Size.Unpadded(), written)
+	digest, size, err := cp.Digest()
+	require.NoError(t, err)
+	gotCid, err := commcid.PieceCommitmentV1ToCID(digest)
+	require.NoError(t, err)
+	require.Equal(t, piece.Info.PieceCID, gotCid)
+	require.EqualValues(t, piece.Info.Size, size)
+
+	// Assert that the data segment index at the tail of piece lists every segment.
+	aggregate, err := piece.aggregate()
+	require.NoError(t, err)
+	indexOffset, err := subject.Seek(int64(aggregate.IndexStartOffset().Unpadded()), io.SeekStart)
+	require.NoError(t, err)
+	indexBytes := make([]byte, piece.Info.Size.Unpadded()-abi.UnpaddedPieceSize(indexOffset))
+	_, err = io.ReadFull(subject, indexBytes)
+	require.NoError(t, err)
+	entries, err := datasegment.ParseIndex(indexBytes)
+	require.NoError(t, err)
+	require.Len(t, entries, len(piece.Segments))
+	for i, entry := range entries {
+		info, err := entry.PieceInfo()
+		require.NoError(t, err)
+		require.Equal(t, piece.Segments[i].Info, info)
+	}
+
+	// Assert that seeking back to each segment reads its data.
+	for i, segment := range piece.Segments[1:] {
+		_, err := subject.Seek(int64(abi.PaddedPieceSize(entries[i+1].Offset).Unpadded()), io.SeekStart)
+		require.NoError(t, err)
+		got := make([]byte, segment.SegmentedSize)
+		_, err = io.ReadFull(subject, got)
+		require.NoError(t, err)
+		want, err := s.Retrieve(ctx, segment.Info)
+		require.NoError(t, err)
+		wantBytes, err := io.ReadAll(want)
+		require.NoError(t, err)
+		require.NoError(t, want.Close())
+		require.Equal(t, wantBytes, got)
+	}
+}
+
+func newTestSegmentor(t *testing.T) *headlessCarSegmentor {
+	j := &Jiffy{options: &options{
+		segmentorStoreDir:          t.TempDir(),
+		segmentorChunkSizeBytes:    1 * KiB,
+		segmentorMaxTotalSizeBytes: 1 * MiB,
+	}}
+	s, err := newHeadlessCarSegmentor(j)
+	require.NoError(t, err)
+	return s
+}
+
+func newTestSegment(t *testing.T, s *headlessCarSegmentor, size int) *Segment {
+	data := make([]byte, size)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	segment, err := s.Segment(context.Background(), io.NopCloser(bytes.NewReader(data)))
+	require.NoError(t, err)
+	return segment
+}
+
+func TestHeadlessCarSegmentor_KeepsCreateTimeOfKnownSegment(t *testing.T) {
+	ctx := context.Background()
+	subject := newTestSegmentor(t)
+	data := bytes.Repeat([]byte("fish"), 1024)
+
+	first, err := subject.Segment(ctx, io.NopCloser(bytes.NewReader(data)))
+	require.NoError(t, err)
+	again, err := subject.Segment(ctx, io.NopCloser(bytes.NewReader(data)))
+	require.NoError(t, err)
+	require.Equal(t, first.CreateTime, again.CreateTime)
+	got, err := subject.GetSegment(ctx, first.Info)
+	require.NoError(t, err)
+	require.Equal(t, first.CreateTime, got.CreateTime)
+}
+
+func TestPiece_ProveInclusion(t *testing.T) {
+	s := newTestSegmentor(t)
+	var segments []*Segment
+	for _, size := range []int{1 * KiB, 3 * KiB, 9 * KiB} {
+		segments = append(segments, newTestSegment(t, s, size))
+	}
+	pieces, _, err := packBestFit(segments, 1*MiB, 1)
+	require.NoError(t, err)
+	piece := pieces[0]
+
+	for _, segment := range segments {
+		proof, err := piece.ProveInclusion(segment.Info)
+		require.NoError(t, err)
+		require.NoError(t, VerifyInclusion(segment.Info, piece.Info, proof))
+
+		// Assert that the proof does not verify against a different segment or a different piece size.
+		other := segments[0].Info
+		if other == segment.Info {
+			other = segments[1].Info
+		}
+		require.Error(t, VerifyInclusion(other, piece.Info, proof))
+		require.Error(t, VerifyInclusion(segment.Info, abi.PieceInfo{PieceCID: piece.Info.PieceCID, Size: piece.Info.Size * 2}, proof))
+	}
+
+	_, err = piece.ProveInclusion(abi.PieceInfo{PieceCID: piece.Info.PieceCID, Size: piece.Info.Size})
+	require.ErrorIs(t, err, ErrSegmentNotFound)
+}
+
+func TestVerifyPiece(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSegmentor(t)
+	segments := []*Segment{newTestSegment(t, s, 2*KiB), newTestSegment(t, s, 5*KiB)}
+	pieces, _, err := packBestFit(segments, 1*MiB, 1)
+	require.NoError(t, err)
+	piece := pieces[0]
+	require.NoError(t, verifyPiece(ctx, piece, s))
+
+	tampered := *piece
+	tampered.Info.PieceCID = segments[0].Info.PieceCID
+	require.ErrorIs(t, verifyPiece(ctx, &tampered, s), ErrPieceCIDMismatch)
+}
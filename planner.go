@@ -0,0 +1,136 @@
+package jiffy
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+)
+
+var (
+	_ Planner = (*simpleReplicator)(nil)
+)
+
+type (
+	// Planner computes what would be dealt in the next replication cycle, without making any deals.
+	Planner interface {
+		Plan(context.Context) (*Plan, error)
+	}
+	// Plan represents the outcome of a replication cycle, had it been executed at Epoch.
+	Plan struct {
+		Epoch abi.ChainEpoch
+		// Pieces lists the candidate pieces packed from under-replicated segments.
+		Pieces []PlannedPiece
+		// Unpacked lists the under-replicated segments that were not packed into any piece.
+		Unpacked []*Segment
+	}
+	// PlannedPiece represents a candidate piece and the deals that would be made for it.
+	PlannedPiece struct {
+		// Piece is the candidate aggregate piece, along with its segments, padded size and piece CID.
+		Piece     *Piece
+		FillRatio float64
+		// ReadyToDeal signals whether the piece meets the thresholds to be dealt. Pieces that are not ready are held
+		// back until they are.
+		ReadyToDeal bool
+		// Deals lists the deals that would be made for the piece. It is empty if the piece is not ready to deal.
+		Deals []PlannedDeal
+		// Error is the error that occurred while picking the storage providers, if any.
+		Error error
+	}
+	// dealPricer is implemented by Dealer implementations that price deals, so that planned deals are priced the
+	// same way as the deals made.
+	dealPricer interface {
+		pickPrice(ctx context.Context, sp address.Address, pieceSize abi.PaddedPieceSize, start, end abi.ChainEpoch, verified bool) (abi.TokenAmount, error)
+	}
+	// PlannedDeal represents a deal that would be made with a storage provider.
+	PlannedDeal struct {
+		Provider address.Address
+		// Piece is the piece that would be dealt with the provider. It differs from PlannedPiece.Piece when the
+		// candidate piece is re-packed against the maximum piece size of the provider.
+		Piece         *Piece
+		StartEpoch    abi.ChainEpoch
+		EndEpoch      abi.ChainEpoch
+		PricePerEpoch abi.TokenAmount
+		// TotalPrice is the estimated price of deal over its entire duration.
+		TotalPrice abi.TokenAmount
+		// Error is the error that occurred while fitting the piece to the provider or pricing the deal, e.g.
+		// ErrAskNotSatisfiable, or ErrProviderCoolingDown if the provider is skipped after repeated deal failures, if
+		// any.
+		Error error
+	}
+)
+
+// Plan runs the same under-replication scan and packing as the replication cycle, and returns the candidate pieces
+// along with the storage providers that would be picked and the estimated price of each deal. Deals are priced the
+// same way as the dealer does, i.e. against the cached storage ask of each provider. No deals are made.
+func (r *simpleReplicator) Plan(ctx context.Context) (*Plan, error) {
+	pieces, unpacked, epoch, err := r.packUnderReplicated(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return r.plan(ctx, pieces, unpacked, epoch), nil
+}
+
+// plan returns the plan of dealing the given candidate pieces at the given epoch.
+func (r *simpleReplicator) plan(ctx context.Context, pieces []*Piece, unpacked []*Segment, epoch abi.ChainEpoch) *Plan {
+	plan := &Plan{
+		Epoch:    epoch,
+		Pieces:   make([]PlannedPiece, 0, len(pieces)),
+		Unpacked: unpacked,
+	}
+	start := epoch + r.j.dealStartDelay
+	end := start + r.j.dealDuration
+	now := time.Now()
+	for _, piece := range pieces {
+		planned := PlannedPiece{
+			Piece:       piece,
+			FillRatio:   piece.FillRatio(),
+			ReadyToDeal: r.isReadyToDeal(piece, now),
+		}
+		if planned.ReadyToDeal {
+			sps, err := r.j.replicatorSpPicker(ctx, piece)
+			if err != nil {
+				planned.Error = err
+			}
+			for _, sp := range sps {
+				if until, cooling := r.cooldown.coolingDown(sp, now); cooling {
+					planned.Deals = append(planned.Deals, PlannedDeal{Provider: sp, Error: fmt.Errorf("%w until %s", ErrProviderCoolingDown, until)})
+					continue
+				}
+				spPieces, err := r.piecesForProvider(ctx, piece, unpacked, sp)
+				if err != nil {
+					planned.Deals = append(planned.Deals, PlannedDeal{Provider: sp, Error: err})
+					continue
+				}
+				for _, spPiece := range spPieces {
+					deal := PlannedDeal{
+						Provider:   sp,
+						Piece:      spPiece,
+						StartEpoch: start,
+						EndEpoch:   end,
+					}
+					if deal.PricePerEpoch, err = r.pickPrice(ctx, sp, spPiece.Info.Size, start, end); err != nil {
+						deal.Error = err
+					} else {
+						deal.TotalPrice = big.Mul(deal.PricePerEpoch, big.NewInt(int64(end-start)))
+					}
+					planned.Deals = append(planned.Deals, deal)
+				}
+			}
+		}
+		plan.Pieces = append(plan.Pieces, planned)
+	}
+	return plan
+}
+
+// pickPrice picks the price per epoch of a deal the same way as the dealer, if it prices deals, or with the
+// configured price picker otherwise.
+func (r *simpleReplicator) pickPrice(ctx context.Context, sp address.Address, pieceSize abi.PaddedPieceSize, start, end abi.ChainEpoch) (abi.TokenAmount, error) {
+	if pricer, ok := r.j.dealer.(dealPricer); ok {
+		return pricer.pickPrice(ctx, sp, pieceSize, start, end, r.j.dealVerified)
+	}
+	return r.j.dealPricePerEpochPicker(pieceSize, start, end), nil
+}
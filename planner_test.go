@@ -0,0 +1,89 @@
+package jiffy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-shipyard/boostly"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSimpleReplicator_PlanPricesDealsAsDealer(t *testing.T) {
+	ctx := context.Background()
+	cheap, err := address.NewIDAddress(1000)
+	require.NoError(t, err)
+	pricey, err := address.NewIDAddress(1001)
+	require.NoError(t, err)
+	asks := map[address.Address]abi.TokenAmount{cheap: big.NewInt(GiB), pricey: big.NewInt(4 * GiB)}
+
+	var picked []abi.PaddedPieceSize
+	opts, err := applyTestOptions(
+		WithDealMaxPricePerGiBEpoch(big.NewInt(2*GiB)),
+		WithDealAskPricePicker(func(ask *boostly.StorageAsk, pieceSize abi.PaddedPieceSize, _, _ abi.ChainEpoch, verified bool) (abi.TokenAmount, error) {
+			require.False(t, verified)
+			picked = append(picked, pieceSize)
+			return big.Add(askPricePerEpoch(ask.Price, pieceSize), big.NewInt(1)), nil
+		}),
+	)
+	require.NoError(t, err)
+	opts.dealStartDelay = 100
+	opts.dealDuration = epochsInMinDeal
+	opts.replicatorPacker = NewBestFitPacker()
+	opts.replicatorPieceCapacity = 1 * MiB
+	opts.replicatorSpPicker = func(context.Context, *Piece) ([]address.Address, error) { return []address.Address{cheap, pricey}, nil }
+	j := &Jiffy{options: opts}
+	j.providers, err = newProviderDirectory(j)
+	require.NoError(t, err)
+	for sp, price := range asks {
+		j.providers.entries[sp] = &providerEntry{
+			info: ProviderInfo{
+				Provider:   sp,
+				SectorSize: abi.SectorSize(1 * MiB),
+				Ask:        &boostly.StorageAsk{Price: price, VerifiedPrice: price, MaxPieceSize: 1 * MiB},
+			},
+			infoExpiry: time.Now().Add(time.Hour),
+			askExpiry:  time.Now().Add(time.Hour),
+		}
+	}
+	j.dealer, err = newStorageMarketDealer(j)
+	require.NoError(t, err)
+	subject, err := newSimpleReplicator(j)
+	require.NoError(t, err)
+
+	now := time.Now()
+	segments := []*Segment{newFakeSegment(t, 2*KiB, now), newFakeSegment(t, 8*KiB, now), newFakeSegment(t, 2*MiB, now)}
+	pieces, unpacked, err := opts.replicatorPacker.Pack(segments, opts.replicatorPieceCapacity, 1)
+	require.NoError(t, err)
+	require.Len(t, unpacked, 1)
+
+	got := subject.plan(ctx, pieces, unpacked, 1413)
+	require.Equal(t, abi.ChainEpoch(1413), got.Epoch)
+	require.Equal(t, unpacked, got.Unpacked)
+	require.Len(t, got.Pieces, 1)
+	planned := got.Pieces[0]
+	require.ElementsMatch(t, segments[:2], planned.Piece.contentSegments())
+	require.True(t, planned.ReadyToDeal)
+	require.Equal(t, planned.Piece.FillRatio(), planned.FillRatio)
+	require.Len(t, planned.Deals, 2)
+
+	// Deals are priced by the ask price picker, within the maximum price, as the dealer would.
+	deal := planned.Deals[0]
+	require.Equal(t, cheap, deal.Provider)
+	require.Equal(t, planned.Piece, deal.Piece)
+	require.Equal(t, abi.ChainEpoch(1513), deal.StartEpoch)
+	require.Equal(t, abi.ChainEpoch(1513)+epochsInMinDeal, deal.EndEpoch)
+	require.NoError(t, deal.Error)
+	wantPrice := big.NewIntUnsigned(uint64(planned.Piece.Info.Size) + 1)
+	require.Equal(t, wantPrice, deal.PricePerEpoch)
+	require.Equal(t, big.Mul(wantPrice, big.NewInt(int64(epochsInMinDeal))), deal.TotalPrice)
+	require.Equal(t, []abi.PaddedPieceSize{planned.Piece.Info.Size}, picked)
+
+	deal = planned.Deals[1]
+	require.Equal(t, pricey, deal.Provider)
+	require.ErrorIs(t, deal.Error, ErrAskNotSatisfiable)
+	require.Nil(t, deal.TotalPrice.Int)
+}
@@ -0,0 +1,198 @@
+package jiffy
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-shipyard/boostly"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+type (
+	// ProviderInfo captures what is known about a storage provider, as cached by the provider directory.
+	ProviderInfo struct {
+		Provider address.Address
+		// AddrInfo is the libp2p peer ID and addresses of the provider. The addresses are the ones configured via
+		// WithProviderAddrs if any, or the ones advertised on chain otherwise.
+		AddrInfo   peer.AddrInfo
+		SectorSize abi.SectorSize
+		// Protocols are the libp2p protocols supported by the provider, as of the last connection to it.
+		Protocols []protocol.ID `json:",omitempty"`
+		// Transports are the retrieval transports supported by the provider, if queried.
+		Transports *boostly.TransportsQueryResponse `json:",omitempty"`
+		// Ask is the storage ask of the provider, if queried.
+		Ask *boostly.StorageAsk `json:",omitempty"`
+		// Updated is the time at which the on-chain information of the provider was last refreshed.
+		Updated time.Time
+	}
+
+	// providerDirectory caches the addressing and capabilities of storage providers, to avoid querying the chain
+	// and reconnecting to providers for every deal and replica check. Cached information is refreshed once its TTL
+	// has passed, or once connecting to the provider fails.
+	providerDirectory struct {
+		j *Jiffy
+
+		mutex   sync.Mutex
+		entries map[address.Address]*providerEntry
+	}
+	providerEntry struct {
+		info             ProviderInfo
+		infoExpiry       time.Time
+		askExpiry        time.Time
+		transportsExpiry time.Time
+	}
+)
+
+func newProviderDirectory(j *Jiffy) (*providerDirectory, error) {
+	return &providerDirectory{
+		j:       j,
+		entries: make(map[address.Address]*providerEntry),
+	}, nil
+}
+
+// info returns the on-chain information of the given provider, refreshing it if expired.
+func (d *providerDirectory) info(ctx context.Context, sp address.Address) (*ProviderInfo, error) {
+	d.mutex.Lock()
+	entry, ok := d.entries[sp]
+	if ok && time.Now().Before(entry.infoExpiry) {
+		info := entry.info
+		d.mutex.Unlock()
+		return &info, nil
+	}
+	d.mutex.Unlock()
+
+	mi, err := d.j.chain.StateMinerInfo(ctx, sp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get miner info of %s: %w", sp, err)
+	}
+	ai, err := mi.addrInfo()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get addresses of %s: %w", sp, err)
+	}
+	if addrs, overridden := d.j.providerAddrs[sp]; overridden {
+		ai.Addrs = addrs
+	}
+	now := time.Now()
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	entry, ok = d.entries[sp]
+	if !ok {
+		entry = &providerEntry{}
+		d.entries[sp] = entry
+	}
+	entry.info.Provider = sp
+	entry.info.AddrInfo = *ai
+	entry.info.SectorSize = mi.SectorSize
+	entry.info.Updated = now
+	entry.infoExpiry = now.Add(d.j.providerInfoTTL)
+	info := entry.info
+	return &info, nil
+}
+
+// connect ensures that the host is connected to the given provider, and returns its information. Existing
+// connections are reused. Failure to connect evicts the cached on-chain information, in case it is stale.
+func (d *providerDirectory) connect(ctx context.Context, sp address.Address) (*ProviderInfo, error) {
+	info, err := d.info(ctx, sp)
+	if err != nil {
+		return nil, err
+	}
+	if d.j.h.Network().Connectedness(info.AddrInfo.ID) != network.Connected {
+		d.j.h.Peerstore().AddAddrs(info.AddrInfo.ID, info.AddrInfo.Addrs, d.j.providerInfoTTL)
+		if err := d.j.h.Connect(ctx, info.AddrInfo); err != nil {
+			d.evict(sp)
+			return nil, fmt.Errorf("failed to connect to %s: %w", sp, err)
+		}
+	}
+	if protocols, err := d.j.h.Peerstore().GetProtocols(info.AddrInfo.ID); err == nil {
+		info.Protocols = protocols
+		d.mutex.Lock()
+		if entry, ok := d.entries[sp]; ok {
+			entry.info.Protocols = protocols
+		}
+		d.mutex.Unlock()
+	}
+	return info, nil
+}
+
+// firstSupportedProtocol connects to the given provider and returns the first of the given protocols that it
+// supports, or empty if it supports none.
+func (d *providerDirectory) firstSupportedProtocol(ctx context.Context, sp address.Address, protocols ...protocol.ID) (*ProviderInfo, protocol.ID, error) {
+	info, err := d.connect(ctx, sp)
+	if err != nil {
+		return nil, "", err
+	}
+	supported, err := d.j.h.Peerstore().FirstSupportedProtocol(info.AddrInfo.ID, protocols...)
+	if err != nil {
+		return nil, "", err
+	}
+	return info, supported, nil
+}
+
+// ask returns the storage ask of the given provider, querying it if expired.
+func (d *providerDirectory) ask(ctx context.Context, sp address.Address) (*boostly.StorageAsk, error) {
+	d.mutex.Lock()
+	if entry, ok := d.entries[sp]; ok && entry.info.Ask != nil && time.Now().Before(entry.askExpiry) {
+		ask := *entry.info.Ask
+		d.mutex.Unlock()
+		return &ask, nil
+	}
+	d.mutex.Unlock()
+
+	info, err := d.connect(ctx, sp)
+	if err != nil {
+		return nil, err
+	}
+	ask, err := queryStorageAsk(ctx, d.j.h, info.AddrInfo.ID, sp)
+	if err != nil {
+		return nil, err
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if entry, ok := d.entries[sp]; ok {
+		cached := *ask
+		entry.info.Ask = &cached
+		entry.askExpiry = time.Now().Add(d.j.providerAskTTL)
+	}
+	return ask, nil
+}
+
+// transports returns the retrieval transports supported by the given provider, querying them if expired.
+func (d *providerDirectory) transports(ctx context.Context, sp address.Address) (*boostly.TransportsQueryResponse, error) {
+	d.mutex.Lock()
+	if entry, ok := d.entries[sp]; ok && entry.info.Transports != nil && time.Now().Before(entry.transportsExpiry) {
+		transports := entry.info.Transports
+		d.mutex.Unlock()
+		return transports, nil
+	}
+	d.mutex.Unlock()
+
+	info, err := d.connect(ctx, sp)
+	if err != nil {
+		return nil, err
+	}
+	transports, err := boostly.QueryTransports(ctx, d.j.h, info.AddrInfo.ID)
+	if err != nil {
+		return nil, err
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if entry, ok := d.entries[sp]; ok {
+		entry.info.Transports = transports
+		entry.transportsExpiry = time.Now().Add(d.j.providerInfoTTL)
+	}
+	return transports, nil
+}
+
+// evict removes the cached information of the given provider, such that it is refreshed upon next use.
+func (d *providerDirectory) evict(sp address.Address) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delete(d.entries, sp)
+}
@@ -0,0 +1,113 @@
+package jiffy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMinerInfo_AddrInfo(t *testing.T) {
+	id, err := test.RandPeerID()
+	require.NoError(t, err)
+	idStr := id.String()
+	empty := ""
+	addr := multiaddr.StringCast("/ip4/127.0.0.1/tcp/1234")
+
+	tests := []struct {
+		name    string
+		info    minerInfo
+		want    *peer.AddrInfo
+		wantErr bool
+	}{
+		{name: "no peer ID", wantErr: true},
+		{name: "empty peer ID", info: minerInfo{PeerId: &empty}, wantErr: true},
+		{name: "invalid peer ID", info: minerInfo{PeerId: &[]string{"fish"}[0]}, wantErr: true},
+		{name: "no addresses", info: minerInfo{PeerId: &idStr}, want: &peer.AddrInfo{ID: id}},
+		{
+			name: "skips invalid addresses",
+			info: minerInfo{PeerId: &idStr, Multiaddrs: [][]byte{[]byte("fish"), addr.Bytes()}},
+			want: &peer.AddrInfo{ID: id, Addrs: []multiaddr.Multiaddr{addr}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.info.addrInfo()
+			if test.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestProviderDirectory_Info(t *testing.T) {
+	ctx := context.Background()
+	id, err := test.RandPeerID()
+	require.NoError(t, err)
+	idStr := id.String()
+	onChain := multiaddr.StringCast("/ip4/127.0.0.1/tcp/1234")
+	override := multiaddr.StringCast("/ip4/127.0.0.1/tcp/5678")
+	sp, err := address.NewIDAddress(1413)
+	require.NoError(t, err)
+	other, err := address.NewIDAddress(1414)
+	require.NoError(t, err)
+
+	var calls atomic.Int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"jsonrpc": "2.0",
+			"id":      0,
+			"result": minerInfo{
+				PeerId:     &idStr,
+				Multiaddrs: [][]byte{onChain.Bytes()},
+				SectorSize: abi.SectorSize(32 * GiB),
+			},
+		})
+	}))
+	defer api.Close()
+
+	opts, err := applyTestOptions(WithProviderAddrs(sp, override), WithProviderInfoTTL(time.Hour))
+	require.NoError(t, err)
+	opts.chain = newChainClient(api.URL)
+	subject, err := newProviderDirectory(&Jiffy{options: opts})
+	require.NoError(t, err)
+
+	// Operator overrides take precedence over the addresses on chain.
+	got, err := subject.info(ctx, sp)
+	require.NoError(t, err)
+	require.Equal(t, sp, got.Provider)
+	require.Equal(t, id, got.AddrInfo.ID)
+	require.Equal(t, []multiaddr.Multiaddr{override}, got.AddrInfo.Addrs)
+	require.Equal(t, abi.SectorSize(32*GiB), got.SectorSize)
+	got, err = subject.info(ctx, other)
+	require.NoError(t, err)
+	require.Equal(t, []multiaddr.Multiaddr{onChain}, got.AddrInfo.Addrs)
+	require.Equal(t, int32(2), calls.Load())
+
+	// Cached information is reused until it expires or is evicted.
+	_, err = subject.info(ctx, sp)
+	require.NoError(t, err)
+	require.Equal(t, int32(2), calls.Load())
+	subject.entries[sp].infoExpiry = time.Now()
+	_, err = subject.info(ctx, sp)
+	require.NoError(t, err)
+	require.Equal(t, int32(3), calls.Load())
+	subject.evict(other)
+	_, err = subject.info(ctx, other)
+	require.NoError(t, err)
+	require.Equal(t, int32(4), calls.Load())
+}
@@ -2,6 +2,7 @@ package jiffy
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
@@ -9,6 +10,7 @@ import (
 	"github.com/filecoin-project/go-address"
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/builtin"
+	"github.com/filecoin-project/go-state-types/builtin/v11/verifreg"
 	"github.com/filecoin-project/go-state-types/builtin/v9/market"
 	"github.com/filecoin-shipyard/boostly"
 	"github.com/filecoin-shipyard/telefil"
@@ -53,10 +55,19 @@ type (
 		DealProposal       boostly.DealProposal
 		LastProviderStatus *boostly.DealStatusResponse
 		LastChainStatus    *telefil.StateMarketStorageDeal
-		LastChecked        time.Time
-		LastError          error
+		// LastAllocation is the verified registry allocation of replicas onboarded without a market deal, if any.
+		LastAllocation *verifreg.Allocation
+		// LastClaim is the verified registry claim of replicas onboarded without a market deal, if any.
+		LastClaim   *verifreg.Claim
+		LastChecked time.Time
+		LastError   error
 	}
 	ReplicaStatus int
+	// replicaVerifier is implemented by Dealer implementations that track the status of replicas by means other than
+	// storage market deals, given the current chain head.
+	replicaVerifier interface {
+		verifyReplica(context.Context, *Replica, abi.ChainEpoch)
+	}
 
 	simpleReplicator struct {
 		j *Jiffy
@@ -64,6 +75,13 @@ type (
 		ctx    context.Context
 		cancel context.CancelFunc
 
+		cooldown *providerCooldown
+
+		// dealSlots limits the concurrent deals across all providers, and providerSlotsBySp per provider.
+		dealSlots          chan struct{}
+		providerSlotsMutex sync.Mutex
+		providerSlotsBySp  map[address.Address]chan struct{}
+
 		segmentReplicasMutex sync.RWMutex
 		segmentReplicas      map[cid.Cid]map[uuid.UUID]*Replica // TODO persist to disk
 	}
@@ -93,6 +111,18 @@ func (r *Replica) MatchesProposalOnChain() bool {
 
 func (r *Replica) Status(head abi.ChainEpoch) ReplicaStatus {
 	switch {
+	case r.LastClaim != nil:
+		if r.LastClaim.TermStart+r.LastClaim.TermMax <= head {
+			return Expired
+		}
+		return Active
+	case r.LastAllocation != nil:
+		if r.LastAllocation.Expiration <= head {
+			return Expired
+		}
+		return Published
+	case errors.Is(r.LastError, ErrAllocationExpired):
+		return Expired
 	case r.LastProviderStatus == nil:
 		if r.LastError != nil {
 			return Unknown
@@ -132,7 +162,13 @@ func (r *Replica) Expiration(genesis time.Time) time.Time {
 }
 
 func newSimpleReplicator(j *Jiffy) (*simpleReplicator, error) {
-	r := &simpleReplicator{j: j}
+	r := &simpleReplicator{
+		j:                 j,
+		segmentReplicas:   make(map[cid.Cid]map[uuid.UUID]*Replica),
+		cooldown:          newProviderCooldown(j),
+		dealSlots:         newSlots(j.replicatorMaxConcurrentDeals),
+		providerSlotsBySp: make(map[address.Address]chan struct{}),
+	}
 	r.ctx, r.cancel = context.WithCancel(context.Background())
 	return r, nil
 }
@@ -155,77 +191,169 @@ func (r *simpleReplicator) replicate(ctx context.Context) {
 			return
 		case <-r.j.replicatorInterval.C:
 		}
-		segments, err := r.j.ListSegments(ctx)
+		pieces, unpacked, _, err := r.packUnderReplicated(ctx)
 		if err != nil {
+			logger.Errorw("failed to execute replication cycle", "err", err)
 			continue
 		}
-
-		head, err := r.j.fil.ChainHead(ctx)
-		if err != nil {
-			logger.Errorw("failed to execute replication cycle: failed to get chain head", "err", err)
+		if len(pieces) <= 0 {
 			continue
 		}
+		r.replicateCycle(ctx, pieces, unpacked)
+	}
+}
 
-		var underReplicated []*Segment
-		r.segmentReplicasMutex.RLock()
-	NextSegment:
-		for _, segment := range segments {
-			replicas, ok := r.segmentReplicas[segment.Info.PieceCID]
-			switch {
-			case !ok, replicas == nil, len(replicas) == 0:
-				underReplicated = append(underReplicated, segment)
-			default:
-				for _, replica := range replicas {
-					switch replica.Status(head.Height) {
-					case Slashed, Expired:
-						// TODO check that the new replica does not end up on SPs that already have a replica of data.
-						//      We need replication "affinity" and "anti-affinity" as a general concept.
-						underReplicated = append(underReplicated, segment)
-						continue NextSegment
-					case Unknown:
-						// TODO we want some grace period before we start a new replica.
-					}
+// packUnderReplicated packs the segments that are not replicated, or whose replicas have been slashed or expired,
+// into pieces. It returns the packed pieces, the segments that were left unpacked and the chain height at which
+// replication status was evaluated.
+func (r *simpleReplicator) packUnderReplicated(ctx context.Context) ([]*Piece, []*Segment, abi.ChainEpoch, error) {
+	segments, err := r.j.ListSegments(ctx)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("failed to list segments: %w", err)
+	}
+	head, err := r.j.fil.ChainHead(ctx)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("failed to get chain head: %w", err)
+	}
+
+	var underReplicated []*Segment
+	r.segmentReplicasMutex.RLock()
+NextSegment:
+	for _, segment := range segments {
+		replicas, ok := r.segmentReplicas[segment.Info.PieceCID]
+		switch {
+		case !ok, replicas == nil, len(replicas) == 0:
+			underReplicated = append(underReplicated, segment)
+		default:
+			for _, replica := range replicas {
+				switch replica.Status(head.Height) {
+				case Slashed, Expired:
+					// TODO check that the new replica does not end up on SPs that already have a replica of data.
+					//      We need replication "affinity" and "anti-affinity" as a general concept.
+					underReplicated = append(underReplicated, segment)
+					continue NextSegment
+				case Unknown:
+					// TODO we want some grace period before we start a new replica.
 				}
 			}
 		}
-		r.segmentReplicasMutex.RUnlock()
-		pieces, _, err := packBestFit(underReplicated, 32*GiB, 1)
+	}
+	r.segmentReplicasMutex.RUnlock()
+	pieces, unpacked, err := r.j.replicatorPacker.Pack(underReplicated, r.j.replicatorPieceCapacity, 1)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("failed to pack segments: %w", err)
+	}
+	for _, piece := range pieces {
+		logger.Debugw("packed under-replicated segments", "piece", piece.Info.PieceCID, "segments", len(piece.Segments), "fillRatio", piece.FillRatio())
+	}
+	if len(unpacked) > 0 {
+		logger.Debugw("some under-replicated segments were left unpacked", "count", len(unpacked))
+	}
+	return pieces, unpacked, head.Height, nil
+}
+
+// piecesForProvider returns the pieces to deal with the given storage provider in order to replicate the given
+// piece, packed against the provider's maximum piece size. The piece segments are re-packed into smaller pieces if
+// the piece exceeds it, or into a larger piece along with the given spare segments if the provider can take more
+// than the piece was packed for.
+func (r *simpleReplicator) piecesForProvider(ctx context.Context, piece *Piece, spare []*Segment, sp address.Address) ([]*Piece, error) {
+	capacity, err := r.providerPieceCapacity(ctx, sp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine maximum piece size of provider: %w", err)
+	}
+	switch {
+	case capacity > piece.Capacity && len(spare) > 0:
+		spPiece, err := r.fillPiece(piece, spare, capacity)
 		if err != nil {
-			continue
+			return nil, fmt.Errorf("failed to fill piece for provider with capacity %d: %w", capacity, err)
 		}
-		if len(pieces) <= 0 {
+		return []*Piece{spPiece}, nil
+	case piece.Info.Size <= capacity:
+		return []*Piece{piece}, nil
+	}
+	// Re-pack the piece segments into pieces that fit the provider.
+	segments := piece.contentSegments()
+	spPieces, unpacked, err := r.j.replicatorPacker.Pack(segments, capacity, len(segments))
+	if err != nil {
+		return nil, fmt.Errorf("failed to re-pack piece for provider with capacity %d: %w", capacity, err)
+	}
+	if len(unpacked) > 0 {
+		logger.Warnw("some segments do not fit the maximum piece size of provider", "sp", sp, "capacity", capacity, "count", len(unpacked))
+	}
+	return spPieces, nil
+}
+
+// fillPiece packs the segments of the given piece along with the spare segments into a single piece of the given
+// capacity. It returns the given piece if the packer leaves any of its segments out, or adds no spare segment to it.
+func (r *simpleReplicator) fillPiece(piece *Piece, spare []*Segment, capacity abi.PaddedPieceSize) (*Piece, error) {
+	segments := piece.contentSegments()
+	filled, _, err := r.j.replicatorPacker.Pack(append(segments, spare...), capacity, 1)
+	if err != nil {
+		return nil, err
+	}
+NextPiece:
+	for _, candidate := range filled {
+		if len(candidate.Segments) <= len(piece.Segments) {
 			continue
 		}
-		for _, piece := range pieces {
-			sps, err := r.j.replicatorSpPicker(ctx, piece)
-			if err != nil {
-				continue
-			}
-			if len(sps) == 0 {
-				continue
-			}
-			for _, sp := range sps {
-				deal, err := r.j.dealer.Deal(ctx, piece, sp)
-				if err != nil {
-					continue
-				}
-				r.segmentReplicasMutex.Lock()
-				// Add an entry to piece replicas map for each segment of the piece
-				for _, segment := range piece.Segments {
-					replicas := r.segmentReplicas[segment.Info.PieceCID]
-					if replicas == nil {
-						replicas = make(map[uuid.UUID]*Replica)
-					}
-					replicas[deal.DealUUID] = &Replica{
-						DealProposal: *deal,
-					}
-					r.segmentReplicas[segment.Info.PieceCID] = replicas
-				}
-				r.segmentReplicasMutex.Unlock()
-				// TODO we might need to store piece CID -> replica deal UUID for retrieval.
+		packed := make(map[*Segment]struct{}, len(candidate.Segments))
+		for _, segment := range candidate.Segments {
+			packed[segment] = struct{}{}
+		}
+		for _, segment := range segments {
+			if _, ok := packed[segment]; !ok {
+				continue NextPiece
 			}
 		}
+		return candidate, nil
 	}
+	return piece, nil
+}
+
+// providerPieceCapacity returns the maximum size of piece that can be dealt with the given storage provider, i.e.
+// its sector size, unless a smaller maximum piece size is configured for it.
+func (r *simpleReplicator) providerPieceCapacity(ctx context.Context, sp address.Address) (abi.PaddedPieceSize, error) {
+	info, err := r.j.providers.info(ctx, sp)
+	if err != nil {
+		return 0, err
+	}
+	capacity := abi.PaddedPieceSize(info.SectorSize)
+	if err := capacity.Validate(); err != nil {
+		return 0, fmt.Errorf("invalid sector size for provider %s: %w", sp, err)
+	}
+	if size, ok := r.j.replicatorProviderPieceSizes[sp]; ok && size < capacity {
+		capacity = size
+	}
+	return capacity, nil
+}
+
+// addReplicas adds an entry to piece replicas map for each segment of the piece.
+func (r *simpleReplicator) addReplicas(piece *Piece, deal *boostly.DealProposal) {
+	r.segmentReplicasMutex.Lock()
+	defer r.segmentReplicasMutex.Unlock()
+	for _, segment := range piece.Segments {
+		replicas := r.segmentReplicas[segment.Info.PieceCID]
+		if replicas == nil {
+			replicas = make(map[uuid.UUID]*Replica)
+		}
+		replicas[deal.DealUUID] = &Replica{
+			DealProposal: *deal,
+		}
+		r.segmentReplicas[segment.Info.PieceCID] = replicas
+	}
+}
+
+// isReadyToDeal checks whether the piece meets the minimum fill ratio and bytes thresholds, or whether its oldest
+// segment has waited long enough that the piece should be dealt regardless.
+func (r *simpleReplicator) isReadyToDeal(piece *Piece, now time.Time) bool {
+	if piece.FillRatio() >= r.j.replicatorMinPieceFillRatio && piece.TotalSegmentedSize >= r.j.replicatorMinPieceBytes {
+		return true
+	}
+	if r.j.replicatorMaxSegmentWait <= 0 {
+		return false
+	}
+	oldest := piece.OldestSegmentCreateTime()
+	return !oldest.IsZero() && now.Sub(oldest) >= r.j.replicatorMaxSegmentWait
 }
 
 func (r *simpleReplicator) verify(ctx context.Context) {
@@ -237,39 +365,53 @@ func (r *simpleReplicator) verify(ctx context.Context) {
 		}
 
 		// Deduplicate all deals by deal UUID, since a segment may be present across multiple deals.
-		toCheck := make(map[uuid.UUID]Replica)
+		toCheck := make(map[uuid.UUID]*Replica)
 		r.segmentReplicasMutex.RLock()
 		for _, replicas := range r.segmentReplicas {
 			for id, replica := range replicas {
 				if _, ok := toCheck[id]; ok {
 					continue
 				}
-				toCheck[id] = *replica
+				replica := *replica
+				toCheck[id] = &replica
 			}
 		}
 		r.segmentReplicasMutex.RUnlock()
 
+		verifier, verifiesReplicas := r.j.dealer.(replicaVerifier)
+		var head abi.ChainEpoch
+		if verifiesReplicas {
+			chainHead, err := r.j.fil.ChainHead(ctx)
+			if err != nil {
+				logger.Errorw("failed to get chain head; skipping replica verification", "err", err)
+				continue
+			}
+			head = chainHead.Height
+		}
 		// TODO check in parallel with some configurable degree of concurrency.
 		for _, replica := range toCheck {
 
 			replica.LastChecked = time.Now()
 			replica.LastChainStatus = nil
 			replica.LastProviderStatus = nil
+			replica.LastAllocation = nil
+			replica.LastClaim = nil
 			replica.LastError = nil
 
+			if verifiesReplicas {
+				verifier.verifyReplica(ctx, replica, head)
+				continue
+			}
+
 			// TODO clean up expired deals
 			// TODO handle slashed deals
 
-			info, err := r.j.fil.StateMinerInfo(ctx, replica.Provider())
+			info, err := r.j.providers.connect(ctx, replica.Provider())
 			if err != nil {
-				replica.LastError = fmt.Errorf("failed to get state miner info: %w", err)
-				continue
-			}
-			if err := r.j.h.Connect(ctx, *info); err != nil {
 				replica.LastError = fmt.Errorf("failed to connect to provider: %w", err)
 				continue
 			}
-			replica.LastProviderStatus, err = boostly.GetDealStatus(ctx, r.j.h, info.ID, replica.DealProposal.DealUUID, r.j.wallet.Sign)
+			replica.LastProviderStatus, err = boostly.GetDealStatus(ctx, r.j.h, info.AddrInfo.ID, replica.DealProposal.DealUUID, r.j.wallet.Sign)
 			if err != nil {
 				replica.LastError = fmt.Errorf("failed to get deal status from provider: %w", err)
 				continue
@@ -278,6 +420,9 @@ func (r *simpleReplicator) verify(ctx context.Context) {
 				// Not published yet; nothing further to do.
 				continue
 			}
+			// Funds and DataCap needed by the proposal are now accounted for on chain.
+			r.j.escrow.release(replica.DealProposal.DealUUID)
+			r.j.dataCap.release(replica.DealProposal.DealUUID)
 
 			replica.LastChainStatus, err = r.j.fil.StateMarketStorageDeal(ctx, replica.LastProviderStatus.DealStatus.ChainDealID)
 			if err != nil {
@@ -304,6 +449,8 @@ func (r *simpleReplicator) verify(ctx context.Context) {
 					replica.LastChecked = checked.LastChecked
 					replica.LastChainStatus = checked.LastChainStatus
 					replica.LastProviderStatus = checked.LastProviderStatus
+					replica.LastAllocation = checked.LastAllocation
+					replica.LastClaim = checked.LastClaim
 					replica.LastError = checked.LastError
 				}
 			}
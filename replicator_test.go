@@ -0,0 +1,163 @@
+package jiffy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/builtin/v11/verifreg"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSimpleReplicator_IsReadyToDeal(t *testing.T) {
+	now := time.Now()
+	pieces, _, err := NewBestFitPacker().Pack([]*Segment{
+		newFakeSegment(t, 2*KiB, now.Add(-time.Hour)),
+		newFakeSegment(t, 1*KiB, now.Add(-time.Minute)),
+	}, 64*KiB, 1)
+	require.NoError(t, err)
+	piece := pieces[0]
+
+	tests := []struct {
+		name string
+		opts options
+		want bool
+	}{
+		{name: "no thresholds", want: true},
+		{name: "fill ratio met", opts: options{replicatorMinPieceFillRatio: piece.FillRatio()}, want: true},
+		{name: "fill ratio not met", opts: options{replicatorMinPieceFillRatio: 0.99}, want: false},
+		{name: "bytes not met", opts: options{replicatorMinPieceBytes: piece.TotalSegmentedSize + 1}, want: false},
+		{name: "bytes not met but waited long enough", opts: options{replicatorMinPieceBytes: piece.TotalSegmentedSize + 1, replicatorMaxSegmentWait: 30 * time.Minute}, want: true},
+		{name: "fill ratio not met and not waited long enough", opts: options{replicatorMinPieceFillRatio: 0.99, replicatorMaxSegmentWait: 2 * time.Hour}, want: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := test.opts
+			subject := &simpleReplicator{j: &Jiffy{options: &opts}}
+			require.Equal(t, test.want, subject.isReadyToDeal(piece, now))
+		})
+	}
+}
+
+func TestSimpleReplicator_IsReadyToDealHoldsBackNearlyEmptyPiece(t *testing.T) {
+	now := time.Now()
+	pieces, _, err := NewBestFitPacker().Pack([]*Segment{newFakeSegment(t, 4*KiB, now)}, 32*GiB, 1)
+	require.NoError(t, err)
+	piece := pieces[0]
+	// The padded piece is mostly occupied, but the sector it was packed for is not.
+	require.Greater(t, float64(piece.Segments[1].Info.Size)/float64(piece.Info.Size), 0.1)
+	require.Less(t, piece.FillRatio(), 0.0001)
+
+	subject := &simpleReplicator{j: &Jiffy{options: &options{replicatorMinPieceFillRatio: 0.1}}}
+	require.False(t, subject.isReadyToDeal(piece, now))
+}
+
+func TestReplica_StatusOfDirectDataOnboarding(t *testing.T) {
+	tests := []struct {
+		name    string
+		replica Replica
+		head    abi.ChainEpoch
+		want    ReplicaStatus
+	}{
+		{name: "pending", replica: Replica{}, want: Accepted},
+		{name: "allocated", replica: Replica{LastAllocation: &verifreg.Allocation{Expiration: 100}}, head: 50, want: Published},
+		{name: "allocation expired", replica: Replica{LastAllocation: &verifreg.Allocation{Expiration: 100}}, head: 100, want: Expired},
+		{name: "allocation never found", replica: Replica{LastError: ErrAllocationExpired}, head: 100, want: Expired},
+		{name: "claimed", replica: Replica{LastClaim: &verifreg.Claim{TermStart: 10, TermMax: 100}}, head: 50, want: Active},
+		{name: "claim expired", replica: Replica{LastClaim: &verifreg.Claim{TermStart: 10, TermMax: 100}}, head: 110, want: Expired},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			require.Equal(t, test.want, test.replica.Status(test.head))
+		})
+	}
+}
+
+func TestSimpleReplicator_PiecesForProvider(t *testing.T) {
+	newSp := func(id uint64) address.Address {
+		sp, err := address.NewIDAddress(id)
+		require.NoError(t, err)
+		return sp
+	}
+	small, same, large, capped, invalid := newSp(1000), newSp(1001), newSp(1002), newSp(1003), newSp(1004)
+	sectorSizes := map[address.Address]abi.SectorSize{
+		small:   abi.SectorSize(256 * KiB),
+		same:    abi.SectorSize(2 * MiB),
+		large:   abi.SectorSize(4 * MiB),
+		capped:  abi.SectorSize(4 * MiB),
+		invalid: abi.SectorSize(3 * KiB),
+	}
+	opts, err := applyTestOptions(
+		WithPacker(NewBestFitPacker()),
+		WithProviderMaxPieceSize(capped, 256*KiB),
+		WithProviderMaxPieceSize(same, 4*MiB),
+	)
+	require.NoError(t, err)
+	j := &Jiffy{options: opts}
+	j.providers, err = newProviderDirectory(j)
+	require.NoError(t, err)
+	for sp, size := range sectorSizes {
+		j.providers.entries[sp] = &providerEntry{
+			info:       ProviderInfo{Provider: sp, SectorSize: size},
+			infoExpiry: time.Now().Add(time.Hour),
+		}
+	}
+	subject, err := newSimpleReplicator(j)
+	require.NoError(t, err)
+
+	now := time.Now()
+	var segments []*Segment
+	for _, size := range []abi.PaddedPieceSize{64 * KiB, 64 * KiB, 64 * KiB} {
+		segments = append(segments, newFakeSegment(t, size, now))
+	}
+	pieces, spare, err := NewBestFitPacker().Pack(segments, 2*MiB, 1)
+	require.NoError(t, err)
+	require.Len(t, pieces, 1)
+	require.Empty(t, spare)
+	piece := pieces[0]
+	spare = []*Segment{newFakeSegment(t, 1*MiB, now), newFakeSegment(t, 8*MiB, now)}
+
+	tests := []struct {
+		name         string
+		sp           address.Address
+		spare        []*Segment
+		wantCapacity abi.PaddedPieceSize
+		wantPieces   int
+		wantSegments []*Segment
+		wantErr      bool
+	}{
+		{name: "re-packs for smaller sectors", sp: small, wantCapacity: 256 * KiB, wantPieces: 2, wantSegments: segments},
+		{name: "keeps piece of same capacity", sp: same, spare: spare, wantCapacity: 2 * MiB, wantPieces: 1, wantSegments: segments},
+		{name: "fills piece for larger sectors", sp: large, spare: spare, wantCapacity: 4 * MiB, wantPieces: 1, wantSegments: append(append([]*Segment{}, segments...), spare[0])},
+		{name: "keeps piece for larger sectors without spare", sp: large, wantCapacity: 4 * MiB, wantPieces: 1, wantSegments: segments},
+		{name: "re-packs for maximum piece size", sp: capped, spare: spare, wantCapacity: 256 * KiB, wantPieces: 2, wantSegments: segments},
+		{name: "invalid sector size", sp: invalid, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			gotCapacity, err := subject.providerPieceCapacity(ctx, test.sp)
+			if test.wantErr {
+				require.Error(t, err)
+				_, err = subject.piecesForProvider(ctx, piece, test.spare, test.sp)
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.wantCapacity, gotCapacity)
+
+			got, err := subject.piecesForProvider(ctx, piece, test.spare, test.sp)
+			require.NoError(t, err)
+			require.Len(t, got, test.wantPieces)
+			var gotSegments []*Segment
+			for _, spPiece := range got {
+				require.LessOrEqual(t, spPiece.Info.Size, test.wantCapacity)
+				gotSegments = append(gotSegments, spPiece.contentSegments()...)
+			}
+			require.ElementsMatch(t, test.wantSegments, gotSegments)
+		})
+	}
+}
@@ -6,7 +6,6 @@ import (
 
 	"github.com/filecoin-project/go-address"
 	"github.com/filecoin-project/go-state-types/abi"
-	"github.com/filecoin-shipyard/boostly"
 )
 
 var (
@@ -53,16 +52,8 @@ func (s *httpPieceRetriever) Retrieve(ctx context.Context, pi abi.PieceInfo) (io
 	}
 
 	var sp address.Address
-	info, err := s.j.fil.StateMinerInfo(ctx, sp)
-	if err != nil {
-		return nil, err
-	}
-	if err = s.j.h.Connect(ctx, *info); err != nil {
-		return nil, err
-	}
-
 	// Check what transports the SP supports
-	transports, err := boostly.QueryTransports(ctx, s.j.h, info.ID)
+	transports, err := s.j.providers.transports(ctx, sp)
 	if err != nil {
 		return nil, err
 	}
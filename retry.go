@@ -0,0 +1,219 @@
+package jiffy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-shipyard/boostly"
+)
+
+const (
+	// DealFailureTransient classifies failures that are likely to go away on their own, such as network errors and
+	// timeouts. Failures that match no other class are considered transient.
+	DealFailureTransient DealFailureClass = iota
+	// DealFailureRejected classifies failures where the storage provider rejected the deal proposal.
+	DealFailureRejected
+	// DealFailurePricing classifies failures where the deal cannot be made within the storage ask of the provider.
+	DealFailurePricing
+	// DealFailureFunds classifies failures where the client lacks the escrow or DataCap needed by the deal.
+	DealFailureFunds
+	// DealFailureProtocolUnsupported classifies failures where the provider does not support the deal protocol.
+	DealFailureProtocolUnsupported
+	// DealFailureBudget classifies failures where the deal would exceed the spending budget. Such deals are deferred
+	// to later replication cycles, e.g. once the daily budget resets.
+	DealFailureBudget
+	// DealFailureOutcomeUnknown classifies failures where the deal proposal was sent, but whether the provider
+	// accepted it cannot be told, e.g. because its response timed out and its deal status could not be queried.
+	DealFailureOutcomeUnknown
+)
+
+var (
+	dealFailureClassNames = map[DealFailureClass]string{
+		DealFailureTransient:           "transient",
+		DealFailureRejected:            "rejected",
+		DealFailurePricing:             "pricing",
+		DealFailureFunds:               "funds",
+		DealFailureProtocolUnsupported: "protocol-unsupported",
+		DealFailureBudget:              "budget",
+		DealFailureOutcomeUnknown:      "outcome-unknown",
+	}
+)
+
+type (
+	// DealFailureClass classifies the errors that fail deals, so that each class can be retried differently.
+	DealFailureClass int
+
+	// DealRetryPolicy determines how deals that fail with a given DealFailureClass are retried.
+	DealRetryPolicy struct {
+		// MaxAttempts is the maximum number of attempts at dealing a piece with a provider within a replication
+		// cycle, including the first. Values less than one are treated as one.
+		MaxAttempts int
+		// Backoff is the delay before the first retry. It doubles after each subsequent attempt.
+		Backoff time.Duration
+		// MaxBackoff caps the delay between attempts. Zero means no cap.
+		MaxBackoff time.Duration
+		// CooldownAfter is the number of consecutive deals failed with this class after which the provider is no
+		// longer dealt with for the Cooldown duration. Zero disables cooldown.
+		CooldownAfter int
+		Cooldown      time.Duration
+	}
+
+	// providerCooldown tracks consecutive deal failures per provider, and cools down the providers that fail
+	// repeatedly according to the DealRetryPolicy of the failure class.
+	providerCooldown struct {
+		j *Jiffy
+
+		mutex    sync.Mutex
+		failures map[address.Address]consecutiveFailures
+		until    map[address.Address]time.Time
+	}
+	consecutiveFailures struct {
+		class DealFailureClass
+		count int
+	}
+)
+
+func (c DealFailureClass) String() string {
+	if name, named := dealFailureClassNames[c]; named {
+		return name
+	}
+	return fmt.Sprintf("unnamed(%d)", c)
+}
+
+func defaultDealRetryPolicies() map[DealFailureClass]DealRetryPolicy {
+	return map[DealFailureClass]DealRetryPolicy{
+		DealFailureTransient: {MaxAttempts: 3, Backoff: 10 * time.Second, MaxBackoff: time.Minute},
+		DealFailureRejected:  {MaxAttempts: 1, CooldownAfter: 3, Cooldown: 6 * time.Hour},
+		DealFailurePricing:   {MaxAttempts: 1},
+		DealFailureFunds:     {MaxAttempts: 1},
+		// Providers rarely start supporting a protocol within hours; avoid hitting them every cycle.
+		DealFailureProtocolUnsupported: {MaxAttempts: 1, CooldownAfter: 1, Cooldown: 24 * time.Hour},
+		DealFailureBudget:              {MaxAttempts: 1},
+		// Retrying may duplicate a deal that the provider has accepted.
+		DealFailureOutcomeUnknown: {MaxAttempts: 1},
+	}
+}
+
+// classifyDealFailure returns the DealFailureClass of the given deal error.
+func classifyDealFailure(err error) DealFailureClass {
+	switch {
+	case errors.Is(err, ErrDealRejected):
+		return DealFailureRejected
+	case errors.Is(err, ErrAskNotSatisfiable):
+		return DealFailurePricing
+	case errors.Is(err, ErrInsufficientEscrow), errors.Is(err, ErrInsufficientDataCap):
+		return DealFailureFunds
+	case errors.Is(err, ErrProtocolUnsupported):
+		return DealFailureProtocolUnsupported
+	case errors.Is(err, ErrBudgetExceeded):
+		return DealFailureBudget
+	case errors.Is(err, ErrDealOutcomeUnknown):
+		return DealFailureOutcomeUnknown
+	default:
+		return DealFailureTransient
+	}
+}
+
+// backoff returns the delay before retrying after the given number of failed attempts.
+func (p DealRetryPolicy) backoff(attempts int) time.Duration {
+	backoff := p.Backoff
+	for i := 1; i < attempts; i++ {
+		if p.MaxBackoff > 0 && backoff >= p.MaxBackoff {
+			break
+		}
+		backoff *= 2
+	}
+	if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+		return p.MaxBackoff
+	}
+	return backoff
+}
+
+func newProviderCooldown(j *Jiffy) *providerCooldown {
+	return &providerCooldown{
+		j:        j,
+		failures: make(map[address.Address]consecutiveFailures),
+		until:    make(map[address.Address]time.Time),
+	}
+}
+
+// coolingDown returns the time until which the given provider is cooled down, and whether it is cooling down at
+// the given time.
+func (c *providerCooldown) coolingDown(sp address.Address, now time.Time) (time.Time, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	until, found := c.until[sp]
+	if found && !now.Before(until) {
+		delete(c.until, sp)
+		return time.Time{}, false
+	}
+	return until, found
+}
+
+// succeeded resets the consecutive failures of the given provider.
+func (c *providerCooldown) succeeded(sp address.Address) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.failures, sp)
+}
+
+// failed counts a deal with the given provider that failed with the given class, and cools down the provider if
+// the consecutive failures of that class reach the CooldownAfter threshold of its policy.
+func (c *providerCooldown) failed(sp address.Address, class DealFailureClass, now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	failures := c.failures[sp]
+	if failures.class != class {
+		failures = consecutiveFailures{class: class}
+	}
+	failures.count++
+	policy := c.j.dealRetryPolicies[class]
+	if policy.CooldownAfter <= 0 || failures.count < policy.CooldownAfter {
+		c.failures[sp] = failures
+		return
+	}
+	delete(c.failures, sp)
+	c.until[sp] = now.Add(policy.Cooldown)
+	logger.Warnw("cooling down provider after repeated deal failures", "sp", sp, "class", class, "failures", failures.count, "until", c.until[sp])
+}
+
+// deal deals the given piece with sp, retrying failed attempts with exponential backoff according to the
+// DealRetryPolicy of their failure class. Deals that fail after all attempts count towards the cooldown of sp.
+func (r *simpleReplicator) deal(ctx context.Context, piece *Piece, sp address.Address) (*boostly.DealProposal, error) {
+	for attempt := 1; ; attempt++ {
+		deal, err := r.dealOnce(ctx, piece, sp)
+		if err == nil {
+			r.cooldown.succeeded(sp)
+			return deal, nil
+		}
+		class := classifyDealFailure(err)
+		policy := r.j.dealRetryPolicies[class]
+		if attempt >= policy.MaxAttempts || ctx.Err() != nil {
+			r.cooldown.failed(sp, class, time.Now())
+			return nil, err
+		}
+		backoff := policy.backoff(attempt)
+		logger.Warnw("retrying failed deal", "piece", piece.Info.PieceCID, "sp", sp, "class", class, "attempt", attempt, "backoff", backoff, "err", err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// dealOnce makes a single attempt at dealing the given piece with sp, bounded by WithDealProposalTimeout.
+func (r *simpleReplicator) dealOnce(ctx context.Context, piece *Piece, sp address.Address) (*boostly.DealProposal, error) {
+	if r.j.dealProposalTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.j.dealProposalTimeout)
+		defer cancel()
+	}
+	return r.j.dealer.Deal(ctx, piece, sp)
+}
@@ -0,0 +1,168 @@
+package jiffy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-shipyard/boostly"
+	"github.com/stretchr/testify/require"
+)
+
+type funcDealer func(context.Context, *Piece, address.Address) (*boostly.DealProposal, error)
+
+func (f funcDealer) Deal(ctx context.Context, piece *Piece, sp address.Address) (*boostly.DealProposal, error) {
+	return f(ctx, piece, sp)
+}
+
+func TestClassifyDealFailure(t *testing.T) {
+	tests := []struct {
+		err  error
+		want DealFailureClass
+	}{
+		{err: errors.New("connection refused"), want: DealFailureTransient},
+		{err: context.DeadlineExceeded, want: DealFailureTransient},
+		{err: fmt.Errorf("%w by f01: no space", ErrDealRejected), want: DealFailureRejected},
+		{err: fmt.Errorf("%w: too expensive", ErrAskNotSatisfiable), want: DealFailurePricing},
+		{err: fmt.Errorf("%w: short", ErrInsufficientEscrow), want: DealFailureFunds},
+		{err: fmt.Errorf("%w: short", ErrInsufficientDataCap), want: DealFailureFunds},
+		{err: fmt.Errorf("%w: sp f01 does not support it", ErrProtocolUnsupported), want: DealFailureProtocolUnsupported},
+		{err: fmt.Errorf("%w: failed to read response: stream reset", ErrDealOutcomeUnknown), want: DealFailureOutcomeUnknown},
+	}
+	for _, test := range tests {
+		t.Run(test.err.Error(), func(t *testing.T) {
+			require.Equal(t, test.want, classifyDealFailure(test.err))
+		})
+	}
+}
+
+func TestDealRetryPolicy_Backoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   DealRetryPolicy
+		attempts int
+		want     time.Duration
+	}{
+		{name: "first", policy: DealRetryPolicy{Backoff: time.Second}, attempts: 1, want: time.Second},
+		{name: "doubled", policy: DealRetryPolicy{Backoff: time.Second}, attempts: 4, want: 8 * time.Second},
+		{name: "capped", policy: DealRetryPolicy{Backoff: time.Second, MaxBackoff: 5 * time.Second}, attempts: 4, want: 5 * time.Second},
+		{name: "capped many", policy: DealRetryPolicy{Backoff: time.Second, MaxBackoff: time.Minute}, attempts: 1000, want: time.Minute},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			require.Equal(t, test.want, test.policy.backoff(test.attempts))
+		})
+	}
+}
+
+func TestProviderCooldown(t *testing.T) {
+	opts, err := applyTestOptions(WithDealRetryPolicy(DealFailureRejected, DealRetryPolicy{CooldownAfter: 2, Cooldown: time.Hour}))
+	require.NoError(t, err)
+	subject := newProviderCooldown(&Jiffy{options: opts})
+	sp, err := address.NewIDAddress(1413)
+	require.NoError(t, err)
+	now := time.Now()
+
+	subject.failed(sp, DealFailureRejected, now)
+	_, cooling := subject.coolingDown(sp, now)
+	require.False(t, cooling)
+
+	// A success resets consecutive failures.
+	subject.succeeded(sp)
+	subject.failed(sp, DealFailureRejected, now)
+	_, cooling = subject.coolingDown(sp, now)
+	require.False(t, cooling)
+
+	// Failures of another class reset consecutive failures.
+	subject.failed(sp, DealFailurePricing, now)
+	subject.failed(sp, DealFailureRejected, now)
+	_, cooling = subject.coolingDown(sp, now)
+	require.False(t, cooling)
+
+	subject.failed(sp, DealFailureRejected, now)
+	until, cooling := subject.coolingDown(sp, now)
+	require.True(t, cooling)
+	require.Equal(t, now.Add(time.Hour), until)
+
+	_, cooling = subject.coolingDown(sp, now.Add(time.Hour))
+	require.False(t, cooling)
+}
+
+func TestSimpleReplicator_Deal(t *testing.T) {
+	sp, err := address.NewIDAddress(1413)
+	require.NoError(t, err)
+	piece := &Piece{Info: newFakeSegment(t, 2*KiB, time.Now()).Info}
+
+	tests := []struct {
+		name         string
+		errs         []error
+		wantAttempts int
+		wantErr      error
+		wantCooling  bool
+	}{
+		{
+			name:         "transient then success",
+			errs:         []error{errors.New("timeout"), nil},
+			wantAttempts: 2,
+		},
+		{
+			name:         "transient exhausted",
+			errs:         []error{errors.New("timeout"), errors.New("timeout"), errors.New("timeout")},
+			wantAttempts: 3,
+			wantErr:      errors.New("timeout"),
+		},
+		{
+			name:         "pricing not retried",
+			errs:         []error{ErrAskNotSatisfiable},
+			wantAttempts: 1,
+			wantErr:      ErrAskNotSatisfiable,
+		},
+		{
+			name:         "outcome unknown not retried",
+			errs:         []error{ErrDealOutcomeUnknown},
+			wantAttempts: 1,
+			wantErr:      ErrDealOutcomeUnknown,
+		},
+		{
+			name:         "protocol unsupported cools down",
+			errs:         []error{ErrProtocolUnsupported},
+			wantAttempts: 1,
+			wantErr:      ErrProtocolUnsupported,
+			wantCooling:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts, err := applyTestOptions(WithDealRetryPolicy(DealFailureTransient, DealRetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}))
+			require.NoError(t, err)
+			j := &Jiffy{options: opts}
+			var attempts int
+			j.dealer = funcDealer(func(context.Context, *Piece, address.Address) (*boostly.DealProposal, error) {
+				err := test.errs[attempts]
+				attempts++
+				if err != nil {
+					return nil, err
+				}
+				return &boostly.DealProposal{}, nil
+			})
+			subject, err := newSimpleReplicator(j)
+			require.NoError(t, err)
+
+			got, err := subject.deal(context.Background(), piece, sp)
+			require.Equal(t, test.wantAttempts, attempts)
+			if test.wantErr != nil {
+				require.Error(t, err)
+				require.Equal(t, test.wantErr.Error(), err.Error())
+				require.Nil(t, got)
+			} else {
+				require.NoError(t, err)
+				require.NotNil(t, got)
+			}
+			_, cooling := subject.cooldown.coolingDown(sp, time.Now())
+			require.Equal(t, test.wantCooling, cooling)
+		})
+	}
+}
@@ -3,9 +3,11 @@ package jiffy
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	commcid "github.com/filecoin-project/go-fil-commcid"
@@ -23,7 +25,7 @@ var (
 
 type (
 	Segmentor interface {
-		Segment(context.Context, io.ReadCloser) (*Segment, error)
+		Segment(context.Context, io.ReadCloser, ...SegmentOption) (*Segment, error)
 		GetSegment(context.Context, abi.PieceInfo) (*Segment, error)
 		ListSegments(context.Context) ([]*Segment, error)
 	}
@@ -35,15 +37,30 @@ type (
 		SegmentedSize uint64
 		// CreateTime is the time at which this segment was created.
 		CreateTime time.Time
+		// AffinityGroup is the group to which the segment belongs, e.g. a tenant. Segments are only packed together
+		// with segments of the same group, or groups that are allowed to share pieces.
+		AffinityGroup string
+		// Root is the root CID of the DAG that the segment data represents, e.g. a UnixFS or CAR root, if known.
+		// See SegmentWithRoot.
+		Root cid.Cid
 	}
 
 	headlessCarSegmentor struct {
-		j        *Jiffy
-		segments map[cid.Cid]headlessCarSegment // TODO implement persistent storage
+		j *Jiffy
+
+		segmentsMutex sync.RWMutex
+		segments      map[cid.Cid]headlessCarSegment // TODO implement persistent storage
 	}
 	headlessCarSegment struct {
 		Segment
 		path string // TODO might not need this
+		// index maps the multihash of each CAR section CID in the segment to the location of its data.
+		index map[string]sectionLocation
+	}
+	// sectionLocation represents the location of a CAR section data within a segment file.
+	sectionLocation struct {
+		offset int64
+		length int64
 	}
 )
 
@@ -52,10 +69,14 @@ type (
 //       See: https://github.com/ipfs/go-unixfsnode/issues/58
 
 func newHeadlessCarSegmentor(j *Jiffy) (*headlessCarSegmentor, error) {
-	return &headlessCarSegmentor{j: j}, nil
+	return &headlessCarSegmentor{
+		j:        j,
+		segments: make(map[cid.Cid]headlessCarSegment),
+	}, nil
 }
 
-func (c *headlessCarSegmentor) Segment(ctx context.Context, in io.ReadCloser) (*Segment, error) {
+func (c *headlessCarSegmentor) Segment(ctx context.Context, in io.ReadCloser, o ...SegmentOption) (*Segment, error) {
+	opts := newSegmentOptions(o...)
 
 	// TODO: because segmentation in Jiffy works with piece CIDs, we can detect duplicate blobs. Capitalize on it.
 
@@ -66,6 +87,7 @@ func (c *headlessCarSegmentor) Segment(ctx context.Context, in io.ReadCloser) (*
 	splitter := chunk.NewSizeSplitter(in, c.j.segmentorChunkSizeBytes)
 	var cc commp.Calc
 	var rawSize, segmentedSize uint64
+	index := make(map[string]sectionLocation)
 	out := io.MultiWriter(&cc, sf)
 	var erroneousCleanup = func() {
 		_ = sf.Close()
@@ -93,11 +115,26 @@ func (c *headlessCarSegmentor) Segment(ctx context.Context, in io.ReadCloser) (*
 				return nil, err
 			}
 			_ = sf.Close()
+			c.segmentsMutex.Lock()
+			defer c.segmentsMutex.Unlock()
+			// Refuse identical data from another affinity group, so that neither group's segment is packed with,
+			// charged to or labelled as the other group.
+			existing, known := c.segments[pcid]
+			if known && existing.AffinityGroup != opts.affinityGroup {
+				erroneousCleanup()
+				return nil, fmt.Errorf("%w: %s belongs to group %q", ErrSegmentAffinityConflict, pcid, existing.AffinityGroup)
+			}
 			finalSegmentPath := filepath.Join(c.j.segmentorStoreDir, pcid.String()+".headless.car")
 			if err := os.Rename(sf.Name(), finalSegmentPath); err != nil {
 				// TODO check for already exists error meaning blob is duplicate
 				return nil, err
 			}
+			// Keep the creation time of known segments, so that segmenting the same data again does not reset the
+			// wait set by WithMaxSegmentWait.
+			createTime := time.Now()
+			if known {
+				createTime = existing.CreateTime
+			}
 			segment := headlessCarSegment{
 				Segment: Segment{
 					Info: abi.PieceInfo{
@@ -106,8 +143,12 @@ func (c *headlessCarSegmentor) Segment(ctx context.Context, in io.ReadCloser) (*
 					},
 					RawSize:       rawSize,
 					SegmentedSize: segmentedSize,
+					CreateTime:    createTime,
+					AffinityGroup: opts.affinityGroup,
+					Root:          opts.root,
 				},
-				path: finalSegmentPath,
+				path:  finalSegmentPath,
+				index: index,
 			}
 			c.segments[pcid] = segment
 			return &segment.Segment, nil
@@ -120,18 +161,25 @@ func (c *headlessCarSegmentor) Segment(ctx context.Context, in io.ReadCloser) (*
 				erroneousCleanup()
 				return nil, ErrSegmentTooLarge
 			}
-			sectionSize, err := car.Section(b).WriteTo(out)
+			sectionCid, sectionSize, err := car.Section(b).Encode(out)
 			if err != nil {
 				erroneousCleanup()
 				return nil, err
 			}
+			// Section data is always written last; therefore, its offset is at the end of section minus data length.
+			index[string(sectionCid.Hash())] = sectionLocation{
+				offset: int64(segmentedSize) + sectionSize - int64(len(b)),
+				length: int64(len(b)),
+			}
 			segmentedSize += uint64(sectionSize)
 		}
 	}
 }
 
 func (c *headlessCarSegmentor) GetSegment(ctx context.Context, info abi.PieceInfo) (*Segment, error) {
+	c.segmentsMutex.RLock()
 	segment, ok := c.segments[info.PieceCID]
+	c.segmentsMutex.RUnlock()
 	if !ok {
 		return nil, ErrSegmentNotFound
 	}
@@ -144,12 +192,15 @@ func (c *headlessCarSegmentor) GetSegment(ctx context.Context, info abi.PieceInf
 }
 
 func (c *headlessCarSegmentor) ListSegments(ctx context.Context) ([]*Segment, error) {
+	c.segmentsMutex.RLock()
+	defer c.segmentsMutex.RUnlock()
 	switch count := len(c.segments); {
 	case count == 0:
 		return nil, nil
 	default:
 		list := make([]*Segment, 0, count)
 		for _, segment := range c.segments {
+			segment := segment
 			select {
 			case <-ctx.Done():
 				return nil, ctx.Err()
@@ -162,7 +213,9 @@ func (c *headlessCarSegmentor) ListSegments(ctx context.Context) ([]*Segment, er
 }
 
 func (c *headlessCarSegmentor) Retrieve(ctx context.Context, info abi.PieceInfo) (io.ReadSeekCloser, error) {
+	c.segmentsMutex.RLock()
 	segment, ok := c.segments[info.PieceCID]
+	c.segmentsMutex.RUnlock()
 	if !ok {
 		return nil, ErrSegmentNotFound
 	}
@@ -176,3 +229,16 @@ func (c *headlessCarSegmentor) Retrieve(ctx context.Context, info abi.PieceInfo)
 		return os.Open(segment.path)
 	}
 }
+
+// locate finds the segment file path and the location of the CAR section data that corresponds to the given CID.
+func (c *headlessCarSegmentor) locate(key cid.Cid) (string, sectionLocation, bool) {
+	mh := string(key.Hash())
+	c.segmentsMutex.RLock()
+	defer c.segmentsMutex.RUnlock()
+	for _, segment := range c.segments {
+		if location, ok := segment.index[mh]; ok {
+			return segment.path, location, true
+		}
+	}
+	return "", sectionLocation{}, false
+}